@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// measureQueries runs each query once, returning how long each took.
+func measureQueries(mm map[string]*query.Metadata, c Config) (map[string]time.Duration, error) {
+	elapsed := map[string]time.Duration{}
+	for _, name := range verifyOrder(mm, false) {
+		klog.Infof("Measuring %q ...", name)
+		rr, err := c.runQuery(mm[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		elapsed[name] = rr.Elapsed
+	}
+	return elapsed, nil
+}
+
+// fitBudget increases query intervals until the projected total daily duration fits within the budget.
+// The least valuable queries, by numeric value, are throttled first, up to maxSeconds.
+func fitBudget(mm map[string]*query.Metadata, elapsed map[string]time.Duration, budget time.Duration, maxSeconds int) error {
+	var total time.Duration
+	for name, m := range mm {
+		d, _, err := dailyQueryDuration(m.Interval, elapsed[name])
+		if err != nil {
+			return fmt.Errorf("%q: failed to parse interval: %v", name, err)
+		}
+		total += d
+	}
+
+	if total <= budget {
+		klog.Infof("projected daily duration %s fits within %s", total.Round(time.Second), budget)
+		return nil
+	}
+
+	// least valuable first: unscored queries, then ascending value
+	names := verifyOrder(mm, false)
+	sort.SliceStable(names, func(i, j int) bool {
+		vi, iok := queryValue(mm[names[i]])
+		vj, jok := queryValue(mm[names[j]])
+		if iok != jok {
+			return !iok
+		}
+		return vi < vj
+	})
+
+	for _, name := range names {
+		if total <= budget {
+			break
+		}
+		m := mm[name]
+		if elapsed[name] <= 0 {
+			continue
+		}
+
+		cost, _, err := dailyQueryDuration(m.Interval, elapsed[name])
+		if err != nil {
+			return fmt.Errorf("%q: failed to parse interval: %v", name, err)
+		}
+
+		// dailyQueryDuration inverted: (86400 / interval) * elapsed <= target
+		target := cost - (total - budget)
+		interval := maxSeconds
+		if target > 0 {
+			interval = int(math.Ceil(86400 * elapsed[name].Seconds() / target.Seconds()))
+		}
+		if interval > maxSeconds {
+			interval = maxSeconds
+		}
+
+		current, _ := strconv.Atoi(m.Interval)
+		if interval <= current {
+			continue
+		}
+
+		m.Interval = strconv.Itoa(interval)
+		reduced, _, err := dailyQueryDuration(m.Interval, elapsed[name])
+		if err != nil {
+			return fmt.Errorf("%q: failed to parse interval: %v", name, err)
+		}
+		total -= cost - reduced
+		klog.Infof("throttling %q (value %q) from %ds to %ds to fit the daily budget", name, m.Value, current, interval)
+	}
+
+	if total > budget {
+		return fmt.Errorf("projected daily duration %s exceeds %s even at the maximum interval", total.Round(time.Second), budget)
+	}
+	klog.Infof("projected daily duration is now %s, within %s", total.Round(time.Second), budget)
+	return nil
+}
+
+// fitPackBudget measures the queries and throttles them to fit within --max-total-daily-duration.
+func fitPackBudget(mm map[string]*query.Metadata, c Config) error {
+	elapsed, err := measureQueries(mm, c)
+	if err != nil {
+		return fmt.Errorf("measure: %w", err)
+	}
+	if err := fitBudget(mm, elapsed, c.MaxTotalQueryDurationPerDay, int(c.MaxInterval.Seconds())); err != nil {
+		return fmt.Errorf("fit budget: %w", err)
+	}
+	return nil
+}
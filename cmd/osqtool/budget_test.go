@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFitBudget(t *testing.T) {
+	mm := map[string]*query.Metadata{
+		"critical": {Name: "critical", Interval: "60", Value: "10"},
+		"useful":   {Name: "useful", Interval: "60", Value: "5"},
+		"trivia":   {Name: "trivia", Interval: "60", Value: "1"},
+	}
+	// each runs 1440 times per day, costing 1440s: 4320s in total
+	elapsed := map[string]time.Duration{
+		"critical": time.Second,
+		"useful":   time.Second,
+		"trivia":   time.Second,
+	}
+
+	if err := fitBudget(mm, elapsed, 1500*time.Second, 3600); err != nil {
+		t.Fatalf("fitBudget: %v", err)
+	}
+
+	got := map[string]string{}
+	for name, m := range mm {
+		got[name] = m.Interval
+	}
+	// trivia can only drop to 24s per day at the max interval, so useful is throttled to 36s per day
+	want := map[string]string{
+		"critical": "60",
+		"useful":   "2400",
+		"trivia":   "3600",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("intervals mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := fitBudget(mm, elapsed, time.Second, 3600); err == nil {
+		t.Errorf("fitBudget() = nil, want error for an impossible budget")
+	}
+}
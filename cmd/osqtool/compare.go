@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// loadGolden loads the rows of a query from a golden file written by run with --format=json.
+func loadGolden(dir string, name string) ([]query.Row, error) {
+	bs, err := os.ReadFile(filepath.Join(dir, name+outputExtensions[formatJSON]))
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []query.Row{}
+	if err := json.Unmarshal(bs, &rows); err != nil {
+		return nil, fmt.Errorf("parse golden file: %w", err)
+	}
+	return rows, nil
+}
+
+// compareQueries runs a list of compatible queries concurrently, reporting the rows that were added, removed, or changed
+// compared to the golden files within dir, and returning an error if any query differs.
+func compareQueries(w io.Writer, dir string, qs []*query.Metadata, c Config) error {
+	errs := []error{}
+	changed := 0
+
+	results := startQueries(qs, c)
+	for i, m := range qs {
+		<-results[i].done
+
+		golden, err := loadGolden(dir, m.Name)
+		if err != nil {
+			fmt.Fprintf(w, "? %s: %v\n", m.Name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+			continue
+		}
+
+		vf, err := results[i].vf, results[i].err
+		if err != nil {
+			klog.Errorf("%q failed: %v", m.Name, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		d := query.DiffRows(golden, vf.Rows, c.IgnoreColumns)
+		if d.Empty() {
+			klog.V(1).Infof("%q matches its golden file (%d rows)", m.Name, len(vf.Rows))
+			continue
+		}
+
+		changed++
+		fmt.Fprintf(w, "~ %s (%d added, %d removed, %d changed)\n", m.Name, len(d.Added), len(d.Removed), len(d.Changed))
+		for _, r := range d.Added {
+			fmt.Fprintf(w, "    + %s\n", r)
+		}
+		for _, r := range d.Removed {
+			fmt.Fprintf(w, "    - %s\n", r)
+		}
+		for _, rc := range d.Changed {
+			fmt.Fprintf(w, "    ~ %s -> %s\n", rc.Before, rc.After)
+		}
+	}
+
+	if changed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d queries differ from the golden files in %s", changed, len(qs), dir))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompareQueries(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"users.sql":     "SELECT username, uid FROM users;",
+		"processes.sql": "SELECT pid, name FROM processes;",
+	})
+	golden := filepath.Join(t.TempDir(), "golden")
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Format: formatJSON, Workers: 2}
+
+	stubOsqueryi(t, `case "$(cat)" in
+  *users*) echo '[{"username":"root","uid":"0"},{"username":"nobody","uid":"65534"},{"username":"daemon","uid":"1"}]' ;;
+  *) echo '[{"pid":"1","name":"init"}]' ;;
+esac`)
+	if err := Run([]string{dir}, golden+"/", c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// The pid of init changes, a user is replaced, and the uid of root changes
+	stubOsqueryi(t, `case "$(cat)" in
+  *users*) echo '[{"username":"nobody","uid":"65534"},{"username":"dev","uid":"1000"},{"username":"root","uid":"2"}]' ;;
+  *) echo '[{"pid":"7","name":"init"}]' ;;
+esac`)
+	c.Compare = golden
+	c.IgnoreColumns = []string{"pid"}
+
+	mm, err := loadAndApply([]string{dir}, c)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var sb strings.Builder
+	err = compareQueries(&sb, golden, []*query.Metadata{mm["processes"], mm["users"]}, c)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 queries differ") {
+		t.Errorf("compareQueries() = %v, want 1 of 2 queries differ", err)
+	}
+
+	want := `~ users (1 added, 1 removed, 1 changed)
+    + uid:1000 username:dev
+    - uid:1 username:daemon
+    ~ uid:0 username:root -> uid:2 username:root
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("compare output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompareMissingGolden(t *testing.T) {
+	stubOsqueryi(t, `echo '[]'`)
+	dir := writeQueries(t, map[string]string{"users.sql": "SELECT * FROM users;"})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Compare: t.TempDir()}
+
+	var sb strings.Builder
+	qs, err := loadAndApply([]string{dir}, c)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	err = compareQueries(&sb, c.Compare, []*query.Metadata{qs["users"]}, c)
+	if err == nil {
+		t.Errorf("compareQueries() = nil, want error for missing golden file")
+	}
+	if !strings.HasPrefix(sb.String(), "? users: ") {
+		t.Errorf("compareQueries() output = %q, want missing golden file report", sb.String())
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+// Convert re-renders osquery packs in single-line form, or multi-line form with --multi-line,
+// without changing their intervals, exclusions, or other metadata.
+func Convert(sourcePaths []string, output string, c Config) error {
+	ps := []*query.Pack{}
+
+	for _, path := range sourcePaths {
+		p, err := query.LoadPackWithConfig(path, c.parseConfig())
+		if err != nil {
+			return fmt.Errorf("load pack %s: %v", path, err)
+		}
+
+		if !c.MultiLine {
+			for _, m := range p.Queries {
+				m.Query = m.SingleLineQuery
+			}
+		}
+		ps = append(ps, p)
+	}
+
+	bs, err := query.RenderPack(query.FlattenPacks(ps), c.renderConfig())
+	if err != nil {
+		return fmt.Errorf("render: %v", err)
+	}
+
+	if output == "" {
+		_, err = fmt.Println(string(bs))
+		return err
+	}
+
+	return os.WriteFile(output, bs, 0o600)
+}
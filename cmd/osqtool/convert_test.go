@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConvert(t *testing.T) {
+	multiLine := `{
+  "queries": {
+    "listeners": {
+      "query": "SELECT pid, port \
+    FROM listening_ports \
+    WHERE port > 1024;",
+      "interval": "5",
+      "description": "Listening ports"
+    },
+    "experimental": {
+      "query": "SELECT * FROM processes;",
+      "interval": "604800"
+    }
+  }
+}`
+	source := writePacks(t, multiLine)[0]
+	output := filepath.Join(t.TempDir(), "converted.conf")
+
+	// Intervals and exclusions are left alone, unlike apply
+	c := Config{MinInterval: time.Minute, MaxInterval: time.Hour, Exclude: []string{"experimental"}, ValidateJSON: true}
+	if err := Convert([]string{source}, output, c); err != nil {
+		t.Fatalf("Convert() = %v", err)
+	}
+
+	bs, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	got := &query.Pack{}
+	if err := json.Unmarshal(bs, got); err != nil {
+		t.Fatalf("converted pack is not valid JSON: %v\n%s", err, bs)
+	}
+
+	want := map[string][2]string{
+		"listeners":    {"SELECT pid, port FROM listening_ports WHERE port > 1024;", "5"},
+		"experimental": {"SELECT * FROM processes;", "604800"},
+	}
+	gotQueries := map[string][2]string{}
+	for name, m := range got.Queries {
+		gotQueries[name] = [2]string{m.Query, m.Interval}
+	}
+	if diff := cmp.Diff(want, gotQueries); diff != "" {
+		t.Errorf("converted queries mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// Dedupe reports groups of queries with the same normalized SQL to w. With --fix, the first query
+// of each group by name is kept, and a pack without the others is written to output.
+func Dedupe(paths []string, output string, w io.Writer, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+
+	groups := query.DuplicateQueries(mm, c.IgnoreCase)
+	for _, g := range groups {
+		fmt.Fprintf(w, "duplicate: %s\n", strings.Join(g, ", "))
+	}
+
+	if !c.Fix {
+		if len(groups) > 0 {
+			return fmt.Errorf("%d groups of duplicate queries found", len(groups))
+		}
+		return nil
+	}
+
+	removed := 0
+	for _, g := range groups {
+		for _, name := range g[1:] {
+			klog.Infof("Removing %q, a duplicate of %q", name, g[0])
+			delete(mm, name)
+			removed++
+		}
+	}
+	klog.Infof("Removed %d duplicate queries, %d remain", removed, len(mm))
+
+	bs, err := c.renderPack(&query.Pack{Queries: mm})
+	if err != nil {
+		return fmt.Errorf("render: %v", err)
+	}
+
+	if output == "" {
+		_, err = fmt.Println(string(bs))
+		return err
+	}
+	return os.WriteFile(output, bs, 0o600)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+func TestDedupe(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"users.sql":      "SELECT uid FROM users;",
+		"users-copy.sql": "-- Same thing\nSELECT uid\nFROM users;",
+		"processes.sql":  "SELECT pid FROM processes;",
+	})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+
+	var sb strings.Builder
+	if err := Dedupe([]string{dir}, "", &sb, c); err == nil {
+		t.Errorf("Dedupe() = nil, want error for duplicates")
+	}
+	if got := sb.String(); got != "duplicate: users, users-copy\n" {
+		t.Errorf("Dedupe() reported %q", got)
+	}
+
+	output := filepath.Join(t.TempDir(), "deduped.conf")
+	c.Fix = true
+	if err := Dedupe([]string{dir}, output, &sb, c); err != nil {
+		t.Fatalf("Dedupe(fix) = %v", err)
+	}
+
+	p, err := query.LoadPack(output)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(p.Queries) != 2 || p.Queries["users"] == nil || p.Queries["users-copy"] != nil {
+		t.Errorf("deduped pack has %v, want processes and users", p.Queries)
+	}
+}
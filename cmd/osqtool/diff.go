@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+// Diff compares the queries of two packs, returning an error if they differ.
+func Diff(paths []string, w io.Writer, c Config) error {
+	if len(paths) != 2 {
+		return fmt.Errorf("diff requires two packs, got %d", len(paths))
+	}
+
+	a, err := query.LoadPackWithConfig(paths[0], c.parseConfig())
+	if err != nil {
+		return fmt.Errorf("load %s: %w", paths[0], err)
+	}
+	b, err := query.LoadPackWithConfig(paths[1], c.parseConfig())
+	if err != nil {
+		return fmt.Errorf("load %s: %w", paths[1], err)
+	}
+
+	d := query.DiffPacks(a, b)
+
+	switch c.Format {
+	case "", formatText:
+		fmt.Fprint(w, d)
+	case formatJSON:
+		bs, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		fmt.Fprintln(w, string(bs))
+	default:
+		return fmt.Errorf("unsupported format for diff: %q", c.Format)
+	}
+
+	if !d.Empty() {
+		return fmt.Errorf("%d added, %d removed, %d changed", len(d.Added), len(d.Removed), len(d.Changed))
+	}
+	return nil
+}
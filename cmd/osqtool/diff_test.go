@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+)
+
+func writePacks(t *testing.T, packs ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	paths := []string{}
+	for i, p := range packs {
+		path := filepath.Join(dir, string(rune('a'+i))+".conf")
+		if err := os.WriteFile(path, []byte(p), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestDiff(t *testing.T) {
+	paths := writePacks(t,
+		`{"queries": {
+  "users": {"query": "SELECT * FROM users;", "interval": "3600"},
+  "legacy": {"query": "SELECT * FROM kernel_extensions;", "interval": "3600", "platform": "darwin"},
+  "uptime": {"query": "SELECT * FROM uptime;", "interval": "60"}
+}}`,
+		`{"queries": {
+  "users": {"query": "SELECT uid, username FROM users;", "interval": "86400"},
+  "shells": {"query": "SELECT * FROM processes WHERE name = 'sh';", "interval": "600"},
+  "uptime": {"query": "SELECT * FROM uptime;", "interval": "60"}
+}}`)
+
+	var sb strings.Builder
+	if err := Diff(paths, &sb, Config{}); err == nil {
+		t.Errorf("Diff() = nil, want error for differing packs")
+	}
+
+	want := `+ shells
+- legacy
+~ users
+    query: "SELECT * FROM users;" -> "SELECT uid, username FROM users;"
+    interval: "3600" -> "86400"
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("Diff() output mismatch (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	if err := Diff(paths, &sb, Config{Format: formatJSON}); err == nil {
+		t.Errorf("Diff() = nil, want error for differing packs")
+	}
+	got := &query.PackDiff{}
+	if err := json.Unmarshal([]byte(sb.String()), got); err != nil {
+		t.Fatalf("unmarshal %q: %v", sb.String(), err)
+	}
+	if diff := cmp.Diff([]string{"shells"}, got.Added); diff != "" {
+		t.Errorf("added mismatch (-want +got):\n%s", diff)
+	}
+	if n := len(got.Changed["users"]); n != 2 {
+		t.Errorf("users has %d changes, want 2", n)
+	}
+
+	sb.Reset()
+	if err := Diff([]string{paths[0], paths[0]}, &sb, Config{}); err != nil {
+		t.Errorf("Diff() of identical packs = %v, want nil", err)
+	}
+	if sb.String() != "" {
+		t.Errorf("Diff() of identical packs output = %q, want none", sb.String())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// queryDocs renders the documentation for a query as Markdown, using a heading of the given level for its name.
+func queryDocs(m *query.Metadata, level int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s\n\n", strings.Repeat("#", level), m.Name)
+
+	if m.Description != "" {
+		fmt.Fprintf(&sb, "%s\n\n", m.Description)
+	}
+	if m.ExtendedDescription != "" {
+		fmt.Fprintf(&sb, "%s\n\n", m.ExtendedDescription)
+	}
+
+	platform := m.Platform
+	if platform == "" {
+		platform = "any"
+	}
+	fmt.Fprintf(&sb, "* Platform: %s\n", platform)
+	if m.Interval != "" {
+		fmt.Fprintf(&sb, "* Interval: %s\n", formatInterval(m.Interval, true))
+	}
+	if m.Author != "" {
+		fmt.Fprintf(&sb, "* Author: %s\n", m.Author)
+	}
+	if len(m.Tags) > 0 {
+		fmt.Fprintf(&sb, "* Tags: %s\n", strings.Join(m.Tags, ", "))
+	}
+
+	fmt.Fprintf(&sb, "\n```sql\n%s\n```\n", strings.TrimSpace(m.Query))
+	return sb.String()
+}
+
+// Docs writes Markdown documentation for each query, sorted by name. If output is a directory,
+// or ends with a path separator, a file is written per query. Otherwise, a single document is
+// written to output, or to w if output is empty.
+func Docs(paths []string, output string, w io.Writer, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+	names := verifyOrder(mm, false)
+
+	perQuery := strings.HasSuffix(output, string(os.PathSeparator))
+	if fi, err := os.Stat(output); err == nil && fi.IsDir() {
+		perQuery = true
+	}
+
+	if perQuery {
+		if err := os.MkdirAll(output, 0o755); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		for _, name := range names {
+			path := filepath.Join(output, name+".md")
+			klog.V(1).Infof("Writing %s ...", path)
+			if err := os.WriteFile(path, []byte(queryDocs(mm[name], 1)), 0o600); err != nil {
+				return err
+			}
+		}
+		klog.Infof("Documented %d queries in %s", len(names), output)
+		return nil
+	}
+
+	sections := []string{"# Queries\n"}
+	for _, name := range names {
+		sections = append(sections, queryDocs(mm[name], 2))
+	}
+	doc := strings.Join(sections, "\n")
+
+	if output == "" {
+		_, err = io.WriteString(w, doc)
+		return err
+	}
+	klog.Infof("Documented %d queries in %s", len(names), output)
+	return os.WriteFile(output, []byte(doc), 0o600)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDocs(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"users.sql": "-- Local users\n--\n-- Accounts that can log in.\n--\n-- interval: 3600\n-- tags: persistent posture\nSELECT uid, username FROM users;",
+		"kmods.sql": "-- Kernel modules\n-- platform: linux\n-- interval: 600\nSELECT name FROM kernel_modules;",
+	})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+
+	var sb strings.Builder
+	if err := Docs([]string{dir}, "", &sb, c); err != nil {
+		t.Fatalf("Docs() = %v", err)
+	}
+
+	want := "# Queries\n\n" +
+		"## kmods\n\nKernel modules\n\n* Platform: linux\n* Interval: 10m0s\n\n```sql\nSELECT name FROM kernel_modules;\n```\n\n" +
+		"## users\n\nLocal users\n\nAccounts that can log in.\n\n* Platform: any\n* Interval: 1h0m0s\n* Tags: persistent, posture\n\n```sql\nSELECT uid, username FROM users;\n```\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("Docs() mismatch (-want +got):\n%s", diff)
+	}
+
+	out := t.TempDir()
+	if err := Docs([]string{dir}, out, &sb, c); err != nil {
+		t.Fatalf("Docs(dir) = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "kmods.md"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.HasPrefix(string(got), "# kmods\n\nKernel modules\n") {
+		t.Errorf("kmods.md = %q, want a level one heading", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+// minOsqueryVersion is the oldest osqueryi release we expect to work well.
+const minOsqueryVersion = "5.0.0"
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// checkResult is the outcome of a single doctor check.
+type checkResult struct {
+	Name   string
+	Status checkStatus
+	Detail string
+	Hint   string
+}
+
+// doctorChecks diagnoses the local osquery environment.
+func doctorChecks(c Config) []checkResult {
+	path, err := c.runConfig().LookPath()
+	if err != nil {
+		return []checkResult{{
+			Name:   "osqueryi",
+			Status: checkFail,
+			Detail: err.Error(),
+			Hint:   "install osquery from https://osquery.io/downloads and make sure osqueryi is in your $PATH, or set --osqueryi",
+		}}
+	}
+	results := []checkResult{{Name: "osqueryi", Status: checkPass, Detail: path}}
+
+	v, err := query.Version(c.runConfig())
+	switch {
+	case err != nil:
+		results = append(results, checkResult{Name: "version", Status: checkFail, Detail: err.Error(), Hint: "make sure osqueryi is executable by the current user"})
+	case olderVersion(v, minOsqueryVersion):
+		results = append(results, checkResult{Name: "version", Status: checkWarn, Detail: v, Hint: fmt.Sprintf("upgrade osquery to %s or newer", minOsqueryVersion)})
+	default:
+		results = append(results, checkResult{Name: "version", Status: checkPass, Detail: v})
+	}
+
+	rr, err := c.runQuery(&query.Metadata{Name: "doctor", Query: "SELECT 1;"})
+	if err != nil {
+		return append(results, checkResult{Name: "query", Status: checkFail, Detail: err.Error(), Hint: "run 'echo \"SELECT 1;\" | osqueryi --json' to debug"})
+	}
+	results = append(results, checkResult{Name: "query", Status: checkPass, Detail: fmt.Sprintf("SELECT 1 returned %d rows in %s", len(rr.Rows), rr.Elapsed)})
+
+	rr, err = c.runQuery(&query.Metadata{Name: "doctor-events", Query: "SELECT value FROM osquery_flags WHERE name = 'disable_events';"})
+	switch {
+	case err != nil:
+		results = append(results, checkResult{Name: "events", Status: checkWarn, Detail: err.Error(), Hint: "unable to determine if event tables are available"})
+	case len(rr.Rows) > 0 && rr.Rows[0]["value"] == "false":
+		results = append(results, checkResult{Name: "events", Status: checkPass, Detail: "event tables are enabled"})
+	default:
+		results = append(results, checkResult{Name: "events", Status: checkWarn, Detail: "event tables are disabled", Hint: "queries against *_events tables will return no rows; enable them with --disable_events=false"})
+	}
+
+	return results
+}
+
+// olderVersion returns true if version a is older than version b.
+func olderVersion(a string, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		ai, aerr := strconv.Atoi(as[i])
+		bi, berr := strconv.Atoi(bs[i])
+		if aerr != nil || berr != nil {
+			return false
+		}
+		if ai != bi {
+			return ai < bi
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// Doctor diagnoses the local environment, reporting the results to w.
+func Doctor(w io.Writer, c Config) error {
+	failed := 0
+	for _, r := range doctorChecks(c) {
+		fmt.Fprintf(w, "[%s] %s: %s\n", r.Status, r.Name, r.Detail)
+		if r.Hint != "" {
+			fmt.Fprintf(w, "       hint: %s\n", r.Hint)
+		}
+		if r.Status == checkFail {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// stubOsqueryi installs a fake osqueryi shell script at the front of $PATH.
+func stubOsqueryi(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub osqueryi requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "osqueryi"), []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestDoctor(t *testing.T) {
+	stubOsqueryi(t, `
+if [ "$1" = "--version" ]; then
+  echo "osqueryi version 5.9.1"
+  exit 0
+fi
+case "$(cat)" in
+  *disable_events*) echo '[{"value":"true"}]' ;;
+  *) echo '[{"1":"1"}]' ;;
+esac
+`)
+
+	var sb strings.Builder
+	if err := Doctor(&sb, Config{}); err != nil {
+		t.Fatalf("Doctor() returned error: %v\n%s", err, sb.String())
+	}
+
+	got := sb.String()
+	for _, want := range []string{
+		"[PASS] version: 5.9.1",
+		"[PASS] query: SELECT 1 returned 1 rows",
+		"[WARN] events: event tables are disabled",
+		"hint: queries against *_events tables",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Doctor() output missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestDoctorOldVersion(t *testing.T) {
+	stubOsqueryi(t, `
+if [ "$1" = "--version" ]; then
+  echo "osqueryi version 4.9.0"
+  exit 0
+fi
+echo '[{"value":"false"}]'
+`)
+
+	var sb strings.Builder
+	if err := Doctor(&sb, Config{}); err != nil {
+		t.Fatalf("Doctor() returned error: %v\n%s", err, sb.String())
+	}
+	if !strings.Contains(sb.String(), "[WARN] version: 4.9.0") {
+		t.Errorf("expected version warning, got:\n%s", sb.String())
+	}
+	if !strings.Contains(sb.String(), "[PASS] events") {
+		t.Errorf("expected events to pass, got:\n%s", sb.String())
+	}
+}
+
+func TestDoctorBrokenQuery(t *testing.T) {
+	stubOsqueryi(t, `
+if [ "$1" = "--version" ]; then
+  echo "osqueryi version 5.9.1"
+  exit 0
+fi
+echo "Error: permission denied" >&2
+exit 1
+`)
+
+	var sb strings.Builder
+	if err := Doctor(&sb, Config{}); err == nil {
+		t.Errorf("Doctor() = nil, want error:\n%s", sb.String())
+	}
+	if !strings.Contains(sb.String(), "[FAIL] query") {
+		t.Errorf("expected query failure, got:\n%s", sb.String())
+	}
+}
+
+func TestDoctorMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	var sb strings.Builder
+	if err := Doctor(&sb, Config{}); err == nil {
+		t.Errorf("Doctor() = nil, want error")
+	}
+	if !strings.Contains(sb.String(), "[FAIL] osqueryi") {
+		t.Errorf("expected osqueryi failure, got:\n%s", sb.String())
+	}
+}
+
+func TestDoctorCustomOsqueryi(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub osqueryi requires a POSIX shell")
+	}
+
+	path := filepath.Join(t.TempDir(), "osqueryi-5.10")
+	stub := `#!/bin/sh
+if [ "$1" = "--version" ]; then
+  echo "osqueryi version 5.10.2"
+  exit 0
+fi
+echo '[{"value":"false"}]'
+`
+	if err := os.WriteFile(path, []byte(stub), 0o700); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	t.Setenv("PATH", t.TempDir())
+
+	var sb strings.Builder
+	if err := Doctor(&sb, Config{Osqueryi: path}); err != nil {
+		t.Fatalf("Doctor() returned error: %v\n%s", err, sb.String())
+	}
+	for _, want := range []string{"[PASS] osqueryi: " + path, "[PASS] version: 5.10.2"} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("Doctor() output missing %q:\n%s", want, sb.String())
+		}
+	}
+
+	sb.Reset()
+	if err := Doctor(&sb, Config{Osqueryi: path + "-missing"}); err == nil {
+		t.Errorf("Doctor() = nil, want error for missing osqueryi")
+	}
+}
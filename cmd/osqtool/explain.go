@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// explainQuery runs EXPLAIN QUERY PLAN for a query, returning the plan rows.
+func explainQuery(m *query.Metadata, c Config) (*query.RunResult, error) {
+	em := *m
+	em.Query = "EXPLAIN QUERY PLAN " + strings.TrimSpace(m.Query)
+	return c.runQuery(&em)
+}
+
+// fullScan returns true if a plan step scans a table without using an index.
+func fullScan(detail string) bool {
+	return strings.HasPrefix(detail, "SCAN") && !strings.Contains(detail, "USING INDEX") && !strings.Contains(detail, "USING COVERING INDEX")
+}
+
+// writePlan writes the steps of a query plan to w, indented by their depth, returning the steps that are full scans.
+func writePlan(w io.Writer, rows []query.Row) []string {
+	depth := map[string]int{}
+	scans := []string{}
+	for _, r := range rows {
+		d := 0
+		if p, ok := depth[r["parent"]]; ok {
+			d = p + 1
+		}
+		depth[r["id"]] = d
+
+		fmt.Fprintf(w, "  %s%s\n", strings.Repeat("  ", d), r["detail"])
+		if fullScan(r["detail"]) {
+			scans = append(scans, r["detail"])
+		}
+	}
+	return scans
+}
+
+// Explain prints the query plan of each query, flagging full table scans as potentially expensive.
+func Explain(paths []string, w io.Writer, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	flagged := 0
+	for _, name := range verifyOrder(mm, false) {
+		m := mm[name]
+		if cw := query.IsIncompatible(m); cw != "" {
+			klog.V(1).Infof("skipping incompatible query: %s (%s)", name, cw)
+			continue
+		}
+
+		rr, err := explainQuery(m, c)
+		if err != nil {
+			klog.Errorf("%q failed: %v", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		fmt.Fprintln(w, name)
+		scans := writePlan(w, rr.Rows)
+		for _, s := range scans {
+			fmt.Fprintf(w, "  warning: %q is a full table scan, and may be expensive\n", s)
+		}
+		if len(scans) > 0 {
+			flagged++
+		}
+		fmt.Fprintln(w, "")
+	}
+
+	klog.Infof("%d queries explained: %d with full table scans", len(mm), flagged)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFullScan(t *testing.T) {
+	tests := []struct {
+		detail string
+		want   bool
+	}{
+		{detail: "SCAN processes VIRTUAL TABLE INDEX 0:", want: true},
+		{detail: "SCAN TABLE file", want: true},
+		{detail: "SCAN t USING INDEX idx_name", want: false},
+		{detail: "SCAN t USING COVERING INDEX idx_name", want: false},
+		{detail: "SEARCH pp USING INTEGER PRIMARY KEY (rowid=?)", want: false},
+		{detail: "USE TEMP B-TREE FOR ORDER BY", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := fullScan(tc.detail); got != tc.want {
+			t.Errorf("fullScan(%q) = %v, want %v", tc.detail, got, tc.want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  "EXPLAIN QUERY PLAN SELECT p.pid"*) echo '[{"id":"3","parent":"0","notused":"0","detail":"SCAN p VIRTUAL TABLE INDEX 0:"},{"id":"7","parent":"3","notused":"0","detail":"SEARCH pp USING INTEGER PRIMARY KEY (rowid=?)"}]' ;;
+  "EXPLAIN QUERY PLAN "*) echo '[{"id":"2","parent":"0","notused":"0","detail":"SEARCH users USING INDEX uid (uid=?)"}]' ;;
+  *) echo "Error: expected EXPLAIN QUERY PLAN" >&2; exit 1 ;;
+esac
+`)
+	dir := writeQueries(t, map[string]string{
+		"parents.sql": "SELECT p.pid FROM processes p JOIN processes pp ON p.parent = pp.pid;",
+		"root.sql":    "SELECT username FROM users WHERE uid = 0;",
+	})
+
+	var sb strings.Builder
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+	if err := Explain([]string{dir}, &sb, c); err != nil {
+		t.Fatalf("Explain() = %v", err)
+	}
+
+	want := `parents
+  SCAN p VIRTUAL TABLE INDEX 0:
+    SEARCH pp USING INTEGER PRIMARY KEY (rowid=?)
+  warning: "SCAN p VIRTUAL TABLE INDEX 0:" is a full table scan, and may be expensive
+
+root
+  SEARCH users USING INDEX uid (uid=?)
+
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("Explain() output mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// sqlFiles returns the SQL files within the given files and directories.
+func sqlFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(p, ".sql") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// formatSQL renders the contents of a SQL file in canonical form. Comments within the query body are
+// preserved, and sidecar metadata is not merged, so that only the layout of the file changes.
+func formatSQL(path string, bs []byte, c Config) ([]byte, error) {
+	pc := c.parseConfig()
+	pc.PreserveComments = true
+
+	name := strings.TrimSuffix(filepath.Base(path), ".sql")
+	m, err := query.ParseWithConfig(name, bs, pc)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := query.RenderWithConfig(m, c.renderConfig())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// Fmt rewrites SQL files in canonical form, in place or within the output directory. In check mode,
+// no files are written: the files that would change are listed to w, and an error is returned if there are any.
+func Fmt(paths []string, output string, w io.Writer, c Config) error {
+	files, err := sqlFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	if output != "" && !c.Check {
+		if err := os.MkdirAll(output, 0o755); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+	}
+
+	errs := []error{}
+	changed := 0
+	for _, path := range files {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		formatted, err := formatSQL(path, bs, c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+
+		if bytes.Equal(bs, formatted) && output == "" {
+			continue
+		}
+
+		if c.Check {
+			if !bytes.Equal(bs, formatted) {
+				fmt.Fprintln(w, path)
+				changed++
+			}
+			continue
+		}
+
+		dest := path
+		if output != "" {
+			dest = filepath.Join(output, filepath.Base(path))
+		}
+		klog.V(1).Infof("Writing %d bytes to %s ...", len(formatted), dest)
+		if err := os.WriteFile(dest, formatted, 0o600); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changed++
+	}
+
+	if c.Check && changed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d files are not formatted", changed, len(files)))
+	} else {
+		klog.Infof("%d files formatted: %d written", len(files), changed)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFmt(t *testing.T) {
+	messy := `-- Shell parents
+-- tags: persistent
+-- interval: 600
+SELECT p.pid, -- the process
+  pp.name
+FROM processes p
+JOIN processes pp ON p.parent = pp.pid`
+
+	dir := writeQueries(t, map[string]string{"shell-parents.sql": messy})
+	path := filepath.Join(dir, "shell-parents.sql")
+
+	var sb strings.Builder
+	if err := Fmt([]string{dir}, "", &sb, Config{Check: true}); err == nil {
+		t.Errorf("Fmt(check) = nil, want error for unformatted file")
+	}
+	if got := strings.TrimSpace(sb.String()); got != path {
+		t.Errorf("Fmt(check) listed %q, want %q", got, path)
+	}
+
+	if err := Fmt([]string{dir}, "", &sb, Config{}); err != nil {
+		t.Fatalf("Fmt() = %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	want := `-- Shell parents
+--
+-- interval: 600
+-- tags: persistent
+
+SELECT p.pid, -- the process
+  pp.name
+FROM processes p
+JOIN processes pp ON p.parent = pp.pid;
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("formatted file mismatch (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	if err := Fmt([]string{dir}, "", &sb, Config{Check: true}); err != nil {
+		t.Errorf("Fmt(check) after formatting = %v, want nil", err)
+	}
+	if sb.Len() > 0 {
+		t.Errorf("Fmt(check) after formatting listed %q, want nothing", sb.String())
+	}
+}
+
+func TestFmtOutput(t *testing.T) {
+	dir := writeQueries(t, map[string]string{"users.sql": "-- Users\nSELECT uid FROM users"})
+	output := filepath.Join(t.TempDir(), "formatted")
+
+	if err := Fmt([]string{dir}, output, &strings.Builder{}, Config{}); err != nil {
+		t.Fatalf("Fmt() = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(output, "users.sql"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if diff := cmp.Diff("-- Users\n--\n\nSELECT uid FROM users;\n", string(got)); diff != "" {
+		t.Errorf("formatted file mismatch (-want +got):\n%s", diff)
+	}
+
+	orig, err := os.ReadFile(filepath.Join(dir, "users.sql"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(orig) != "-- Users\nSELECT uid FROM users" {
+		t.Errorf("Fmt() modified the source file: %q", orig)
+	}
+}
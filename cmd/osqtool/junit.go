@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+// junitSuite is a JUnit XML test suite, as consumed by most CI systems.
+type junitSuite struct {
+	XMLName  xml.Name     `xml:"testsuite"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Cases    []*junitCase `xml:"testcase"`
+}
+
+// junitCase is a single verified query.
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+// junitMessage describes why a test case failed or was skipped.
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport collects verify results as JUnit test cases, safe for concurrent use.
+type junitReport struct {
+	mu    sync.Mutex
+	cases []*junitCase
+}
+
+// junitSeconds formats a duration as JUnit expects, in seconds.
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func (j *junitReport) add(name string, status string, vf *query.RunResult, err error) {
+	tc := &junitCase{Name: name, Classname: "osqtool.verify", Time: junitSeconds(0)}
+	if vf != nil {
+		tc.Time = junitSeconds(vf.Elapsed)
+	}
+
+	switch status {
+	case query.StatusErrored:
+		tc.Failure = &junitMessage{Message: "query failed verification", Text: err.Error()}
+	case query.StatusPartial:
+		msg := fmt.Sprintf("incompatible platform: %s", vf.IncompatiblePlatform)
+		tc.Skipped = &junitMessage{Message: msg}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cases = append(j.cases, tc)
+}
+
+// write writes the report to path as a JUnit XML test suite, with test cases ordered by name.
+func (j *junitReport) write(path string, elapsed time.Duration) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	sort.Slice(j.cases, func(a, b int) bool { return j.cases[a].Name < j.cases[b].Name })
+	s := &junitSuite{Name: "osqtool verify", Tests: len(j.cases), Time: junitSeconds(elapsed), Cases: j.cases}
+	for _, tc := range j.cases {
+		if tc.Failure != nil {
+			s.Failures++
+		}
+		if tc.Skipped != nil {
+			s.Skipped++
+		}
+	}
+
+	bs, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(bs, '\n')...), 0o600)
+}
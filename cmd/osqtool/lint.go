@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// lintQueries runs the registered lint rules against each query, reporting findings to w.
+func lintQueries(mm map[string]*query.Metadata, w io.Writer) error {
+	findings := 0
+	errored := 0
+	for _, name := range verifyOrder(mm, false) {
+		for _, f := range query.Lint(mm[name]) {
+			fmt.Fprintln(w, f)
+			findings++
+			if f.Severity == query.SeverityError {
+				errored++
+			}
+		}
+	}
+
+	klog.Infof("%d queries linted: %d findings, %d errors", len(mm), findings, errored)
+	if errored > 0 {
+		return fmt.Errorf("%d error findings", errored)
+	}
+	return nil
+}
+
+// Lint checks the queries within a directory or pack against the registered lint rules, without osqueryi.
+func Lint(paths []string, w io.Writer, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+	return lintQueries(mm, w)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+// listEntry is a query summary, as printed by list with --format=json.
+type listEntry struct {
+	Name     string   `json:"name"`
+	Platform string   `json:"platform"`
+	Interval string   `json:"interval"`
+	Tags     []string `json:"tags"`
+	Author   string   `json:"author,omitempty"`
+}
+
+// newListEntry summarizes a query, using "any" for queries without a platform.
+func newListEntry(m *query.Metadata) listEntry {
+	e := listEntry{Name: m.Name, Platform: m.Platform, Interval: m.Interval, Tags: m.Tags, Author: m.Author}
+	if e.Platform == "" {
+		e.Platform = "any"
+	}
+	if e.Tags == nil {
+		e.Tags = []string{}
+	}
+	return e
+}
+
+// List writes a summary of each query to w, sorted by name, after applying the configured filters.
+func List(paths []string, w io.Writer, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+
+	entries := []listEntry{}
+	for _, name := range verifyOrder(mm, false) {
+		e := newListEntry(mm[name])
+		e.Name = name
+		entries = append(entries, e)
+	}
+
+	switch c.Format {
+	case "", formatText:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tPLATFORM\tINTERVAL\tTAGS\tAUTHOR")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Name, e.Platform, formatInterval(e.Interval, c.HumanIntervals), strings.Join(e.Tags, ","), e.Author)
+		}
+		return tw.Flush()
+	case formatJSON:
+		bs, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		_, err = fmt.Fprintln(w, string(bs))
+		return err
+	default:
+		return fmt.Errorf("unsupported format for list: %q", c.Format)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestList(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"users.sql":     "-- author: Jane Doe\n-- tags: posture persistent\nSELECT uid FROM users;",
+		"kmods.sql":     "-- platform: linux\n-- interval: 600\nSELECT name FROM kernel_modules;",
+		"launchd.sql":   "-- platform: darwin\n-- interval: 60\nSELECT name FROM launchd;",
+		"processes.sql": "-- tags: noisy\nSELECT pid FROM processes;",
+	})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, ExcludeTags: []string{"noisy"}}
+
+	var sb strings.Builder
+	if err := List([]string{dir}, &sb, c); err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	want := `NAME     PLATFORM  INTERVAL  TAGS                AUTHOR
+kmods    linux     600
+launchd  darwin    60
+users    any       3600      posture,persistent  Jane Doe
+`
+	// tabwriter pads the empty trailing columns
+	lines := strings.Split(sb.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " ")
+	}
+	if diff := cmp.Diff(want, strings.Join(lines, "\n")); diff != "" {
+		t.Errorf("List() output mismatch (-want +got):\n%s", diff)
+	}
+
+	sb.Reset()
+	c.Format = formatJSON
+	c.Platforms = []string{"darwin"}
+	if err := List([]string{dir}, &sb, c); err != nil {
+		t.Fatalf("List(json) = %v", err)
+	}
+	got := []listEntry{}
+	if err := json.Unmarshal([]byte(sb.String()), &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	wantEntries := []listEntry{
+		{Name: "launchd", Platform: "darwin", Interval: "60", Tags: []string{}},
+		{Name: "users", Platform: "any", Interval: "3600", Tags: []string{"posture", "persistent"}, Author: "Jane Doe"},
+	}
+	if diff := cmp.Diff(wantEntries, got); diff != "" {
+		t.Errorf("List(json) mismatch (-want +got):\n%s", diff)
+	}
+}
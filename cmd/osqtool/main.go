@@ -5,17 +5,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"text/tabwriter"
 	"time"
 	"unicode/utf8"
 
@@ -28,18 +35,184 @@ import (
 type Config struct {
 	maxQueryDuration            time.Duration
 	maxQueryDurationPerDay      time.Duration
+	retryBackoff                time.Duration
 	MaxTotalQueryDurationPerDay time.Duration
+	PerQueryDailyBudget         time.Duration
 	MinInterval                 time.Duration
 	MaxInterval                 time.Duration
 	DefaultInterval             time.Duration
+	RoundInterval               time.Duration
 	TagIntervals                []string
+	PlatformIntervals           []string
+	TagRules                    []query.TagRule
+	TableIntervals              []string
 	Exclude                     []string
 	ExcludeTags                 []string
+	RequireTags                 []string
+	RequireAllTags              bool
 	Platforms                   []string
 	Workers                     int
 	MaxResults                  int
+	MaxResultsPerHour           int
+	MinResults                  int
+	DisableExcluded             bool
+	Vars                        map[string]string
+	FailOnEmpty                 bool
+	DryRun                      bool
+	DirectivesOverrideSidecar   bool
+	Seed                        string
+	Retries                     int
+	CommentStyle                string
+	Order                       string
+	Watch                       bool
+	MaxColumns                  int
+	Splay                       float64
+	Summary                     string
+	NoAutoSemicolon             bool
+	MaxIntervalUtilization      float64
+	WarnIntervalUtilization     bool
+	Compare                     string
+	IgnoreColumns               []string
+	PlatformSuffixes            map[string]string
+	Columns                     []string
 	SingleQuotes                bool
+	PrintQuery                  bool
 	MultiLine                   bool
+	CanonicalQuery              bool
+	SQLFormatter                string
+	ValidateJSON                bool
+	PreserveComments            bool
+	RichHeader                  bool
+	IgnoreFile                  string
+	RunDenyListed               bool
+	SkipErrors                  bool
+	ClampReport                 bool
+	HumanIntervals              bool
+	SortByValue                 bool
+	FitBudget                   bool
+	OsqueryVersion              string
+	SchemaDir                   string
+	MergeInto                   string
+	JSONLinesProgress           string
+	RepairTrailingCommas        bool
+	StrictJSONLoad              bool
+	Append                      bool
+	PrettyRows                  bool
+	ExplainRows                 bool
+	Format                      string
+	ReuseOsqueryi               bool
+	QueryTimeout                time.Duration
+	Osqueryi                    string
+	OsqueryFlags                []string
+	Check                       bool
+	OnConflict                  string
+	ExpandPosix                 bool
+	JUnit                       string
+	Fix                         bool
+	IgnoreCase                  bool
+	GroupByPlatform             bool
+	ExtraSchema                 string
+	AllowUnknownTables          bool
+
+	// run overrides how queries are run, for example within a long-lived osqueryi session
+	run runFunc
+}
+
+// stringsFlag is a flag that may be repeated, splitting each value into whitespace-separated fields.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, strings.Fields(v)...)
+	return nil
+}
+
+// varsFlag is a flag that may be repeated, collecting key=value pairs.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	pairs := []string{}
+	for k, val := range v {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varsFlag) Set(s string) error {
+	k, val, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not in key=value form", s)
+	}
+	v[k] = val
+	return nil
+}
+
+// renderConfig returns the configuration to use when rendering packs.
+func (c Config) renderConfig() *query.RenderConfig {
+	return &query.RenderConfig{SingleQuotes: c.SingleQuotes, ValidateJSON: c.ValidateJSON, CommentPrefix: c.CommentStyle, Order: c.Order}
+}
+
+// runConfig returns the configuration to use when running queries with osqueryi.
+func (c Config) runConfig() *query.RunConfig {
+	return &query.RunConfig{Osqueryi: c.Osqueryi, Flags: c.OsqueryFlags, Seed: c.Seed}
+}
+
+// renderPack renders a pack in the configured --format: an osquery pack by default, or Fleet query documents.
+func (c Config) renderPack(p *query.Pack) ([]byte, error) {
+	switch c.Format {
+	case "", formatText, formatJSON:
+		return query.RenderPack(p, c.renderConfig())
+	case formatFleetYAML:
+		return query.RenderFleetYAML(p)
+	default:
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+}
+
+// queryConfig returns the configuration to use when applying changes to queries.
+func (c Config) queryConfig() query.Config {
+	qc := query.Config{
+		MinInterval:       c.MinInterval,
+		MaxInterval:       c.MaxInterval,
+		DefaultInterval:   c.DefaultInterval,
+		RoundInterval:     c.RoundInterval,
+		TagIntervals:      c.TagIntervals,
+		PlatformIntervals: c.PlatformIntervals,
+		TableIntervals:    c.TableIntervals,
+		TagRules:          c.TagRules,
+		Exclude:           c.Exclude,
+		ExcludeTags:       c.ExcludeTags,
+		RequireTags:       c.RequireTags,
+		RequireAllTags:    c.RequireAllTags,
+		Platforms:         c.Platforms,
+		DisableExcluded:   c.DisableExcluded,
+		Vars:              c.Vars,
+		MultiLine:         c.MultiLine,
+		Splay:             c.Splay,
+	}
+	if c.CanonicalQuery {
+		qc.Formatter = newFormatter(c)
+	}
+	return qc
+}
+
+// parseConfig returns the configuration to use when parsing SQL files.
+func (c Config) parseConfig() *query.ParseConfig {
+	return &query.ParseConfig{
+		PreserveComments:          c.PreserveComments,
+		IgnoreFile:                c.IgnoreFile,
+		RepairTrailingCommas:      c.RepairTrailingCommas,
+		StrictJSON:                c.StrictJSONLoad,
+		RichHeader:                c.RichHeader,
+		DirectivesOverrideSidecar: c.DirectivesOverrideSidecar,
+		CommentPrefix:             c.CommentStyle,
+		NoAutoSemicolon:           c.NoAutoSemicolon,
+		PlatformSuffixes:          c.PlatformSuffixes,
+	}
 }
 
 func main() {
@@ -48,44 +221,236 @@ func main() {
 	multiLineFlag := flag.Bool("multi-line", false, "output queries is multi-line form. This is accepted by osquery, but technically is invalid JSON.")
 	defaultIntervalFlag := flag.Duration("default-interval", 1*time.Hour, "Interval to use for queries which do not specify one")
 	tagIntervalsFlag := flag.String("tag-intervals", "transient=6m,persistent=1.25x,postmortem=6h,rapid=20s,often=x/3,seldom=3x", "modifiers to the default-interval based on query tags")
+	platformIntervalsFlag := flag.String("platform-intervals", "", "modifiers to the default-interval based on query platforms, applied after --tag-intervals, such as darwin=2x,windows=30m")
+	tableIntervalsFlag := flag.String("table-intervals", "processes=10m,process_open_sockets=10m,listening_ports=10m,logged_in_users=15m,users=12h,groups=12h,os_version=24h,system_info=24h", "recommended intervals for tables, used by queries with an 'interval: auto' directive")
 	maxIntervalFlag := flag.Duration("min-interval", 24*time.Hour, "Queries cant be scheduled less often than this")
-	excludeFlag := flag.String("exclude", "", "Comma-separated list of queries to exclude")
+	roundIntervalFlag := flag.Duration("round-interval", 0, "Round intervals to the nearest multiple of this duration, staying within the interval bounds (0 to disable)")
+	excludeFlag := flag.String("exclude", "", "Comma-separated list of queries to exclude, which may be globs such as 'exp-*'")
 	excludeTagsFlag := flag.String("exclude-tags", "disabled", "Comma-separated list of tags to exclude")
+	requireTagsFlag := flag.String("require-tags", "", "Comma-separated list of tags, one of which a query must have to be included")
+	requireAllTagsFlag := flag.Bool("require-all-tags", false, "Include only queries that have all of the --require-tags, rather than any of them")
 	platformsFlag := flag.String("platforms", "", "Comma-separated list of platforms to include")
-	workersFlag := flag.Int("workers", 0, "Number of workers to use when verifying results (0 for automatic)")
-	maxResultsFlag := flag.Int("max-results", 250000, "Maximum number of results a query may return during verify")
-	singleQuotesFlag := flag.Bool("single-quotes", false, "Render double quotes as single quotes (may corrupt queries)")
+	workersFlag := flag.Int("workers", 0, "Number of workers to use when running or verifying queries (0 for automatic)")
+	maxResultsFlag := flag.Int("max-results", 250000, "Maximum number of results a query may return during verify, or that run will print per query (0 for unlimited)")
+	minResultsFlag := flag.Int("min-results", 0, "Minimum number of results a query must return during verify on a compatible platform, unless overridden by a min_results directive (0 to disable)")
+	maxResultsPerHourFlag := flag.Int("max-results-per-hour", 0, "Maximum number of results a query may emit per hour, based on its interval (checked during --verify, 0 to disable)")
+	singleQuotesFlag := flag.Bool("single-quotes", false, "Rewrite double-quoted strings within queries as single-quoted strings, escaping any single quotes within them")
 	maxQueryDurationFlag := flag.Duration("max-query-duration", 4*time.Second, "Maximum query duration (checked during --verify)")
 	maxQueryDurationPerDayFlag := flag.Duration("max-query-daily-duration", 60*time.Minute, "Maximum duration for a single query multiplied by how many times it runs daily (checked during --verify)")
 	maxTotalQueryDurationFlag := flag.Duration("max-total-daily-duration", 6*time.Hour, "Maximum total query-duration per day across all queries")
+	ignoreFileFlag := flag.String("ignore-file", ".osqtoolignore", "Name of gitignore-style files listing paths to skip when loading directories")
+	preserveCommentsFlag := flag.Bool("preserve-comments", false, "Preserve inline SQL comments within the query body")
+	perQueryDailyBudgetFlag := flag.Duration("per-query-daily-budget", 0, "Daily duration budget per query used by suggest-intervals (defaults to --max-query-daily-duration)")
+	runDenyListedFlag := flag.Bool("run-denylisted", false, "Run and verify queries that are marked as denylisted")
+	validateJSONFlag := flag.Bool("validate-json", false, "Fail if the rendered pack is not strictly valid JSON (incompatible with --multi-line)")
+	printQueryFlag := flag.Bool("print-query", false, "Log the final text of each query before running it (run and verify)")
+	skipErrorsFlag := flag.Bool("skip-errors", false, "Log and skip source paths that fail to load instead of aborting")
+	extraSchemaFlag := flag.String("extra-schema", "", "JSON file of additional tables (such as extension tables) to merge into the schema used by validate")
+	appendFlag := flag.Bool("append", false, "Append to the --output file of run instead of truncating it")
+	prettyRowsFlag := flag.Bool("pretty-rows", false, "Render run output as aligned tables")
+	strictJSONLoadFlag := flag.Bool("strict-json-load", false, "Reject packs that are not strictly valid JSON instead of repairing multi-line queries and trailing commas")
+	repairTrailingCommasFlag := flag.Bool("repair-trailing-commas", false, "Remove trailing commas from objects and arrays when loading packs")
+	groupByPlatformFlag := flag.Bool("group-output-by-platform", false, "Group run output into sections by platform, listing incompatible queries separately")
+	jsonLinesProgressFlag := flag.String("json-lines-progress", "", "Write a JSON line for each query as it completes verification to this path (- for stdout)")
+	canonicalQueryFlag := flag.Bool("canonical-query", false, "Reformat queries into a canonical form, with one clause per line")
+	sqlFormatterFlag := flag.String("sql-formatter", "", "External command to format SQL via stdin for --canonical-query (falls back to the built-in formatter if unavailable)")
+	clampReportFlag := flag.Bool("clamp-report", false, "Report every query whose interval was clamped by --min-interval or --max-interval (apply and pack)")
+	humanIntervalsFlag := flag.Bool("human-intervals", isTerminal(os.Stderr), "Log intervals as durations such as 1h0m0s rather than seconds (defaults to true when stderr is a terminal)")
+	tagFileFlag := flag.String("tag-file", "", "YAML file mapping query name globs to tags to add, such as 'process-*: [process]'")
+	sortByValueFlag := flag.Bool("sort-by-value", false, "Verify queries in order of descending numeric value, so the most important queries are checked first")
+	fitBudgetFlag := flag.Bool("fit-budget", false, "Measure each query and increase intervals, least valuable first, until the pack fits within --max-total-daily-duration (apply and pack)")
+	osqueryVersionFlag := flag.String("osquery-version", "", "osquery version to validate tables and columns against, using the snapshot in --schema-dir")
+	schemaDirFlag := flag.String("schema-dir", "", "Directory of osquery schema snapshots named by version, such as 5.10.0.json")
+	richHeaderFlag := flag.Bool("rich-header", false, "Parse the leading comment block of SQL files as a description, extended description, and directives in any order")
+	explainRowsFlag := flag.Bool("explain-rows", false, "Prefix each row of run output with the [name] of the query that produced it")
+	bannedFunctionsFlag := flag.String("banned-functions", "", "Comma-separated list of SQL functions that lint reports as errors when called, such as readfile")
+	mergeIntoFlag := flag.String("merge-into", "", "osquery configuration file whose schedule pack should add or replace queries in, preserving other settings")
+	formatFlag := flag.String("format", formatText, "Output format: text, csv, or ndjson for run, or json when its --output is a directory of a file per query, text or json for diff and list, and fleet-yaml for apply and pack")
+	reuseOsqueryiFlag := flag.Bool("reuse-osqueryi", false, "Run queries within long-lived osqueryi processes rather than starting one per query (run and verify)")
+	queryTimeoutFlag := flag.Duration("query-timeout", 0, "Abandon any query that takes longer than this to run, treating it as a failure (0 for no timeout)")
+	osqueryiFlag := flag.String("osqueryi", "", "Path to the osqueryi binary (default $OSQUERYI, or osqueryi in $PATH)")
+	osqueryFlags := stringsFlag{}
+	flag.Var(&osqueryFlags, "osquery-flags", "Additional arguments for osqueryi, appended after --json, such as \"--disable_extensions=false\" (may be repeated)")
+	checkFlag := flag.Bool("check", false, "Report the files that fmt would change, without writing them, and fail if there are any")
+	onConflictFlag := flag.String("on-conflict", conflictError, "How merge resolves queries with the same name: error, skip, last-wins, or rename (suffixing the name with its source)")
+	expandPosixFlag := flag.Bool("expand-posix", false, "Write posix queries into both the linux and darwin packs when splitting, rather than a posix pack")
+	junitFlag := flag.String("junit", "", "Path to write a JUnit XML report of verify results, with a test case per query")
+	fixFlag := flag.Bool("fix", false, "Write a pack without the duplicates found by dedupe, keeping the first query of each group by name")
+	ignoreCaseFlag := flag.Bool("ignore-case", false, "Ignore the case of SQL outside of quoted strings when dedupe compares queries")
+	disableExcludedFlag := flag.Bool("disable-excluded", false, "Keep queries excluded by --exclude, --exclude-tags, or --platforms, but mark them as removed rather than dropping them")
+	failOnEmptyFlag := flag.Bool("fail-on-empty", true, "Fail verify if no queries were fully verified; if false, verify succeeds when every query ran partially, such as those for other platforms")
+	directivesOverrideSidecarFlag := flag.Bool("directives-override-sidecar", false, "Give directives within SQL files precedence over sidecar YAML metadata, rather than the reverse")
+	allowUnknownTablesFlag := flag.Bool("allow-unknown-tables", false, "Log tables that validate can not find in the schema as warnings rather than errors, such as tables missing from the bundled list of common tables")
+	columnsFlag := flag.String("columns", "", "Comma-separated list of columns to show in run output, in order, such as path,sha256 (columns a row lacks are shown empty)")
+	platformFlag := flag.String("platform", "", "Platform to prefill in the query written by new, such as darwin")
+	intervalFlag := flag.String("interval", "", "Interval to prefill in the query written by new, in seconds or as a duration such as 1h")
+	forceFlag := flag.Bool("force", false, "Overwrite an existing file with new")
+	platformSuffixesFlag := flag.String("platform-suffixes", "", "Additional query name suffixes that indicate a platform, checked before the built-in ones, such as mac=darwin,bsd=freebsd")
+	compareFlag := flag.String("compare", "", "Directory of golden files written by run with --format=json, to compare the results of run against, failing if they differ")
+	ignoreColumnsFlag := flag.String("ignore-columns", "", "Comma-separated list of volatile columns, such as pid or mtime, to ignore when comparing results with --compare")
+	maxIntervalUtilizationFlag := flag.Float64("max-interval-utilization", 0.8, "Maximum fraction of its interval that a single run of a query may take during verify, as osquery can not keep up with queries that run for longer than their interval (0 to disable)")
+	warnIntervalUtilizationFlag := flag.Bool("warn-interval-utilization", false, "Log queries that exceed --max-interval-utilization rather than failing verify")
+	noAutoSemicolonFlag := flag.Bool("no-auto-semicolon", false, "Leave SQL files that do not end with a semicolon as they are, rather than appending one")
+	summaryFlag := flag.String("summary", "", "Path to write a JSON summary of verify results, with the status, elapsed time, and row count of each query and the daily totals")
+	splayFlag := flag.String("splay", "", "Perturb each interval by up to this percentage, such as 10%, deterministically by query name so that queries do not all run at once (apply, pack, and verify)")
+	maxColumnsFlag := flag.Int("max-columns", 0, "Maximum number of distinct columns across the rows a query returns during verify, to keep results narrow (0 to disable)")
+	watchFlag := flag.Bool("watch", false, "Verify again whenever a query file within the paths changes, until interrupted (verify only)")
+	orderFlag := flag.String("order", query.OrderByName, "Order of queries within rendered packs: name, platform-then-name, or interval")
+	commentStyleFlag := flag.String("comment-style", query.DefaultCommentPrefix, "Comment marker for the description and directive lines of SQL files, such as '#', used by unpack and fmt and when loading SQL files")
+	retriesFlag := flag.Int("retries", 0, "Number of times verify retries a query that fails for reasons other than a missing table or a timeout, with a short backoff")
+	seedFlag := flag.String("seed", "", "osquery configuration to run queries against, such as one defining auto_table_construction tables backed by a SQLite fixture (events are disabled)")
+	dryRunFlag := flag.Bool("dry-run", false, "Log the interval overrides and exclusions that apply or pack would make, and print a summary instead of the pack")
+	setFlag := varsFlag{}
+	flag.Var(setFlag, "set", "Substitute {{.key}} placeholders in queries, in key=value form (may be repeated)")
 	verifyFlag := flag.Bool("verify", false, "Verify queries quickly")
 
 	klog.InitFlags(nil)
 	flag.Parse()
 	args := flag.Args()
 
+	osqueryi := *osqueryiFlag
+	if osqueryi == "" {
+		osqueryi = os.Getenv("OSQUERYI")
+	}
+
+	if len(args) == 1 && args[0] == "doctor" {
+		if err := Doctor(os.Stdout, Config{Osqueryi: osqueryi, OsqueryFlags: osqueryFlags}); err != nil {
+			klog.Exitf("doctor: %v", err)
+		}
+		return
+	}
+
 	if len(args) < 2 {
-		klog.Exitf("usage: osqtool [apply|pack|run|unpack|verify] <path>")
+		klog.Exitf("usage: osqtool [apply|convert|dedupe|diff|docs|doctor|explain|fmt|lint|list|merge|new|pack|run|split|suggest-intervals|unpack|validate|verify] <path>")
 	}
 
 	action := args[0]
 	paths := args[1:]
 	var err error
+
+	splay, err := parseSplay(*splayFlag)
+	if err != nil {
+		klog.Exitf("--splay: %v", err)
+	}
+
+	platformSuffixes, err := parsePlatformSuffixes(*platformSuffixesFlag)
+	if err != nil {
+		klog.Exitf("--platform-suffixes: %v", err)
+	}
+
+	var columns []string
+	if *columnsFlag != "" {
+		columns = strings.Split(*columnsFlag, ",")
+	}
+
 	c := Config{
 		maxQueryDuration:            *maxQueryDurationFlag,
 		maxQueryDurationPerDay:      *maxQueryDurationPerDayFlag,
+		retryBackoff:                defaultRetryBackoff,
 		MaxTotalQueryDurationPerDay: *maxTotalQueryDurationFlag,
+		PerQueryDailyBudget:         *perQueryDailyBudgetFlag,
 		MinInterval:                 *minIntervalFlag,
 		MaxInterval:                 *maxIntervalFlag,
 		MaxResults:                  *maxResultsFlag,
+		MaxResultsPerHour:           *maxResultsPerHourFlag,
+		MinResults:                  *minResultsFlag,
+		DisableExcluded:             *disableExcludedFlag,
+		Vars:                        setFlag,
+		FailOnEmpty:                 *failOnEmptyFlag,
+		DryRun:                      *dryRunFlag,
+		DirectivesOverrideSidecar:   *directivesOverrideSidecarFlag,
+		Seed:                        *seedFlag,
+		Retries:                     *retriesFlag,
+		CommentStyle:                *commentStyleFlag,
+		Order:                       *orderFlag,
+		Watch:                       *watchFlag,
+		MaxColumns:                  *maxColumnsFlag,
+		Splay:                       splay,
+		Summary:                     *summaryFlag,
+		NoAutoSemicolon:             *noAutoSemicolonFlag,
+		MaxIntervalUtilization:      *maxIntervalUtilizationFlag,
+		WarnIntervalUtilization:     *warnIntervalUtilizationFlag,
+		Compare:                     *compareFlag,
+		IgnoreColumns:               strings.Split(*ignoreColumnsFlag, ","),
+		PlatformSuffixes:            platformSuffixes,
+		Columns:                     columns,
 		DefaultInterval:             *defaultIntervalFlag,
+		RoundInterval:               *roundIntervalFlag,
 		TagIntervals:                strings.Split(*tagIntervalsFlag, ","),
+		PlatformIntervals:           strings.Split(*platformIntervalsFlag, ","),
+		TableIntervals:              strings.Split(*tableIntervalsFlag, ","),
 		Exclude:                     strings.Split(*excludeFlag, ","),
 		ExcludeTags:                 strings.Split(*excludeTagsFlag, ","),
+		RequireTags:                 strings.Split(*requireTagsFlag, ","),
+		RequireAllTags:              *requireAllTagsFlag,
 		Platforms:                   strings.Split(*platformsFlag, ","),
 		Workers:                     *workersFlag,
 		SingleQuotes:                *singleQuotesFlag,
+		PrintQuery:                  *printQueryFlag,
 		MultiLine:                   *multiLineFlag,
+		CanonicalQuery:              *canonicalQueryFlag,
+		SQLFormatter:                *sqlFormatterFlag,
+		ValidateJSON:                *validateJSONFlag,
+		PreserveComments:            *preserveCommentsFlag,
+		RichHeader:                  *richHeaderFlag,
+		IgnoreFile:                  *ignoreFileFlag,
+		RunDenyListed:               *runDenyListedFlag,
+		SkipErrors:                  *skipErrorsFlag,
+		ClampReport:                 *clampReportFlag,
+		HumanIntervals:              *humanIntervalsFlag,
+		SortByValue:                 *sortByValueFlag,
+		FitBudget:                   *fitBudgetFlag,
+		OsqueryVersion:              *osqueryVersionFlag,
+		SchemaDir:                   *schemaDirFlag,
+		MergeInto:                   *mergeIntoFlag,
+		JSONLinesProgress:           *jsonLinesProgressFlag,
+		RepairTrailingCommas:        *repairTrailingCommasFlag,
+		StrictJSONLoad:              *strictJSONLoadFlag,
+		Append:                      *appendFlag,
+		PrettyRows:                  *prettyRowsFlag,
+		ExplainRows:                 *explainRowsFlag,
+		Format:                      *formatFlag,
+		ReuseOsqueryi:               *reuseOsqueryiFlag,
+		QueryTimeout:                *queryTimeoutFlag,
+		Osqueryi:                    osqueryi,
+		OsqueryFlags:                osqueryFlags,
+		Check:                       *checkFlag,
+		OnConflict:                  *onConflictFlag,
+		ExpandPosix:                 *expandPosixFlag,
+		JUnit:                       *junitFlag,
+		Fix:                         *fixFlag,
+		IgnoreCase:                  *ignoreCaseFlag,
+		GroupByPlatform:             *groupByPlatformFlag,
+		ExtraSchema:                 *extraSchemaFlag,
+		AllowUnknownTables:          *allowUnknownTablesFlag,
+	}
+
+	if err := checkIntervalModifiers("tag-intervals", c.TagIntervals); err != nil {
+		klog.Exit(err)
+	}
+	if err := checkIntervalModifiers("platform-intervals", c.PlatformIntervals); err != nil {
+		klog.Exit(err)
+	}
+
+	if c.CommentStyle == "" || strings.ContainsAny(c.CommentStyle, " \t\r\n") {
+		klog.Exitf("--comment-style must be a non-empty marker without whitespace, got %q", c.CommentStyle)
+	}
+
+	if c.ValidateJSON && c.MultiLine {
+		klog.Exitf("--validate-json cannot be used with --multi-line, as multi-line packs are not valid JSON")
+	}
+
+	if *bannedFunctionsFlag != "" {
+		if err := query.RegisterLintRule(query.BannedFunctions{Names: strings.Split(*bannedFunctionsFlag, ",")}); err != nil {
+			klog.Exitf("banned functions: %v", err)
+		}
+	}
+
+	if *tagFileFlag != "" {
+		c.TagRules, err = query.LoadTagFile(*tagFileFlag)
+		if err != nil {
+			klog.Exitf("tag file: %v", err)
+		}
 	}
 
 	if c.Workers < 1 {
@@ -95,12 +460,38 @@ func main() {
 		}
 	}
 
-	if *verifyFlag || action == "verify" {
-		if _, err := exec.LookPath("osqueryi"); err != nil {
-			klog.Exit(fmt.Errorf("osqueryi executable not found on the host! Download it from: https://osquery.io/downloads"))
+	needsOsqueryi := *verifyFlag || *fitBudgetFlag
+	switch action {
+	case "verify", "run", "suggest-intervals", "explain":
+		needsOsqueryi = true
+	}
+	if needsOsqueryi {
+		if _, err := c.runConfig().LookPath(); err != nil {
+			klog.Exit(fmt.Errorf("osqueryi executable not found on the host (%v)! Download it from: https://osquery.io/downloads, or run 'osqtool doctor' for details", err))
+		}
+		if c.Seed != "" {
+			if _, err := os.Stat(c.Seed); err != nil {
+				klog.Exitf("seed: %v", err)
+			}
+		}
+	}
+
+	if c.Watch {
+		if action != "verify" {
+			klog.Exitf("--watch is only supported by verify, not %q", action)
 		}
+		// Interrupting watch kills any running queries, rather than leaving them orphaned
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err := Watch(ctx, paths, os.Stdout, c)
+		if err != nil {
+			klog.Exitf("watch failed: %v", err)
+		}
+		return
+	}
 
-		err = Verify(paths, c)
+	if *verifyFlag || action == "verify" {
+		err = interruptibleVerify(paths, c)
 		if err != nil {
 			klog.Exitf("verify failed: %v", err)
 		}
@@ -113,10 +504,47 @@ func main() {
 		err = Pack(paths, *outputFlag, c)
 	case "unpack":
 		err = Unpack(paths, *outputFlag, c)
+	case "convert":
+		err = Convert(paths, *outputFlag, c)
+	case "diff":
+		err = Diff(paths, os.Stdout, c)
+	case "lint":
+		err = Lint(paths, os.Stdout, c)
+	case "validate":
+		err = Validate(paths, c)
 	case "verify":
-		err = Verify(paths, c)
+		err = interruptibleVerify(paths, c)
+	case "dedupe":
+		// With --fix, the pack is written to stdout, so duplicates are reported to stderr
+		report := io.Writer(os.Stdout)
+		if c.Fix {
+			report = os.Stderr
+		}
+		err = Dedupe(paths, *outputFlag, report, c)
+	case "docs":
+		err = Docs(paths, *outputFlag, os.Stdout, c)
+	case "explain":
+		err = Explain(paths, os.Stdout, c)
+	case "fmt":
+		err = Fmt(paths, *outputFlag, os.Stdout, c)
+	case "list":
+		err = List(paths, os.Stdout, c)
+	case "merge":
+		err = Merge(paths, *outputFlag, os.Stderr, c)
 	case "run":
 		err = Run(paths, *outputFlag, c)
+	case "split":
+		if len(paths) != 1 {
+			klog.Exitf("split expects a single pack, got %d paths", len(paths))
+		}
+		err = Split(paths[0], *outputFlag, c)
+	case "new":
+		if len(paths) != 1 {
+			klog.Exitf("new expects a single query name, got %d", len(paths))
+		}
+		err = New(paths[0], *platformFlag, *intervalFlag, *forceFlag, c)
+	case "suggest-intervals":
+		err = SuggestIntervals(paths, os.Stdout, c)
 	default:
 		err = fmt.Errorf("unknown action")
 	}
@@ -125,164 +553,166 @@ func main() {
 	}
 }
 
-// calculateInterval calculates the default interval to use for a query.
-func calculateInterval(m *query.Metadata, c Config) int {
-	tagMap := map[string]bool{}
-	for _, t := range m.Tags {
-		tagMap[t] = true
-	}
-
-	interval := int(c.DefaultInterval.Seconds())
-
-	for _, k := range c.TagIntervals {
-		tag, modifier, found := strings.Cut(k, "=")
-		klog.V(1).Infof("processing tag interval: %s=%s (map: %v) - currently: %d", tag, modifier, tagMap, interval)
+// interruptibleVerify runs Verify, killing any running queries on interrupt rather than leaving them orphaned.
+// The handler is only installed while verifying, so that an interrupt still stops other actions immediately.
+func interruptibleVerify(paths []string, c Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return Verify(ctx, paths, c)
+}
 
-		if !found {
-			klog.Errorf("unparseable tag interval: %v", k)
+// checkIntervalModifiers returns an error listing every entry of a --tag-intervals style flag
+// that is not of the form name=modifier, or whose modifier does not parse.
+func checkIntervalModifiers(flagName string, entries []string) error {
+	bad := []string{}
+	for _, k := range entries {
+		if k == "" {
 			continue
 		}
-
-		if !tagMap[tag] {
-			klog.V(1).Infof("%s is not mentioned by this query, moving on", tag)
+		_, modifier, found := strings.Cut(k, "=")
+		if !found {
+			bad = append(bad, fmt.Sprintf("%q: missing '='", k))
 			continue
 		}
-
-		if i, err := strconv.Atoi(modifier); err == nil {
-			klog.V(1).Infof("%s is an int, setting interval to %d", modifier, i)
-			interval = i
-			continue
+		if _, err := query.ParseIntervalModifier(modifier); err != nil {
+			bad = append(bad, fmt.Sprintf("%q: %v", k, err))
 		}
+	}
 
-		if d, err := time.ParseDuration(modifier); err == nil {
-			klog.V(1).Infof("%s is a duration, setting interval to %0.f", modifier, d.Seconds())
-			interval = int(d.Seconds())
-			continue
-		}
-
-		switch {
-		case strings.HasSuffix(modifier, "x"):
-			x, err := strconv.ParseFloat(strings.Trim(modifier, "x"), 64)
-			if err != nil {
-				klog.Errorf("unparseable tag multiplier: %v", modifier)
-				continue
-			}
-
-			klog.V(1).Infof("multiplying interval by %d", x)
-			interval = int(float64(interval) * x)
-		case strings.Contains(modifier, "x/"):
-			_, divisor, found := strings.Cut(k, "/")
-			if !found {
-				klog.Errorf("unparseable tag denominator: %v", k)
-				continue
-			}
-
-			if d, err := strconv.ParseFloat(divisor, 64); err == nil {
-				klog.V(1).Infof("dividing interval by %d", d)
-				interval = int(float64(interval) / d)
-			}
-		default:
-			klog.Errorf("do not understand modifier: %s", k)
-		}
+	if len(bad) > 0 {
+		return fmt.Errorf("--%s has %d invalid entries: %s", flagName, len(bad), strings.Join(bad, ", "))
 	}
-	return interval
+	return nil
 }
 
-// TODO: Move config application to pkg/query.
-func applyConfig(mm map[string]*query.Metadata, c Config) error {
-	klog.V(1).Infof("applying config: %+v", c)
-	minSeconds := int(c.MinInterval.Seconds())
-	maxSeconds := int(c.MaxInterval.Seconds())
-	excludeMap := map[string]bool{}
-	for _, v := range c.Exclude {
-		if v == "" {
-			continue
-		}
-		excludeMap[v] = true
-	}
+// writeDryRunSummary writes what applyConfig changed, for --dry-run.
+func writeDryRunSummary(w io.Writer, r *query.ApplyReport) error {
+	_, err := fmt.Fprintf(w, "dry run: %d queries, %d overridden, %d excluded\n", r.Queries, len(r.Overridden), r.Excluded)
+	return err
+}
 
-	excludeTagsMap := map[string]bool{}
-	for _, v := range c.ExcludeTags {
-		if v != "" {
-			excludeTagsMap[v] = true
-		}
-	}
+// writeClampReport writes a table of clamped intervals, sorted by query name.
+func writeClampReport(w io.Writer, r *query.ApplyReport) error {
+	sort.Slice(r.Clamps, func(i, j int) bool { return r.Clamps[i].Name < r.Clamps[j].Name })
 
-	platformsMap := map[string]bool{}
-	for _, v := range c.Platforms {
-		if v == "" {
-			continue
-		}
+	fmt.Fprintf(w, "%d intervals clamped:\n", len(r.Clamps))
+	if len(r.Clamps) == 0 {
+		return nil
+	}
 
-		platformsMap[v] = true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "QUERY\tREQUESTED\tCLAMPED\tBOUND")
+	for _, e := range r.Clamps {
+		fmt.Fprintf(tw, "%s\t%ds\t%ds\t%s\n", e.Name, e.Requested, e.Clamped, e.Bound)
 	}
+	return tw.Flush()
+}
 
-	for name, m := range mm {
-		if !c.MultiLine {
-			m.Query = m.SingleLineQuery
-		}
+// applyConfig applies the configuration to a set of queries, recording changes in r if it is set.
+// When applying several sets of queries, pass a referenced map to collect the --set variables they
+// use, and check it with query.UnusedVars once all are applied.
+func applyConfig(mm map[string]*query.Metadata, c Config, r *query.ApplyReport, referenced map[string]bool) error {
+	qc := c.queryConfig()
+	qc.Report = r
+	qc.Referenced = referenced
+	return query.Apply(mm, qc)
+}
 
-		if excludeMap[name] {
-			klog.Infof("Skipping %s,excluded by --exclude", name)
-			delete(mm, name)
-			continue
-		}
+// parseSplay parses a --splay percentage such as "10%" into a fraction such as 0.1.
+func parseSplay(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
 
-		for _, t := range m.Tags {
-			if excludeTagsMap[t] {
-				klog.Infof("Skipping %s, excluded by --exclude-tags=%s", name, t)
-				delete(mm, name)
-				continue
-			}
-		}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a percentage: %w", s, err)
+	}
+	if pct < 0 || pct >= 100 {
+		return 0, fmt.Errorf("%q must be at least 0%% and less than 100%%", s)
+	}
+	return pct / 100, nil
+}
 
-		if len(platformsMap) > 0 && m.Platform != "" && !platformsMap[m.Platform] {
-			klog.Infof("Skipping %s - %q not listed in --platforms", name, m.Platform)
-			delete(mm, name)
+// parsePlatformSuffixes parses a --platform-suffixes list such as "mac=darwin,bsd=freebsd".
+func parsePlatformSuffixes(s string) (map[string]string, error) {
+	suffixes := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
 			continue
 		}
-
-		if m.Interval == "" {
-			interval := calculateInterval(m, c)
-			klog.V(1).Infof("setting %q interval to %ds", name, interval)
-			m.Interval = strconv.Itoa(interval)
+		suffix, platform, found := strings.Cut(kv, "=")
+		suffix = strings.TrimSpace(suffix)
+		platform = strings.TrimSpace(platform)
+		if !found || suffix == "" || platform == "" {
+			return nil, fmt.Errorf("%q is not of the form suffix=platform", kv)
 		}
+		suffixes[suffix] = platform
+	}
+	return suffixes, nil
+}
 
-		i, err := strconv.Atoi(m.Interval)
-		if err != nil {
-			return fmt.Errorf("%q: failed to parse %q: %w", name, m.Interval, err)
-		}
+// newFormatter returns the SQL formatter to use for --canonical-query, falling back to the built-in
+// formatter if the --sql-formatter command is unavailable.
+func newFormatter(c Config) query.Formatter {
+	args := strings.Fields(c.SQLFormatter)
+	if len(args) == 0 {
+		return &query.ClauseFormatter{}
+	}
 
-		if i > maxSeconds {
-			klog.Infof("overriding %q interval to %ds (max)", name, maxSeconds)
-			m.Interval = strconv.Itoa(maxSeconds)
-		}
-		if i < minSeconds {
-			klog.Infof("overriding %q interval to %ds (min)", name, minSeconds)
-			m.Interval = strconv.Itoa(minSeconds)
-		}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		klog.Warningf("%s is unavailable (%v), falling back to the built-in SQL formatter", args[0], err)
+		return &query.ClauseFormatter{}
 	}
-	return nil
+	return &query.CommandFormatter{Command: args}
 }
 
 // Apply applies programattic changes to an osquery pack.
 func Apply(sourcePaths []string, output string, c Config) error {
 	ps := []*query.Pack{}
 
+	r := &query.ApplyReport{}
+	referenced := map[string]bool{}
+
 	for _, path := range sourcePaths {
-		p, err := query.LoadPack(path)
+		p, err := query.LoadPackWithConfig(path, c.parseConfig())
 		if err != nil {
 			return fmt.Errorf("load pack: %v", err)
 		}
 
-		if err := applyConfig(p.Queries, c); err != nil {
+		if err := applyConfig(p.Queries, c, r, referenced); err != nil {
 			return fmt.Errorf("apply: %w", err)
 		}
 		ps = append(ps, p)
 	}
+	if err := query.UnusedVars(c.Vars, referenced); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+
+	if c.ClampReport {
+		if err := writeClampReport(os.Stderr, r); err != nil {
+			return fmt.Errorf("clamp report: %w", err)
+		}
+	}
+
+	if c.FitBudget {
+		mm := map[string]*query.Metadata{}
+		for _, p := range ps {
+			for k, v := range p.Queries {
+				mm[k] = v
+			}
+		}
+		if err := fitPackBudget(mm, c); err != nil {
+			return err
+		}
+	}
+
+	if c.DryRun {
+		return writeDryRunSummary(os.Stderr, r)
+	}
 
 	p := query.FlattenPacks(ps)
-	bs, err := query.RenderPack(p, &query.RenderConfig{SingleQuotes: c.SingleQuotes})
+	bs, err := c.renderPack(p)
 	if err != nil {
 		return fmt.Errorf("render: %v", err)
 	}
@@ -298,23 +728,66 @@ func Apply(sourcePaths []string, output string, c Config) error {
 // Pack creates an osquery pack from a recursive directory of SQL files.
 func Pack(sourcePaths []string, output string, c Config) error {
 	mms := map[string]*query.Metadata{}
+	discovery := []string{}
+	skipped := []string{}
+	r := &query.ApplyReport{}
+	referenced := map[string]bool{}
+
 	for _, path := range sourcePaths {
 		klog.Infof("Loading from %s ...", path)
-		mm, err := query.LoadFromDir(path)
+		mm, err := query.LoadFromDirWithConfig(path, c.parseConfig())
 		if err != nil {
-			return fmt.Errorf("load from dir %s: %v", path, err)
+			if !c.SkipErrors {
+				return fmt.Errorf("load from dir %s: %v", path, err)
+			}
+			klog.Errorf("skipping %s: %v", path, err)
+			skipped = append(skipped, path)
+			continue
 		}
 
-		if err := applyConfig(mm, c); err != nil {
+		if err := applyConfig(mm, c, r, referenced); err != nil {
 			return fmt.Errorf("apply: %w", err)
 		}
 		for k, v := range mm {
 			mms[k] = v
 		}
+
+		dq, err := query.LoadDiscovery(path)
+		if err != nil {
+			return fmt.Errorf("load discovery from %s: %v", path, err)
+		}
+		discovery = append(discovery, dq...)
+	}
+
+	if len(skipped) > 0 {
+		klog.Warningf("Skipped %d of %d paths due to errors: %s", len(skipped), len(sourcePaths), strings.Join(skipped, ", "))
+	}
+	if err := query.UnusedVars(c.Vars, referenced); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+
+	if c.ClampReport {
+		if err := writeClampReport(os.Stderr, r); err != nil {
+			return fmt.Errorf("clamp report: %w", err)
+		}
+	}
+
+	if c.FitBudget {
+		if err := fitPackBudget(mms, c); err != nil {
+			return err
+		}
+	}
+
+	if c.DryRun {
+		return writeDryRunSummary(os.Stderr, r)
+	}
+
+	if c.MergeInto != "" {
+		return mergeInto(c.MergeInto, output, &query.Pack{Queries: mms, Discovery: discovery})
 	}
 
 	klog.Infof("Packing %d queries into %s ...", len(mms), output)
-	bs, err := query.RenderPack(&query.Pack{Queries: mms}, &query.RenderConfig{SingleQuotes: c.SingleQuotes})
+	bs, err := c.renderPack(&query.Pack{Queries: mms, Discovery: discovery})
 	if err != nil {
 		return fmt.Errorf("render: %v", err)
 	}
@@ -327,76 +800,122 @@ func Pack(sourcePaths []string, output string, c Config) error {
 	return os.WriteFile(output, bs, 0o600)
 }
 
+// mergeInto merges the queries of a pack into the schedule of an osquery configuration file,
+// writing the result to output, or back to the configuration file if output is empty.
+func mergeInto(conf string, output string, p *query.Pack) error {
+	bs, err := os.ReadFile(conf)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	merged, err := query.MergeSchedule(bs, p)
+	if err != nil {
+		return fmt.Errorf("merge into %s: %w", conf, err)
+	}
+
+	if output == "" {
+		output = conf
+	}
+	klog.Infof("Merging %d queries into the schedule of %s ...", len(p.Queries), output)
+	return os.WriteFile(output, merged, 0o600)
+}
+
 // Unpack extracts SQL files from an osquery pack.
 func Unpack(sourcePaths []string, destPath string, c Config) error {
 	if destPath == "" {
 		destPath = "."
 	}
 
-	mms := map[string]*query.Metadata{}
+	ps := []*query.Pack{}
+	referenced := map[string]bool{}
 	for _, path := range sourcePaths {
-		p, err := query.LoadPack(path)
+		p, err := query.LoadPackWithConfig(path, c.parseConfig())
 		if err != nil {
 			return fmt.Errorf("load pack %s: %v", path, err)
 		}
 
-		if err := applyConfig(p.Queries, c); err != nil {
+		if err := applyConfig(p.Queries, c, nil, referenced); err != nil {
 			return fmt.Errorf("apply: %w", err)
 		}
-
-		for k, v := range p.Queries {
-			mms[k] = v
-		}
-
+		ps = append(ps, p)
 	}
+	if err := query.UnusedVars(c.Vars, referenced); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	p := query.FlattenPacks(ps)
 
-	err := query.SaveToDirectory(mms, destPath)
+	err := query.SaveToDirectoryWithConfig(p.Queries, destPath, c.renderConfig())
 	if err != nil {
 		return fmt.Errorf("save to dir: %v", err)
 	}
-	fmt.Printf("%d queries saved to %s\n", len(mms), destPath)
+	if err := query.SaveDiscovery(p.Discovery, destPath); err != nil {
+		return fmt.Errorf("save discovery: %v", err)
+	}
+	fmt.Printf("%d queries saved to %s\n", len(p.Queries), destPath)
+	if len(p.Discovery) > 0 {
+		fmt.Printf("%d discovery queries saved to %s\n", len(p.Discovery), filepath.Join(destPath, query.DiscoveryDir))
+	}
 	return nil
 }
 
-// dailyQueryDuration returns what the total duration for a query would be for a day.
-func dailyQueryDuration(interval string, d time.Duration) (time.Duration, int, error) {
-	i, err := strconv.Atoi(interval)
+// isPack returns true if path is an osquery pack: a .conf or .json file, or any other file
+// whose content is a top-level object with a "queries" key.
+func isPack(path string) bool {
+	if strings.Contains(path, ".conf") || strings.HasSuffix(path, ".json") {
+		return true
+	}
+
+	bs, err := os.ReadFile(path)
 	if err != nil {
-		return time.Duration(0), 0, err
+		return false
 	}
+	trimmed := bytes.TrimSpace(bs)
+	return bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(trimmed, []byte(`"queries"`))
+}
 
-	runs := 86400 / i
-	return time.Duration(runs) * d, runs, nil
+// loadPath loads the queries from a directory, pack, or SQL file.
+func loadPath(path string, c Config) (map[string]*query.Metadata, error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	loaded := map[string]*query.Metadata{}
+	switch {
+	case s.IsDir():
+		loaded, err = query.LoadFromDirWithConfig(path, c.parseConfig())
+		if err != nil {
+			return nil, fmt.Errorf("load from dir %s: %w", path, err)
+		}
+	case isPack(path):
+		p, err := query.LoadPackWithConfig(path, c.parseConfig())
+		if err != nil {
+			return nil, fmt.Errorf("load pack %s: %w", path, err)
+		}
+		loaded = p.Queries
+	default:
+		m, err := query.LoadWithConfig(path, c.parseConfig())
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", path, err)
+		}
+		loaded[m.Name] = m
+	}
+	return loaded, nil
 }
 
 func loadAndApply(paths []string, c Config) (map[string]*query.Metadata, error) {
 	mm := map[string]*query.Metadata{}
+	skipped := []string{}
 
 	for _, path := range paths {
-		s, err := os.Stat(path)
+		loaded, err := loadPath(path, c)
 		if err != nil {
-			return nil, fmt.Errorf("stat: %w", err)
-		}
-
-		loaded := map[string]*query.Metadata{}
-		switch {
-		case s.IsDir():
-			loaded, err = query.LoadFromDir(path)
-			if err != nil {
-				return mm, fmt.Errorf("load from dir %s: %w", path, err)
-			}
-		case strings.Contains(path, ".conf"):
-			p, err := query.LoadPack(path)
-			if err != nil {
-				return mm, fmt.Errorf("load pack %s: %w", path, err)
+			if !c.SkipErrors {
+				return mm, err
 			}
-			loaded = p.Queries
-		default:
-			m, err := query.Load(path)
-			if err != nil {
-				return mm, fmt.Errorf("load %s: %w", path, err)
-			}
-			loaded[m.Name] = m
+			klog.Errorf("skipping %s: %v", path, err)
+			skipped = append(skipped, path)
+			continue
 		}
 
 		for k, v := range loaded {
@@ -409,14 +928,61 @@ func loadAndApply(paths []string, c Config) (map[string]*query.Metadata, error)
 		klog.Infof("Loaded %d queries from %s", len(loaded), path)
 	}
 
+	if len(skipped) > 0 {
+		klog.Warningf("Skipped %d of %d paths due to errors: %s", len(skipped), len(paths), strings.Join(skipped, ", "))
+	}
+
+	if !c.RunDenyListed {
+		for name, m := range mm {
+			if m.DenyList {
+				klog.Infof("Skipping %s, denylisted (use --run-denylisted to override)", name)
+				delete(mm, name)
+			}
+		}
+	}
+
+	// Only the actions that render packs keep excluded queries, so that they are never run
+	ac := c
+	ac.DisableExcluded = false
+
 	klog.Infof("Applying configuration to %d queries: %+v", len(mm), c)
-	if err := applyConfig(mm, c); err != nil {
+	if err := applyConfig(mm, ac, nil, nil); err != nil {
 		return mm, fmt.Errorf("apply: %w", err)
 	}
 
 	return mm, nil
 }
 
+// isTerminal returns true if the file is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// logQuery logs the query text that will be sent to osqueryi.
+func logQuery(m *query.Metadata) {
+	klog.Infof("%q query:\n%s", m.Name, m.Query)
+	if m.SingleLineQuery != "" && m.SingleLineQuery != m.Query {
+		klog.Infof("%q single-line query: %s", m.Name, m.SingleLineQuery)
+	}
+}
+
+// defaultRetryBackoff is how long verify waits before its first retry of a failed query, doubling with each attempt.
+const defaultRetryBackoff = 500 * time.Millisecond
+
+// Output formats supported by run and diff.
+const (
+	formatText   = "text"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	formatJSON   = "json"
+	// formatFleetYAML renders packs as Fleet query documents.
+	formatFleetYAML = "fleet-yaml"
+)
+
 // Run runs the queries within a directory or pack.
 func Run(path []string, output string, c Config) error {
 	mm, err := loadAndApply(path, c)
@@ -424,150 +990,439 @@ func Run(path []string, output string, c Config) error {
 		return err
 	}
 
+	switch c.Format {
+	case "", formatText, formatCSV, formatNDJSON, formatJSON:
+	default:
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+
+	if c.ReuseOsqueryi {
+		pool := newSessionPool(c.Workers, c.runConfig())
+		defer pool.Close()
+		c.run = pool.Run
+	}
+
+	if c.Compare != "" {
+		qs := []*query.Metadata{}
+		for _, m := range mm {
+			if cw := query.IsIncompatible(m); cw != "" {
+				klog.V(1).Infof("skipping incompatible query: %s (%s)", m.Name, cw)
+				continue
+			}
+			qs = append(qs, m)
+		}
+		sort.Slice(qs, func(i, j int) bool { return qs[i].Name < qs[j].Name })
+		return compareQueries(os.Stdout, c.Compare, qs, c)
+	}
+
+	if isOutputDir(output) {
+		if err := os.MkdirAll(output, 0o755); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		qs := []*query.Metadata{}
+		for _, m := range mm {
+			if cw := query.IsIncompatible(m); cw != "" {
+				klog.V(1).Infof("skipping incompatible query: %s (%s)", m.Name, cw)
+				continue
+			}
+			qs = append(qs, m)
+		}
+		return errors.Join(runQueriesToDir(output, qs, c)...)
+	}
+
+	if c.Format == formatJSON {
+		return fmt.Errorf("--format=json requires --output to be a directory")
+	}
+
 	f := os.Stdout
 	if output != "" && output != "-" {
-		f, err = os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o700)
-		if err != nil {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if c.Append {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
 
+		f, err = os.OpenFile(output, flags, 0o600)
+		if err != nil {
 			return fmt.Errorf("unable to open output: %s", err)
 		}
+		defer f.Close()
 	}
 
-	errs := []error{}
 	qs := []*query.Metadata{}
 	for _, q := range mm {
 		qs = append(qs, q)
 	}
-
 	sort.Slice(qs, func(i, j int) bool { return qs[i].Name < qs[j].Name })
-	lastRows := -1
 
-	// TODO: Parallelize. Output must be sorted for diffing
+	skipped := []*query.Metadata{}
+	groups := map[string][]*query.Metadata{}
 	for _, m := range qs {
-		m := m
-		name := m.Name
-
 		if cw := query.IsIncompatible(m); cw != "" {
-			klog.V(1).Infof("skipping incompatible query: %s (%s)", name, cw)
+			klog.V(1).Infof("skipping incompatible query: %s (%s)", m.Name, cw)
+			skipped = append(skipped, m)
 			continue
 		}
 
-		vf, verr := query.Run(m)
-		if verr != nil {
-			klog.Errorf("%q failed: %v", name, verr)
-			errs = append(errs, verr)
-			continue
+		group := ""
+		if c.GroupByPlatform {
+			group = strings.Join(m.Platforms(), ",")
+			if group == "" {
+				group = "any"
+			}
 		}
+		groups[group] = append(groups[group], m)
+	}
 
-		// TODO: Consider CSV output
-		header := fmt.Sprintf("%s (%d rows)", name, len(vf.Rows))
-
-		// If this is a big entry after a short entry, add a space
-		if lastRows == 0 && len(vf.Rows) > 0 {
-			fmt.Fprintln(f, "")
-		}
-		fmt.Fprintln(f, header)
+	names := []string{}
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
 
-		lastRows = len(vf.Rows)
-		if len(vf.Rows) == 0 {
-			continue
+	errs := []error{}
+	for i, g := range names {
+		if c.GroupByPlatform {
+			if i > 0 {
+				fmt.Fprintln(f, "")
+			}
+			fmt.Fprintf(f, "== %s ==\n\n", g)
 		}
+		errs = append(errs, runQueries(f, groups[g], c)...)
+	}
 
-		divider := strings.Repeat("-", utf8.RuneCountInString(header))
-		fmt.Fprintln(f, divider)
-		for _, v := range vf.Rows {
-			fmt.Fprintln(f, v)
+	if c.GroupByPlatform && len(skipped) > 0 {
+		fmt.Fprintf(f, "\n== skipped: incompatible with %s ==\n\n", runtime.GOOS)
+		for _, m := range skipped {
+			fmt.Fprintf(f, "%s (%s)\n", m.Name, m.Platform)
 		}
-		fmt.Fprintln(f, "")
 	}
 
 	return errors.Join(errs...)
 }
 
-// Verify verifies the queries within a directory or pack.
-func Verify(path []string, c Config) error {
-	mm, err := loadAndApply(path, c)
-	if err != nil {
-		return err
+// writeCSV writes the rows of a query as CSV, preceded by a single-field marker row when marker is not empty.
+// If columns is nil, every column is written.
+func writeCSV(w io.Writer, marker string, vf *query.RunResult, columns []string) error {
+	if marker != "" {
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{marker}); err != nil {
+			return err
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
 	}
 
-	var (
-		verified, partial  uint64
-		totalQueryDuration time.Duration
-		totalRuns          int64
-	)
-
-	sg := semgroup.NewGroup(context.Background(), int64(c.Workers))
+	if len(vf.Rows) > 0 {
+		bs, err := vf.CSV(columns)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(bs); err != nil {
+			return err
+		}
+	}
 
-	for name, m := range mm {
-		m := m
-		name := name
+	if marker != "" {
+		_, err := fmt.Fprintln(w, "")
+		return err
+	}
+	return nil
+}
 
-		sg.Go(func() error {
-			klog.Infof("Verifying: %q ", name)
-			vf, verr := query.Run(m)
-			if verr != nil {
-				klog.Errorf("%q failed validation: %v", name, verr)
-				return fmt.Errorf("%s: %w", name, verr)
+// writeNDJSON writes each row of a query as a JSON object with a "_query" field, flushing once the query is complete.
+// If columns is set, the "_query" field is followed by only those columns, in order.
+func writeNDJSON(w io.Writer, name string, vf *query.RunResult, columns []string) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range vf.Rows {
+		var bs []byte
+		if columns != nil {
+			bs = orderedJSON(append([]string{"_query"}, columns...), append([]string{name}, r.Values(columns)...))
+		} else {
+			o := map[string]string{"_query": name}
+			for k, v := range r {
+				o[k] = v
 			}
 
-			// Short-circuit out of remaining tests if the query is not compatible with the local platform
-			if vf.IncompatiblePlatform != "" {
-				atomic.AddUint64(&partial, 1)
-				return nil
+			// encoding/json sorts map keys, so the output is deterministic
+			var err error
+			bs, err = json.Marshal(o)
+			if err != nil {
+				return err
 			}
+		}
+		if _, err := fmt.Fprintf(bw, "%s\n", bs); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
 
-			if vf.Elapsed > c.maxQueryDuration {
-				return fmt.Errorf("%q: %s exceeds --max-query-duration=%s", name, vf.Elapsed.Round(time.Millisecond), c.maxQueryDuration)
-			}
+// writeJSON writes the rows of a query as an indented JSON array. If columns is set, each row
+// has only those columns, in order.
+func writeJSON(w io.Writer, vf *query.RunResult, columns []string) error {
+	var bs []byte
+	if columns != nil {
+		objs := [][]byte{}
+		for _, r := range vf.Rows {
+			objs = append(objs, orderedJSON(columns, r.Values(columns)))
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, append(append([]byte("["), bytes.Join(objs, []byte(","))...), ']'), "", "  "); err != nil {
+			return err
+		}
+		bs = buf.Bytes()
+	} else {
+		var err error
+		bs, err = json.MarshalIndent(vf.Rows, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(append(bs, '\n'))
+	return err
+}
 
-			queryDurationPerDay, runsPerDay, err := dailyQueryDuration(m.Interval, vf.Elapsed)
-			if err != nil {
-				return fmt.Errorf("%q: failed to parse interval: %v", name, err)
-			}
+// orderedJSON renders a JSON object of string values, with keys in the given order rather than sorted.
+func orderedJSON(keys []string, values []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		// Marshalling a string can not fail
+		kb, _ := json.Marshal(k)
+		vb, _ := json.Marshal(values[i])
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
 
-			atomic.AddInt64((*int64)(&totalQueryDuration), int64(queryDurationPerDay))
-			atomic.AddInt64((&totalRuns), int64(runsPerDay))
+// isOutputDir returns true if the --output of run names a directory: one that exists, or ends with a separator.
+func isOutputDir(output string) bool {
+	if output == "" || output == "-" {
+		return false
+	}
+	if strings.HasSuffix(output, "/") || strings.HasSuffix(output, string(filepath.Separator)) {
+		return true
+	}
+	fi, err := os.Stat(output)
+	return err == nil && fi.IsDir()
+}
 
-			if queryDurationPerDay > c.maxQueryDurationPerDay {
-				return fmt.Errorf("%q: %s exceeds --max-daily-query-duration=%s (%d runs * %s)", name, queryDurationPerDay.Round(time.Second), c.maxQueryDurationPerDay, runsPerDay, vf.Elapsed.Round(time.Millisecond))
-			}
+// outputExtensions are the file extensions used by runQueriesToDir for each --format.
+var outputExtensions = map[string]string{
+	"":           ".txt",
+	formatText:   ".txt",
+	formatCSV:    ".csv",
+	formatNDJSON: ".ndjson",
+	formatJSON:   ".json",
+}
 
-			if len(vf.Rows) > c.MaxResults {
-				shortResult := []string{}
-				for _, r := range vf.Rows {
-					shortResult = append(shortResult, r.String())
-				}
-				if len(shortResult) >= 10 {
-					shortResult = shortResult[0:10]
-					shortResult = append(shortResult, "...")
-				}
+// runQueriesToDir runs a list of compatible queries concurrently, writing the results of each in the configured --format
+// to a file within dir named after the query, such as users.txt.
+func runQueriesToDir(dir string, qs []*query.Metadata, c Config) []error {
+	errs := []error{}
+	results := startQueries(qs, c)
+	for i, m := range qs {
+		<-results[i].done
 
-				return fmt.Errorf("%q: %d results exceeds --max-results=%d:\n  %s", name, len(vf.Rows), c.MaxResults, strings.Join(shortResult, "\n  "))
+		vf, err := results[i].vf, results[i].err
+		if err != nil {
+			klog.Errorf("%q failed: %v", m.Name, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		header := fmt.Sprintf("%s (%d rows)", m.Name, len(vf.Rows))
+		vf, more := limitRows(vf, c.MaxResults)
+
+		var buf bytes.Buffer
+		switch c.Format {
+		case formatCSV:
+			logOmitted(m.Name, more, c)
+			err = writeCSV(&buf, "", vf, c.Columns)
+		case formatNDJSON:
+			logOmitted(m.Name, more, c)
+			err = writeNDJSON(&buf, m.Name, vf, c.Columns)
+		case formatJSON:
+			logOmitted(m.Name, more, c)
+			err = writeJSON(&buf, vf, c.Columns)
+		default:
+			fmt.Fprintln(&buf, header)
+			if len(vf.Rows) > 0 {
+				writeRows(&buf, header, m.Name, vf, more, c)
 			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+			continue
+		}
 
-			klog.Infof("%q returned %d rows in %s, daily cost for interval %s (%d runs): %s", name, len(vf.Rows), vf.Elapsed.Round(time.Millisecond), m.Interval, runsPerDay, queryDurationPerDay.Round(time.Second))
-			atomic.AddUint64(&verified, 1)
-			return nil
-		})
+		path := filepath.Join(dir, m.Name+outputExtensions[c.Format])
+		klog.Infof("Writing %d rows to %s ...", len(vf.Rows), path)
+		if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errs
+}
 
-	errs := []error{}
-	// Someday this might return new go errors
-	errs = append(errs, sg.Wait())
-	errored := uint64(len(errs))
+// limitRows returns a result with at most limit rows, along with the number of rows omitted.
+// A limit of 0 or less keeps every row.
+func limitRows(vf *query.RunResult, limit int) (*query.RunResult, int) {
+	if limit <= 0 || len(vf.Rows) <= limit {
+		return vf, 0
+	}
+	shown := *vf
+	shown.Rows = vf.Rows[:limit]
+	return &shown, len(vf.Rows) - limit
+}
 
-	if verified == 0 {
-		errs = append(errs, fmt.Errorf("0 queries were fully verified"))
+// logOmitted logs the rows omitted by --max-results, for formats where a trailing note would corrupt the output.
+func logOmitted(name string, more int, c Config) {
+	if more > 0 {
+		klog.Infof("%q: omitted %d rows beyond --max-results=%d", name, more, c.MaxResults)
 	}
+}
 
-	if totalQueryDuration > c.MaxTotalQueryDurationPerDay {
-		errs = append(errs, fmt.Errorf("total query duration per day (%s) exceeds --max-total-daily-duration=%s", totalQueryDuration.Round(time.Second), c.MaxTotalQueryDurationPerDay))
+// writeRows writes the rows of a query in the text format of run, below its header line,
+// followed by a note if more rows were omitted.
+func writeRows(w io.Writer, header string, name string, vf *query.RunResult, more int, c Config) {
+	prefix := ""
+	if c.ExplainRows {
+		prefix = fmt.Sprintf("[%s] ", name)
 	}
 
-	klog.Infof("%d queries found: %d verified, %d errored, %d partial", len(mm), verified, errored, partial)
-	klog.Infof("total daily query runs: %d", totalRuns)
-	klog.Infof("total daily execution time: %s", totalQueryDuration)
+	truncated := ""
+	if more > 0 {
+		truncated = fmt.Sprintf("%s... (%d more rows)", prefix, more)
+	}
 
-	return errors.Join(errs...)
+	if c.PrettyRows {
+		headers := vf.Columns()
+		if c.Columns != nil {
+			headers = c.Columns
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(vf.Pretty(headers), "\n"), "\n") {
+			fmt.Fprintln(w, prefix+line)
+		}
+		if truncated != "" {
+			fmt.Fprintln(w, truncated)
+		}
+		fmt.Fprintln(w, "")
+		return
+	}
+
+	divider := strings.Repeat("-", utf8.RuneCountInString(header))
+	fmt.Fprintln(w, divider)
+	for _, v := range vf.Rows {
+		line := v.String()
+		if c.Columns != nil {
+			line = v.Text(c.Columns)
+		}
+		fmt.Fprintf(w, "%s%s\n", prefix, line)
+	}
+	if truncated != "" {
+		fmt.Fprintln(w, truncated)
+	}
+	fmt.Fprintln(w, "")
+}
+
+// runResult is the outcome of running a query, available once done is closed.
+type runResult struct {
+	vf   *query.RunResult
+	err  error
+	done chan struct{}
+}
+
+// startQueries runs a list of queries with up to c.Workers at a time. Queries are started in order, so
+// waiting on each result in turn allows results to be handled in order as soon as they are available.
+func startQueries(qs []*query.Metadata, c Config) []*runResult {
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]*runResult, len(qs))
+	for i := range results {
+		results[i] = &runResult{done: make(chan struct{})}
+	}
+
+	go func() {
+		sg := semgroup.NewGroup(context.Background(), int64(workers))
+		for i, m := range qs {
+			i, m := i, m
+			sg.Go(func() error {
+				defer close(results[i].done)
+				if c.PrintQuery {
+					logQuery(m)
+				}
+				results[i].vf, results[i].err = c.runQuery(m)
+				return nil
+			})
+		}
+		if err := sg.Wait(); err != nil {
+			klog.Errorf("run: %v", err)
+		}
+	}()
+
+	return results
+}
+
+// runQueries runs a list of compatible queries concurrently, writing their results in order.
+func runQueries(w io.Writer, qs []*query.Metadata, c Config) []error {
+	errs := []error{}
+	lastRows := -1
+
+	results := startQueries(qs, c)
+	for i, m := range qs {
+		name := m.Name
+		<-results[i].done
+
+		vf, verr := results[i].vf, results[i].err
+		if verr != nil {
+			klog.Errorf("%q failed: %v", name, verr)
+			errs = append(errs, verr)
+			continue
+		}
+
+		header := fmt.Sprintf("%s (%d rows)", name, len(vf.Rows))
+		vf, more := limitRows(vf, c.MaxResults)
+
+		switch c.Format {
+		case formatCSV:
+			logOmitted(name, more, c)
+			if err := writeCSV(w, header, vf, c.Columns); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+			continue
+		case formatNDJSON:
+			logOmitted(name, more, c)
+			if err := writeNDJSON(w, name, vf, c.Columns); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+			continue
+		}
+
+		// If this is a big entry after a short entry, add a space
+		if lastRows == 0 && len(vf.Rows) > 0 {
+			fmt.Fprintln(w, "")
+		}
+		fmt.Fprintln(w, header)
+
+		lastRows = len(vf.Rows)
+		if len(vf.Rows) == 0 {
+			continue
+		}
+
+		writeRows(w, header, name, vf, more, c)
+	}
+
+	return errs
 }
@@ -0,0 +1,906 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/klog/v2"
+)
+
+func TestLoadAndApplyDenyList(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users.sql": "SELECT * FROM users;",
+		"noisy.sql": "-- denylist: true\nSELECT * FROM processes;",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+	mm, err := loadAndApply([]string{dir}, c)
+	if err != nil {
+		t.Fatalf("loadAndApply: %v", err)
+	}
+	if mm["noisy"] != nil {
+		t.Errorf("denylisted query was not skipped")
+	}
+	if mm["users"] == nil {
+		t.Errorf("users query was unexpectedly skipped")
+	}
+
+	c.RunDenyListed = true
+	mm, err = loadAndApply([]string{dir}, c)
+	if err != nil {
+		t.Fatalf("loadAndApply: %v", err)
+	}
+	if mm["noisy"] == nil {
+		t.Errorf("denylisted query was skipped despite RunDenyListed")
+	}
+}
+
+// captureLogs redirects klog output into a buffer for the duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	t.Cleanup(func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	})
+	return &buf
+}
+
+func TestLogQuery(t *testing.T) {
+	buf := captureLogs(t)
+	logQuery(&query.Metadata{
+		Name:            "users",
+		Query:           "SELECT *\nFROM users;",
+		SingleLineQuery: "SELECT * FROM users;",
+	})
+	klog.Flush()
+
+	got := buf.String()
+	for _, want := range []string{"\"users\" query:\nSELECT *\nFROM users;", "\"users\" single-line query: SELECT * FROM users;"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("logQuery() output missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestLoadAndApplySkipErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.sql"), []byte("SELECT * FROM users;"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	paths := []string{dir, filepath.Join(dir, "does-not-exist")}
+
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+	if _, err := loadAndApply(paths, c); err == nil {
+		t.Errorf("loadAndApply() = nil error, want error for missing path")
+	}
+
+	c.SkipErrors = true
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		t.Fatalf("loadAndApply() with SkipErrors = %v", err)
+	}
+	if len(mm) != 1 || mm["users"] == nil {
+		t.Errorf("loadAndApply() = %v, want only the users query", mm)
+	}
+}
+
+// writeQueries writes SQL files into a temporary directory, returning the directory.
+func writeQueries(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestRunDisableExcluded(t *testing.T) {
+	ran := filepath.Join(t.TempDir(), "ran.sql")
+	stubOsqueryi(t, `cat >> "`+ran+`"; echo '[{"a":"1"}]'`)
+	dir := writeQueries(t, map[string]string{
+		"users.sql":     "SELECT * FROM users;",
+		"processes.sql": "SELECT * FROM processes;",
+	})
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     1,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		Exclude:                     []string{"processes"},
+		DisableExcluded:             true,
+	}
+
+	if err := Run([]string{dir}, filepath.Join(t.TempDir(), "out.txt"), c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	bs, err := os.ReadFile(ran)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if strings.Contains(string(bs), "processes") {
+		t.Errorf("excluded query was run: %s", bs)
+	}
+	if got := strings.Count(string(bs), "FROM users"); got != 2 {
+		t.Errorf("users ran %d times, want 2 (run, then verify):\n%s", got, bs)
+	}
+}
+
+func TestRunOutputTruncates(t *testing.T) {
+	rows := filepath.Join(t.TempDir(), "rows.json")
+	stubOsqueryi(t, `cat > /dev/null; cat "`+rows+`"`)
+	dir := writeQueries(t, map[string]string{"users.sql": "SELECT * FROM users;"})
+	out := filepath.Join(t.TempDir(), "out.txt")
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+
+	if err := os.WriteFile(rows, []byte(`[{"username":"root"},{"username":"daemon"},{"username":"nobody"}]`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if err := os.WriteFile(rows, []byte(`[]`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := "users (0 rows)\n"; string(got) != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	c.Append = true
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got, err = os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := "users (0 rows)\nusers (0 rows)\n"; string(got) != want {
+		t.Errorf("appended output = %q, want %q", got, want)
+	}
+}
+
+func TestRunGroupByPlatform(t *testing.T) {
+	stubOsqueryi(t, `cat > /dev/null; echo '[{"a":"1"}]'`)
+	dir := writeQueries(t, map[string]string{
+		"local.sql":     "-- platform: " + runtime.GOOS + "\nSELECT 1 AS a;",
+		"anywhere.sql":  "SELECT 1 AS a;",
+		"elsewhere.sql": "-- platform: plan9\nSELECT 1 AS a;",
+	})
+	out := filepath.Join(t.TempDir(), "out.txt")
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, GroupByPlatform: true}
+
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	want := fmt.Sprintf(`== any ==
+
+anywhere (1 rows)
+-----------------
+a:1
+
+
+== %s ==
+
+local (1 rows)
+--------------
+a:1
+
+
+== skipped: incompatible with %s ==
+
+elsewhere (plan9)
+`, runtime.GOOS, runtime.GOOS)
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("Run() output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckIntervalModifiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		wantErr string
+	}{
+		{name: "int", entries: []string{"rapid=20"}},
+		{name: "duration", entries: []string{"transient=6m"}},
+		{name: "multiplier", entries: []string{"persistent=1.25x"}},
+		{name: "divisor", entries: []string{"often=x/3"}},
+		{name: "default flag", entries: strings.Split("transient=6m,persistent=1.25x,postmortem=6h,rapid=20s,often=x/3,seldom=3x", ",")},
+		{name: "empty", entries: []string{""}},
+		{name: "malformed duration", entries: []string{"transient=6mm", "rapid=20s"}, wantErr: `1 invalid entries: "transient=6mm"`},
+		{name: "missing equals", entries: []string{"transient"}, wantErr: `"transient": missing '='`},
+		{name: "zero divisor", entries: []string{"often=x/0"}, wantErr: `"often=x/0"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkIntervalModifiers("tag-intervals", tc.entries)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("checkIntervalModifiers(%v) = %v, want nil", tc.entries, err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("checkIntervalModifiers(%v) = %v, want error containing %q", tc.entries, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyConfigCanonicalQuery(t *testing.T) {
+	m, err := query.Parse("users", []byte("select  *\n   from users   where uid=0"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	c := Config{
+		DefaultInterval: time.Hour,
+		MaxInterval:     24 * time.Hour,
+		MultiLine:       true,
+		CanonicalQuery:  true,
+		SQLFormatter:    "osqtool-missing-formatter --reindent",
+	}
+	mm := map[string]*query.Metadata{"users": m}
+	if err := applyConfig(mm, c, nil, nil); err != nil {
+		t.Fatalf("applyConfig: %v", err)
+	}
+
+	if want := "SELECT *\nFROM users\nWHERE uid=0;"; m.Query != want {
+		t.Errorf("Query = %q, want %q", m.Query, want)
+	}
+	if want := "SELECT * FROM users WHERE uid=0;"; m.SingleLineQuery != want {
+		t.Errorf("SingleLineQuery = %q, want %q", m.SingleLineQuery, want)
+	}
+}
+
+func TestApplyConfigClampReport(t *testing.T) {
+	mm := map[string]*query.Metadata{
+		"rapid":  {Name: "rapid", Interval: "5"},
+		"seldom": {Name: "seldom", Interval: "604800"},
+		"normal": {Name: "normal", Interval: "3600"},
+	}
+	c := Config{MinInterval: 20 * time.Second, MaxInterval: 24 * time.Hour}
+
+	r := &query.ApplyReport{}
+	if err := applyConfig(mm, c, r, nil); err != nil {
+		t.Fatalf("applyConfig: %v", err)
+	}
+
+	want := []query.ClampEvent{
+		{Name: "rapid", Requested: 5, Clamped: 20, Bound: "min"},
+		{Name: "seldom", Requested: 604800, Clamped: 86400, Bound: "max"},
+	}
+
+	var sb strings.Builder
+	if err := writeClampReport(&sb, r); err != nil {
+		t.Fatalf("writeClampReport: %v", err)
+	}
+	if diff := cmp.Diff(want, r.Clamps); diff != "" {
+		t.Errorf("clamps mismatch (-want +got):\n%s", diff)
+	}
+
+	wantReport := `2 intervals clamped:
+QUERY   REQUESTED  CLAMPED  BOUND
+rapid   5s         20s      min
+seldom  604800s    86400s   max
+`
+	if diff := cmp.Diff(wantReport, sb.String()); diff != "" {
+		t.Errorf("report mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPackDryRun(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"rapid.sql":  "-- interval: 5\nSELECT * FROM processes;",
+		"odd.sql":    "-- interval: 3500\nSELECT * FROM users;",
+		"normal.sql": "-- interval: 3600\nSELECT * FROM groups;",
+		"legacy.sql": "SELECT * FROM kernel_extensions;",
+	})
+	output := filepath.Join(t.TempDir(), "pack.conf")
+	c := Config{
+		MinInterval:   20 * time.Second,
+		MaxInterval:   24 * time.Hour,
+		RoundInterval: time.Hour,
+		Exclude:       []string{"legacy"},
+		DryRun:        true,
+	}
+
+	if err := Pack([]string{dir}, output, c); err != nil {
+		t.Fatalf("Pack() = %v", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Pack() wrote %s during a dry run: %v", output, err)
+	}
+
+	mm, err := query.LoadFromDir(dir)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	r := &query.ApplyReport{}
+	if err := applyConfig(mm, c, r, nil); err != nil {
+		t.Fatalf("applyConfig: %v", err)
+	}
+
+	var sb strings.Builder
+	if err := writeDryRunSummary(&sb, r); err != nil {
+		t.Fatalf("writeDryRunSummary: %v", err)
+	}
+	if got, want := sb.String(), "dry run: 4 queries, 2 overridden, 1 excluded\n"; got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestLint(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"users.sql": "-- Local users\nSELECT username FROM users;",
+		"all.sql":   "SELECT * FROM processes;",
+	})
+
+	var sb strings.Builder
+	if err := Lint([]string{dir}, &sb, Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}); err != nil {
+		t.Errorf("Lint() = %v, want nil for warnings", err)
+	}
+
+	want := `all: [warning] missing-description: query has no description
+all: [warning] select-star: SELECT * returns unstable columns; list the columns you need
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("Lint() output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunExplainRows(t *testing.T) {
+	stubOsqueryi(t, `case "$(cat)" in
+  *users*) echo '[{"username":"root"},{"username":"daemon"}]' ;;
+  *) echo '[{"pid":"1"}]' ;;
+esac`)
+	dir := writeQueries(t, map[string]string{
+		"users.sql":     "SELECT username FROM users;",
+		"processes.sql": "SELECT pid FROM processes;",
+	})
+
+	var sb strings.Builder
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, ExplainRows: true}
+	mm, err := loadAndApply([]string{dir}, c)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if errs := runQueries(&sb, []*query.Metadata{mm["processes"], mm["users"]}, c); len(errs) > 0 {
+		t.Fatalf("runQueries: %v", errs)
+	}
+
+	want := `processes (1 rows)
+------------------
+[processes] pid:1
+
+users (2 rows)
+--------------
+[users] username:root
+[users] username:daemon
+
+`
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunMaxResults(t *testing.T) {
+	stubOsqueryi(t, `cat > /dev/null
+echo '[{"pid":"1"},{"pid":"2"},{"pid":"3"},{"pid":"4"}]'`)
+	dir := writeQueries(t, map[string]string{"processes.sql": "SELECT pid FROM processes;"})
+
+	tests := []struct {
+		name       string
+		maxResults int
+		pretty     bool
+		format     string
+		want       string
+	}{
+		{name: "truncated", maxResults: 2, want: `processes (4 rows)
+------------------
+pid:1
+pid:2
+... (2 more rows)
+
+`},
+		{name: "pretty", maxResults: 3, pretty: true, want: `processes (4 rows)
++-----+
+| pid |
++-----+
+| 1   |
+| 2   |
+| 3   |
++-----+
+... (1 more rows)
+
+`},
+		{name: "csv", maxResults: 2, format: formatCSV, want: `processes (4 rows)
+pid
+1
+2
+
+`},
+		{name: "ndjson", maxResults: 1, format: formatNDJSON, want: `{"_query":"processes","pid":"1"}
+`},
+		{name: "unlimited", maxResults: 0, want: `processes (4 rows)
+------------------
+pid:1
+pid:2
+pid:3
+pid:4
+
+`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var sb strings.Builder
+			c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, MaxResults: tc.maxResults, PrettyRows: tc.pretty, Format: tc.format}
+			mm, err := loadAndApply([]string{dir}, c)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if errs := runQueries(&sb, []*query.Metadata{mm["processes"]}, c); len(errs) > 0 {
+				t.Fatalf("runQueries: %v", errs)
+			}
+			if diff := cmp.Diff(tc.want, sb.String()); diff != "" {
+				t.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPackVarsAcrossSources(t *testing.T) {
+	plain := writeQueries(t, map[string]string{"users.sql": "SELECT uid FROM users;"})
+	templated := writeQueries(t, map[string]string{"listeners.sql": "SELECT * FROM listening_ports WHERE port > {{.min_port}};"})
+	output := filepath.Join(t.TempDir(), "pack.conf")
+
+	// A variable only needs to be referenced by one of the sources
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Vars: map[string]string{"min_port": "1024"}}
+	if err := Pack([]string{plain, templated}, output, c); err != nil {
+		t.Fatalf("Pack() = %v", err)
+	}
+	bs, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(bs), "port > 1024") {
+		t.Errorf("pack = %s, want min_port substituted", bs)
+	}
+
+	c.Vars["agent"] = "x"
+	if err := Pack([]string{plain, templated}, output, c); err == nil || !strings.Contains(err.Error(), "not referenced by any query: agent") {
+		t.Errorf("Pack() = %v, want unreferenced variable error", err)
+	}
+}
+
+func TestPackMergeInto(t *testing.T) {
+	dir := writeQueries(t, map[string]string{"users.sql": "-- Local users\n-- interval: 600\nSELECT uid FROM users;"})
+	conf := filepath.Join(t.TempDir(), "osquery.conf")
+	if err := os.WriteFile(conf, []byte(`{"options": {"host_identifier": "uuid"}, "schedule": {}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, MergeInto: conf}
+	if err := Pack([]string{dir}, "", c); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	got, err := os.ReadFile(conf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := `{
+  "options": {
+    "host_identifier": "uuid"
+  },
+  "schedule": {
+    "users": {
+      "query": "SELECT uid FROM users;",
+      "interval": "600",
+      "description": "Local users"
+    }
+  }
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("merged config mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunCSV(t *testing.T) {
+	stubOsqueryi(t, `case "$(cat)" in
+  *users*) printf '%s' '[{"username":"root","shell":"/bin/sh"},{"username":"Doe, Jane","description":"line one\nline two"}]' ;;
+  *) echo '[]' ;;
+esac`)
+	dir := writeQueries(t, map[string]string{
+		"users.sql": "SELECT * FROM users;",
+		"empty.sql": "SELECT * FROM empty;",
+	})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Format: formatCSV}
+
+	out := filepath.Join(t.TempDir(), "out.csv")
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	users := "description,shell,username\n,/bin/sh,root\n\"line one\nline two\",,\"Doe, Jane\"\n"
+	want := "empty (0 rows)\n\nusers (2 rows)\n" + users + "\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+
+	outDir := t.TempDir()
+	if err := Run([]string{dir}, outDir, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got, err = os.ReadFile(filepath.Join(outDir, "users.csv"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if diff := cmp.Diff(users, string(got)); diff != "" {
+		t.Errorf("users.csv mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunNDJSON(t *testing.T) {
+	stubOsqueryi(t, `case "$(cat)" in
+  *users*) echo '[{"username":"root","uid":"0"},{"username":"nobody","uid":"65534"}]' ;;
+  *) echo '[{"pid":"1"}]' ;;
+esac`)
+	dir := writeQueries(t, map[string]string{
+		"users.sql":     "SELECT username, uid FROM users;",
+		"processes.sql": "SELECT pid FROM processes;",
+	})
+	out := filepath.Join(t.TempDir(), "out.ndjson")
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Format: formatNDJSON}
+
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	want := `{"_query":"processes","pid":"1"}
+{"_query":"users","uid":"0","username":"root"}
+{"_query":"users","uid":"65534","username":"nobody"}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunColumns(t *testing.T) {
+	stubOsqueryi(t, `echo '[{"path":"/bin/sh","sha256":"abc","mode":"0755"},{"path":"/tmp/x","mode":"0600"}]'`)
+	dir := writeQueries(t, map[string]string{"hashes.sql": "SELECT path, sha256, mode FROM hash JOIN file USING (path);"})
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: formatText, want: "hashes (2 rows)\n---------------\nsha256:abc path:/bin/sh owner:\nsha256: path:/tmp/x owner:\n\n"},
+		{format: formatCSV, want: "hashes (2 rows)\nsha256,path,owner\nabc,/bin/sh,\n,/tmp/x,\n\n"},
+		{format: formatNDJSON, want: `{"_query":"hashes","sha256":"abc","path":"/bin/sh","owner":""}
+{"_query":"hashes","sha256":"","path":"/tmp/x","owner":""}
+`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Format: tc.format, Columns: []string{"sha256", "path", "owner"}}
+			out := filepath.Join(t.TempDir(), "out")
+			if err := Run([]string{dir}, out, c); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("output mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunOutputDir(t *testing.T) {
+	stubOsqueryi(t, `case "$(cat)" in
+  *users*) echo '[{"username":"root","uid":"0"},{"username":"nobody","uid":"65534"}]' ;;
+  *) echo '[]' ;;
+esac`)
+	dir := writeQueries(t, map[string]string{
+		"users.sql": "SELECT username, uid FROM users;",
+		"empty.sql": "SELECT * FROM empty;",
+	})
+
+	tests := []struct {
+		format string
+		file   string
+		want   string
+	}{
+		{format: formatText, file: "users.txt", want: "users (2 rows)\n--------------\nuid:0 username:root\nuid:65534 username:nobody\n\n"},
+		{format: formatText, file: "empty.txt", want: "empty (0 rows)\n"},
+		{format: formatJSON, file: "users.json", want: "[\n  {\n    \"uid\": \"0\",\n    \"username\": \"root\"\n  },\n  {\n    \"uid\": \"65534\",\n    \"username\": \"nobody\"\n  }\n]\n"},
+		{format: formatJSON, file: "empty.json", want: "[]\n"},
+		{format: formatNDJSON, file: "users.ndjson", want: "{\"_query\":\"users\",\"uid\":\"0\",\"username\":\"root\"}\n{\"_query\":\"users\",\"uid\":\"65534\",\"username\":\"nobody\"}\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			// A trailing separator creates the directory
+			out := filepath.Join(t.TempDir(), "golden") + "/"
+			c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Format: tc.format}
+			if err := Run([]string{dir}, out, c); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(out, tc.file))
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("%s mismatch (-want +got):\n%s", tc.file, diff)
+			}
+		})
+	}
+
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Format: formatJSON}
+	if err := Run([]string{dir}, filepath.Join(t.TempDir(), "out.json"), c); err == nil {
+		t.Errorf("Run(--format=json to a file) = nil, want error")
+	}
+}
+
+func TestLintErrors(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"hashes.sql": "-- Every hash\nSELECT sha256 FROM hash;",
+	})
+
+	var sb strings.Builder
+	err := Lint([]string{dir}, &sb, Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour})
+	if err == nil {
+		t.Errorf("Lint() = nil, want error for error-severity finding")
+	}
+	if want := "hashes: [error] missing-where: hash is scanned without a WHERE clause\n"; sb.String() != want {
+		t.Errorf("Lint() output = %q, want %q", sb.String(), want)
+	}
+}
+
+func TestRunParallelOrdered(t *testing.T) {
+	stubOsqueryi(t, `case "$(cat)" in
+  *slow*) sleep 0.3; echo '[{"speed":"slow"}]' ;;
+  *empty*) echo '[]' ;;
+  *) echo '[{"speed":"fast"}]' ;;
+esac`)
+	dir := writeQueries(t, map[string]string{
+		"a-slow.sql":  "SELECT 'slow' AS speed;",
+		"b-empty.sql": "SELECT 'empty' AS speed;",
+		"c-fast.sql":  "SELECT 'fast' AS speed;",
+	})
+	out := filepath.Join(t.TempDir(), "out.txt")
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, Workers: 3}
+
+	if err := Run([]string{dir}, out, c); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	want := `a-slow (1 rows)
+---------------
+speed:slow
+
+b-empty (0 rows)
+
+c-fast (1 rows)
+---------------
+speed:fast
+
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStringsFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	sf := stringsFlag{}
+	fs.Var(&sf, "osquery-flags", "")
+	if err := fs.Parse([]string{"--osquery-flags=--disable_extensions=false", "--osquery-flags", "--a=1 --b"}); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := stringsFlag{"--disable_extensions=false", "--a=1", "--b"}
+	if diff := cmp.Diff(want, sf); diff != "" {
+		t.Errorf("flags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDiscoveryRoundTrip(t *testing.T) {
+	discovery := []string{
+		"SELECT pid FROM processes WHERE name = 'ossec-agentd';",
+		"SELECT 1 FROM os_version WHERE platform = 'ubuntu';",
+	}
+	paths := writePacks(t, `{
+  "discovery": [
+    "SELECT pid FROM processes WHERE name = 'ossec-agentd';",
+    "SELECT 1 FROM os_version WHERE platform = 'ubuntu';"
+  ],
+  "queries": {
+    "ossec_rootkits": {"query": "SELECT * FROM ossec_rootkits;", "interval": "3600", "platform": "linux"}
+  }
+}`)
+	c := Config{MaxInterval: 24 * time.Hour, DefaultInterval: time.Hour}
+	dir := t.TempDir()
+
+	applied := filepath.Join(dir, "applied.conf")
+	if err := Apply(paths, applied, c); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	p, err := query.LoadPack(applied)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if diff := cmp.Diff(discovery, p.Discovery); diff != "" {
+		t.Errorf("Apply() discovery mismatch (-want +got):\n%s", diff)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := os.Mkdir(unpacked, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := Unpack([]string{applied}, unpacked, c); err != nil {
+		t.Fatalf("Unpack() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(unpacked, "discovery", "001.sql")); err != nil {
+		t.Errorf("Unpack() did not write discovery queries: %v", err)
+	}
+
+	packed := filepath.Join(dir, "packed.conf")
+	if err := Pack([]string{unpacked}, packed, c); err != nil {
+		t.Fatalf("Pack() = %v", err)
+	}
+	p, err = query.LoadPack(packed)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if diff := cmp.Diff(discovery, p.Discovery); diff != "" {
+		t.Errorf("Pack() discovery mismatch (-want +got):\n%s", diff)
+	}
+	if len(p.Queries) != 1 || p.Queries["ossec_rootkits"] == nil {
+		t.Errorf("Pack() queries = %v, want only ossec_rootkits", p.Queries)
+	}
+}
+
+func TestLoadPath(t *testing.T) {
+	pack := `{
+  "queries": {
+    "users": {
+      "query": "SELECT * FROM users;",
+      "interval": "3600"
+    }
+  }
+}`
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{name: "pack.json", content: pack, want: []string{"users"}},
+		{name: "pack.conf", content: pack, want: []string{"users"}},
+		{name: "pack", content: pack, want: []string{"users"}},
+		{name: "processes.sql", content: "SELECT * FROM processes;", want: []string{"processes"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.name)
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			mm, err := loadPath(path, Config{})
+			if err != nil {
+				t.Fatalf("loadPath(%s) = %v", tc.name, err)
+			}
+			got := []string{}
+			for name := range mm {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("loadPath(%s) queries mismatch (-want +got):\n%s", tc.name, diff)
+			}
+		})
+	}
+}
+
+func TestParseSplay(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "10%", want: 0.1},
+		{in: "25", want: 0.25},
+		{in: "0%", want: 0},
+		{in: "-5%", wantErr: true},
+		{in: "100%", wantErr: true},
+		{in: "lots", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseSplay(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseSplay(%q) error = %v, want error: %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseSplay(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParsePlatformSuffixes(t *testing.T) {
+	got, err := parsePlatformSuffixes("mac=darwin, bsd = freebsd")
+	if err != nil {
+		t.Fatalf("parsePlatformSuffixes() = %v", err)
+	}
+	if diff := cmp.Diff(map[string]string{"mac": "darwin", "bsd": "freebsd"}, got); diff != "" {
+		t.Errorf("parsePlatformSuffixes() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, bad := range []string{"mac", "=darwin", "mac="} {
+		if _, err := parsePlatformSuffixes(bad); err == nil {
+			t.Errorf("parsePlatformSuffixes(%q) = nil error, want error", bad)
+		}
+	}
+}
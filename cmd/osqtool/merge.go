@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// Policies for resolving queries of the same name when merging packs.
+const (
+	conflictError    = "error"
+	conflictSkip     = "skip"
+	conflictLastWins = "last-wins"
+	conflictRename   = "rename"
+)
+
+// mergeConflict records how a query name loaded from more than one source was resolved.
+type mergeConflict struct {
+	Name       string
+	Source     string
+	Resolution string
+}
+
+// mergeReport describes where the queries of a merged pack came from.
+type mergeReport struct {
+	Sources   []string
+	Counts    map[string]int
+	Conflicts []mergeConflict
+}
+
+// sourceSuffix returns the suffix used to rename a conflicting query from a source, such as "extra" for "/tmp/extra.conf".
+func sourceSuffix(path string) string {
+	base := filepath.Base(filepath.Clean(path))
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// mergeQueries loads the queries from each path, resolving name conflicts according to --on-conflict.
+func mergeQueries(paths []string, c Config) (map[string]*query.Metadata, *mergeReport, error) {
+	policy := c.OnConflict
+	switch policy {
+	case conflictError, conflictSkip, conflictLastWins, conflictRename:
+	default:
+		return nil, nil, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+
+	mm := map[string]*query.Metadata{}
+	origin := map[string]string{}
+	r := &mergeReport{Sources: paths, Counts: map[string]int{}}
+
+	for _, path := range paths {
+		loaded, err := loadPath(path, c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names := []string{}
+		for name := range loaded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			m := loaded[name]
+			prev, exists := origin[name]
+			if !exists {
+				mm[name] = m
+				origin[name] = path
+				continue
+			}
+
+			switch policy {
+			case conflictError:
+				return nil, nil, fmt.Errorf("conflict: %q from %s was already loaded from %s", name, path, prev)
+			case conflictSkip:
+				r.Conflicts = append(r.Conflicts, mergeConflict{Name: name, Source: path, Resolution: "skipped, keeping " + prev})
+			case conflictLastWins:
+				mm[name] = m
+				origin[name] = path
+				r.Conflicts = append(r.Conflicts, mergeConflict{Name: name, Source: path, Resolution: "replaced " + prev})
+			case conflictRename:
+				renamed := name + "-" + sourceSuffix(path)
+				if _, taken := origin[renamed]; taken {
+					return nil, nil, fmt.Errorf("conflict: %q from %s can not be renamed to %q, which is already loaded", name, path, renamed)
+				}
+				m.Name = renamed
+				mm[renamed] = m
+				origin[renamed] = path
+				r.Conflicts = append(r.Conflicts, mergeConflict{Name: name, Source: path, Resolution: "renamed to " + renamed})
+			}
+		}
+	}
+
+	for _, path := range origin {
+		r.Counts[path]++
+	}
+	return mm, r, nil
+}
+
+// writeMergeSummary writes how many queries came from each source, and how conflicts were resolved.
+func writeMergeSummary(w io.Writer, r *mergeReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tQUERIES")
+	for _, s := range r.Sources {
+		fmt.Fprintf(tw, "%s\t%d\n", s, r.Counts[s])
+	}
+	if len(r.Conflicts) > 0 {
+		fmt.Fprintln(tw, "")
+		fmt.Fprintln(tw, "CONFLICT\tSOURCE\tRESOLUTION")
+		for _, mc := range r.Conflicts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", mc.Name, mc.Source, mc.Resolution)
+		}
+	}
+	return tw.Flush()
+}
+
+// Merge combines the queries of several packs or directories into a single pack, resolving
+// name conflicts according to --on-conflict, and writing a summary of the sources to w.
+func Merge(paths []string, output string, w io.Writer, c Config) error {
+	mm, r, err := mergeQueries(paths, c)
+	if err != nil {
+		return err
+	}
+
+	if err := writeMergeSummary(w, r); err != nil {
+		return fmt.Errorf("summary: %w", err)
+	}
+
+	if err := applyConfig(mm, c, nil, nil); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+
+	klog.Infof("Merging %d queries from %d sources into %s ...", len(mm), len(paths), output)
+	bs, err := query.RenderPack(&query.Pack{Queries: mm}, c.renderConfig())
+	if err != nil {
+		return fmt.Errorf("render: %v", err)
+	}
+
+	if output == "" {
+		_, err = fmt.Println(string(bs))
+		return err
+	}
+	return os.WriteFile(output, bs, 0o600)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeQueries(t *testing.T) {
+	paths := writePacks(t,
+		`{"queries": {
+  "users": {"query": "SELECT uid FROM users;", "interval": "3600"},
+  "uptime": {"query": "SELECT total_seconds FROM uptime;", "interval": "60"}
+}}`,
+		`{"queries": {
+  "users": {"query": "SELECT uid, username FROM users;", "interval": "600"},
+  "groups": {"query": "SELECT gid FROM groups;", "interval": "3600"}
+}}`)
+
+	tests := []struct {
+		policy     string
+		wantNames  []string
+		wantUsers  string
+		wantCounts []int
+		wantErr    bool
+	}{
+		{policy: conflictError, wantErr: true},
+		{policy: "coin-toss", wantErr: true},
+		{policy: conflictSkip, wantNames: []string{"groups", "uptime", "users"}, wantUsers: "SELECT uid FROM users;", wantCounts: []int{2, 1}},
+		{policy: conflictLastWins, wantNames: []string{"groups", "uptime", "users"}, wantUsers: "SELECT uid, username FROM users;", wantCounts: []int{1, 2}},
+		{policy: conflictRename, wantNames: []string{"groups", "uptime", "users", "users-b"}, wantUsers: "SELECT uid FROM users;", wantCounts: []int{2, 2}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			mm, r, err := mergeQueries(paths, Config{OnConflict: tc.policy})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("mergeQueries() = nil error, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeQueries() = %v", err)
+			}
+
+			names := []string{}
+			for name := range mm {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if diff := cmp.Diff(tc.wantNames, names); diff != "" {
+				t.Errorf("names mismatch (-want +got):\n%s", diff)
+			}
+			if got := mm["users"].Query; got != tc.wantUsers {
+				t.Errorf("users query = %q, want %q", got, tc.wantUsers)
+			}
+
+			counts := []int{r.Counts[paths[0]], r.Counts[paths[1]]}
+			if diff := cmp.Diff(tc.wantCounts, counts); diff != "" {
+				t.Errorf("counts mismatch (-want +got):\n%s", diff)
+			}
+			if len(r.Conflicts) != 1 {
+				t.Errorf("conflicts = %v, want 1", r.Conflicts)
+			}
+		})
+	}
+}
+
+func TestMergeSummary(t *testing.T) {
+	paths := writePacks(t,
+		`{"queries": {"users": {"query": "SELECT uid FROM users;", "interval": "3600"}}}`,
+		`{"queries": {"users": {"query": "SELECT uid FROM users;", "interval": "600"}}}`)
+
+	var sb strings.Builder
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, OnConflict: conflictRename}
+	if err := Merge(paths, t.TempDir()+"/merged.conf", &sb, c); err != nil {
+		t.Fatalf("Merge() = %v", err)
+	}
+
+	for _, want := range []string{paths[0] + "  1", paths[1] + "  1", "users     " + paths[1] + "  renamed to users-b"} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, sb.String())
+		}
+	}
+}
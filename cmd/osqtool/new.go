@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// newQueryTemplate is the skeleton written by new, with directive stubs for the author to fill in.
+const newQueryTemplate = `-- description: TODO: describe what this query finds
+-- interval:%s
+-- platform:%s
+-- tags:
+SELECT
+  *
+FROM
+  osquery_info;
+`
+
+// prefill returns a directive value for newQueryTemplate, preceded by a space if it is not empty.
+func prefill(v string) string {
+	if v == "" {
+		return ""
+	}
+	return " " + v
+}
+
+// New writes a SQL file for a new query from a template, prefilled with --platform and --interval.
+// An existing file is only overwritten if force is set.
+func New(name string, platform string, interval string, force bool, c Config) error {
+	path := name
+	if !strings.HasSuffix(path, ".sql") {
+		path += ".sql"
+	}
+
+	content := fmt.Sprintf(newQueryTemplate, prefill(interval), prefill(platform))
+
+	// Make sure the skeleton is one that Parse understands before writing it
+	if _, err := query.ParseWithConfig(strings.TrimSuffix(filepath.Base(path), ".sql"), []byte(content), c.parseConfig()); err != nil {
+		return fmt.Errorf("parse template: %w", err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists (use --force to overwrite)", path)
+		}
+		return err
+	}
+	defer f.Close()
+
+	klog.Infof("Writing %s ...", path)
+	if _, err := f.WriteString(content); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNew(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "unsigned-kexts")
+	if err := New(name, "macos", "1h", false, Config{}); err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	m, err := query.Load(name + ".sql")
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	got := []string{m.Name, m.Description, m.Interval, strings.Join(m.Platforms(), ","), strings.Join(m.Tags, " ")}
+	want := []string{"unsigned-kexts", "TODO: describe what this query finds", "3600", "darwin", ""}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parsed template mismatch (-want +got):\n%s", diff)
+	}
+
+	err = New(name+".sql", "", "", false, Config{})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("New(existing) = %v, want already exists error", err)
+	}
+
+	if err := New(name, "", "", true, Config{}); err != nil {
+		t.Fatalf("New(existing, force) = %v", err)
+	}
+	bs, err := os.ReadFile(name + ".sql")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(bs), "-- interval:\n-- platform:\n") {
+		t.Errorf("forced template = %q, want empty stubs", bs)
+	}
+
+	if err := New(filepath.Join(t.TempDir(), "bad"), "", "1.5s", false, Config{}); err == nil {
+		t.Errorf("New(--interval=1.5s) = nil, want error")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+)
+
+// runFunc runs a query, such as query.RunContext or (*query.Session).RunContext.
+type runFunc func(ctx context.Context, m *query.Metadata) (*query.RunResult, error)
+
+// runQuery runs a query using the configured runner, defaulting to a new osqueryi process per query.
+// The query is abandoned if it takes longer than --query-timeout.
+func (c Config) runQuery(m *query.Metadata) (*query.RunResult, error) {
+	return c.runQueryContext(context.Background(), m)
+}
+
+// runQueryContext is like runQuery, but the query is also abandoned if ctx is done first.
+func (c Config) runQueryContext(ctx context.Context, m *query.Metadata) (*query.RunResult, error) {
+	if c.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.QueryTimeout)
+		defer cancel()
+	}
+
+	if c.run != nil {
+		return c.run(ctx, m)
+	}
+	return query.RunContext(ctx, m, c.runConfig())
+}
+
+// sessionPool shares up to size long-lived osqueryi sessions between concurrent workers.
+type sessionPool struct {
+	config   *query.RunConfig
+	mu       sync.Mutex
+	idle     chan *query.Session
+	sessions []*query.Session
+}
+
+func newSessionPool(size int, c *query.RunConfig) *sessionPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &sessionPool{config: c, idle: make(chan *query.Session, size)}
+	for i := 0; i < size; i++ {
+		p.idle <- nil
+	}
+	return p
+}
+
+// Run runs a query within an idle session, starting a new session if necessary.
+func (p *sessionPool) Run(ctx context.Context, m *query.Metadata) (*query.RunResult, error) {
+	var s *query.Session
+	select {
+	case s = <-p.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { p.idle <- s }()
+
+	if s == nil {
+		var err error
+		s, err = query.NewSession(p.config)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.sessions = append(p.sessions, s)
+		p.mu.Unlock()
+	}
+	return s.RunContext(ctx, m)
+}
+
+// Close stops all of the sessions started by the pool.
+func (p *sessionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		s.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// Split writes one pack per platform into the output directory, named after the source pack and platform,
+// such as "pack-linux.conf". Posix queries are written to a posix pack unless --expand-posix is set.
+func Split(path string, output string, c Config) error {
+	if output == "" {
+		output = "."
+	}
+
+	p, err := query.LoadPackWithConfig(path, c.parseConfig())
+	if err != nil {
+		return fmt.Errorf("load pack %s: %v", path, err)
+	}
+
+	if err := applyConfig(p.Queries, c, nil, nil); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+
+	if err := os.MkdirAll(output, 0o755); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+
+	prefix := "pack"
+	if path != "-" {
+		prefix = sourceSuffix(path)
+	}
+
+	packs := query.SplitPack(p, c.ExpandPosix)
+	platforms := []string{}
+	for platform := range packs {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	for _, platform := range platforms {
+		bs, err := query.RenderPack(packs[platform], c.renderConfig())
+		if err != nil {
+			return fmt.Errorf("render %s: %v", platform, err)
+		}
+
+		dest := filepath.Join(output, fmt.Sprintf("%s-%s.conf", prefix, platform))
+		klog.Infof("Writing %d %s queries to %s ...", len(packs[platform].Queries), platform, dest)
+		if err := os.WriteFile(dest, bs, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
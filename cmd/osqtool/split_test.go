@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplit(t *testing.T) {
+	paths := writePacks(t, `{"oncall": "secops", "queries": {
+  "users": {"query": "SELECT uid FROM users;", "interval": "3600"},
+  "shells": {"query": "SELECT pid FROM processes;", "interval": "3600", "platform": "posix"},
+  "services": {"query": "SELECT name FROM services;", "interval": "3600", "platform": "windows"}
+}}`)
+	output := t.TempDir()
+
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, ExpandPosix: true}
+	if err := Split(paths[0], output, c); err != nil {
+		t.Fatalf("Split() = %v", err)
+	}
+
+	entries, err := os.ReadDir(output)
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	files := []string{}
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	sort.Strings(files)
+	want := []string{"a-any.conf", "a-darwin.conf", "a-linux.conf", "a-windows.conf"}
+	if diff := cmp.Diff(want, files); diff != "" {
+		t.Errorf("files mismatch (-want +got):\n%s", diff)
+	}
+
+	p, err := query.LoadPack(filepath.Join(output, "a-linux.conf"))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if p.Oncall != "secops" {
+		t.Errorf("oncall = %q, want secops", p.Oncall)
+	}
+	if p.Queries["shells"] == nil || len(p.Queries) != 1 {
+		t.Errorf("linux queries = %v, want only shells", p.Queries)
+	}
+}
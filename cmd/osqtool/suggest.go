@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"k8s.io/klog/v2"
+)
+
+// suggestInterval returns the shortest interval in seconds that keeps the daily cost of a query
+// taking elapsed time per run within budget, bounded by the min and max intervals.
+func suggestInterval(elapsed time.Duration, budget time.Duration, minSeconds int, maxSeconds int) int {
+	interval := minSeconds
+	if budget > 0 {
+		// dailyQueryDuration inverted: (86400 / interval) * elapsed <= budget
+		interval = int(math.Ceil(86400 * elapsed.Seconds() / budget.Seconds()))
+	}
+
+	if interval < minSeconds {
+		interval = minSeconds
+	}
+	if maxSeconds > 0 && interval > maxSeconds {
+		interval = maxSeconds
+	}
+	if interval < 1 {
+		interval = 1
+	}
+	return interval
+}
+
+// SuggestIntervals runs each query and suggests an interval that fits within the per-query daily budget.
+func SuggestIntervals(paths []string, w io.Writer, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+
+	budget := c.PerQueryDailyBudget
+	if budget == 0 {
+		budget = c.maxQueryDurationPerDay
+	}
+	minSeconds := int(c.MinInterval.Seconds())
+	maxSeconds := int(c.MaxInterval.Seconds())
+
+	names := []string{}
+	for name := range mm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := []error{}
+	for _, name := range names {
+		m := mm[name]
+		if cw := query.IsIncompatible(m); cw != "" {
+			klog.Infof("skipping incompatible query: %s (%s)", name, cw)
+			continue
+		}
+
+		vf, err := c.runQuery(m)
+		if err != nil {
+			klog.Errorf("%q failed: %v", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		interval := suggestInterval(vf.Elapsed, budget, minSeconds, maxSeconds)
+		fmt.Fprintf(w, "%s: -- interval: %d (took %s, currently %s)\n", name, interval, vf.Elapsed.Round(time.Millisecond), formatInterval(m.Interval, c.HumanIntervals))
+	}
+
+	return errors.Join(errs...)
+}
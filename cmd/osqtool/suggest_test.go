@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuggestInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		budget  time.Duration
+		want    int
+	}{
+		{name: "one second within an hour", elapsed: time.Second, budget: time.Hour, want: 24},
+		{name: "fractional rounds up", elapsed: 250 * time.Millisecond, budget: 7 * time.Minute, want: 52},
+		{name: "fast query hits min", elapsed: time.Millisecond, budget: time.Hour, want: 20},
+		{name: "slow query hits max", elapsed: time.Hour, budget: time.Minute, want: 86400},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := suggestInterval(tc.elapsed, tc.budget, 20, 86400); got != tc.want {
+				t.Errorf("suggestInterval(%s, %s) = %d, want %d", tc.elapsed, tc.budget, got, tc.want)
+			}
+		})
+	}
+}
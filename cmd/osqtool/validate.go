@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/chainguard-dev/osqtool/pkg/schema"
+	"k8s.io/klog/v2"
+)
+
+// loadSchema loads the bundled osquery schema, or the snapshot for --osquery-version, merged with any extra schema.
+func loadSchema(c Config) (*schema.Schema, error) {
+	var s *schema.Schema
+	var err error
+
+	switch {
+	case c.OsqueryVersion == "":
+		s, err = schema.Default()
+		if err != nil {
+			return nil, fmt.Errorf("default schema: %w", err)
+		}
+	case c.SchemaDir == "":
+		return nil, fmt.Errorf("--osquery-version requires --schema-dir, as osqtool does not bundle per-version schema snapshots")
+	default:
+		s, err = schema.LoadVersion(c.SchemaDir, c.OsqueryVersion)
+		if err != nil {
+			return nil, fmt.Errorf("schema for osquery %s: %w", c.OsqueryVersion, err)
+		}
+	}
+
+	if c.ExtraSchema != "" {
+		extra, err := schema.LoadFile(c.ExtraSchema)
+		if err != nil {
+			return nil, fmt.Errorf("extra schema: %w", err)
+		}
+		klog.Infof("Merging %d tables from %s", len(extra.Tables), c.ExtraSchema)
+		s.Merge(extra)
+	}
+	return s, nil
+}
+
+// validateQueries checks the queries against a schema without running them, optionally checking column references.
+// If allowUnknown is set, unknown tables are logged as warnings, rather than errors.
+func validateQueries(mm map[string]*query.Metadata, s *schema.Schema, columns bool, allowUnknown bool) error {
+	names := []string{}
+	for name := range mm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := []error{}
+	for _, name := range names {
+		unknown := s.UnknownTables(mm[name].Query)
+		switch {
+		case len(unknown) == 0:
+		case allowUnknown:
+			klog.Warningf("%q references unknown tables: %s", name, strings.Join(unknown, ", "))
+		case s.Partial:
+			// A partial schema can not tell a missing table apart from one it does not list
+			klog.Errorf("%q references tables not in the bundled list of common tables: %s", name, strings.Join(unknown, ", "))
+			errs = append(errs, fmt.Errorf("%s: unknown tables: %s (use --allow-unknown-tables if they exist, or --osquery-version for a complete schema)", name, strings.Join(unknown, ", ")))
+		default:
+			klog.Errorf("%q references unknown tables: %s", name, strings.Join(unknown, ", "))
+			errs = append(errs, fmt.Errorf("%s: unknown tables: %s", name, strings.Join(unknown, ", ")))
+		}
+		if !columns {
+			continue
+		}
+		if unknown := s.UnknownColumns(mm[name].Query); len(unknown) > 0 {
+			klog.Errorf("%q references unknown columns: %s", name, strings.Join(unknown, ", "))
+			errs = append(errs, fmt.Errorf("%s: unknown columns: %s", name, strings.Join(unknown, ", ")))
+		}
+	}
+
+	klog.Infof("%d queries validated offline: %d errored", len(mm), len(errs))
+	return errors.Join(errs...)
+}
+
+// Validate checks the queries within a directory or pack against the osquery schema, without osqueryi.
+func Validate(paths []string, c Config) error {
+	mm, err := loadAndApply(paths, c)
+	if err != nil {
+		return err
+	}
+
+	s, err := loadSchema(c)
+	if err != nil {
+		return err
+	}
+
+	// The bundled schema is not tied to a version, so columns are only checked against a versioned snapshot
+	return validateQueries(mm, s, c.OsqueryVersion != "", c.AllowUnknownTables)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateOsqueryVersion(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"cgroups.sql": "SELECT pid, cgroup_path FROM processes;",
+	})
+	c := Config{
+		DefaultInterval: time.Hour,
+		MaxInterval:     24 * time.Hour,
+		SchemaDir:       "../../pkg/schema/testdata/versions",
+	}
+
+	c.OsqueryVersion = "5.10.0"
+	if err := Validate([]string{dir}, c); err != nil {
+		t.Errorf("Validate() for 5.10.0 = %v, want nil", err)
+	}
+
+	c.OsqueryVersion = "5.9.0"
+	err := Validate([]string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "unknown columns: processes.cgroup_path") {
+		t.Errorf("Validate() for 5.9.0 = %v, want unknown column error", err)
+	}
+}
+
+func TestValidatePartialSchema(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"usb.sql":   "SELECT * FROM usb_devices;",
+		"users.sql": "SELECT username FROM users;",
+	})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+
+	// usb_devices exists in osquery, but is not within the bundled list of common tables
+	err := Validate([]string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "unknown tables: usb_devices") {
+		t.Errorf("Validate() with the bundled schema = %v, want unknown table error", err)
+	}
+
+	c.AllowUnknownTables = true
+	if err := Validate([]string{dir}, c); err != nil {
+		t.Errorf("Validate() with --allow-unknown-tables = %v, want nil", err)
+	}
+
+	c.AllowUnknownTables = false
+	c.SchemaDir = "../../pkg/schema/testdata/versions"
+	c.OsqueryVersion = "5.10.0"
+	err = Validate([]string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "unknown tables: usb_devices") {
+		t.Errorf("Validate() for 5.10.0 = %v, want unknown table error", err)
+	}
+}
+
+func TestValidateExtraSchema(t *testing.T) {
+	dir := writeQueries(t, map[string]string{"agents.sql": "SELECT id, status FROM acme_agents;"})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+
+	err := Validate([]string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "unknown tables: acme_agents") {
+		t.Errorf("Validate() without --extra-schema = %v, want unknown table error", err)
+	}
+
+	c.ExtraSchema = "../../pkg/schema/testdata/extension.json"
+	if err := Validate([]string{dir}, c); err != nil {
+		t.Errorf("Validate() with --extra-schema = %v, want nil", err)
+	}
+}
+
+func TestValidateMisspelledTable(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"typo.sql":  "SELECT pid FROM proceses;",
+		"shell.sql": "WITH shells(name) AS (SELECT 'bash') SELECT p.pid FROM processes p JOIN shells s ON p.name = s.name;",
+	})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour}
+
+	err := Validate([]string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "typo: unknown tables: proceses") {
+		t.Errorf("Validate() = %v, want unknown table error for proceses", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "shells") {
+		t.Errorf("Validate() = %v, want common table expressions to be ignored", err)
+	}
+}
+
+func TestValidateOsqueryVersionWithoutSchemaDir(t *testing.T) {
+	dir := writeQueries(t, map[string]string{"users.sql": "SELECT username FROM users;"})
+	c := Config{DefaultInterval: time.Hour, MaxInterval: 24 * time.Hour, OsqueryVersion: "5.10.0"}
+
+	err := Validate([]string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "--osquery-version requires --schema-dir") {
+		t.Errorf("Validate() = %v, want error asking for --schema-dir", err)
+	}
+}
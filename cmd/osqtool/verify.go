@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/fatih/semgroup"
+	"k8s.io/klog/v2"
+)
+
+// verifyTotals are the totals accumulated across all verified queries.
+type verifyTotals struct {
+	verified, partial, errored uint64
+	// interrupted counts queries abandoned mid-run because verification was cancelled
+	interrupted   uint64
+	queryDuration int64
+	runs          int64
+
+	mu            sync.Mutex
+	missingTables map[string]int
+}
+
+// addMissingTable records a query that failed because it references a missing table.
+func (t *verifyTotals) addMissingTable(table string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.missingTables == nil {
+		t.missingTables = map[string]int{}
+	}
+	t.missingTables[table]++
+}
+
+// missingTableSummary describes how many queries reference each missing table, most referenced first.
+func missingTableSummary(counts map[string]int) []string {
+	tables := []string{}
+	for t := range counts {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if counts[tables[i]] != counts[tables[j]] {
+			return counts[tables[i]] > counts[tables[j]]
+		}
+		return tables[i] < tables[j]
+	})
+
+	lines := []string{}
+	for _, t := range tables {
+		if counts[t] == 1 {
+			lines = append(lines, fmt.Sprintf("1 query references missing table `%s`", t))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%d queries reference missing table `%s`", counts[t], t))
+	}
+	return lines
+}
+
+// progressLine is a JSON line describing a completed query.
+type progressLine struct {
+	Query     string `json:"query"`
+	Status    string `json:"status"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+	Rows      int    `json:"rows"`
+	Error     string `json:"error,omitempty"`
+}
+
+// progressWriter emits a JSON line per completed query, safe for concurrent use.
+type progressWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (p *progressWriter) emit(name string, status string, vf *query.RunResult, err error) {
+	l := progressLine{Query: name, Status: status}
+	if vf != nil {
+		l.ElapsedMS = vf.Elapsed.Milliseconds()
+		l.Rows = len(vf.Rows)
+	}
+	if err != nil {
+		l.Error = err.Error()
+	}
+
+	bs, merr := json.Marshal(l)
+	if merr != nil {
+		klog.Errorf("marshal progress: %v", merr)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, werr := fmt.Fprintf(p.w, "%s\n", bs); werr != nil {
+		klog.Errorf("write progress: %v", werr)
+	}
+}
+
+// summaryReport collects verify results for --summary, safe for concurrent use.
+type summaryReport struct {
+	mu sync.Mutex
+	s  query.VerifySummary
+}
+
+func (r *summaryReport) add(name string, status string, vf *query.RunResult, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Add(query.NewVerifyResult(name, status, vf, err))
+}
+
+// write writes the summary to path as JSON, along with the daily totals.
+func (r *summaryReport) write(path string, duration time.Duration, runs int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.s.SetTotals(duration, runs)
+	bs, err := r.s.Render()
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return os.WriteFile(path, append(bs, '\n'), 0o600)
+}
+
+// dailyQueryDuration returns what the total duration for a query would be for a day.
+func dailyQueryDuration(interval string, d time.Duration) (time.Duration, int, error) {
+	i, err := strconv.Atoi(interval)
+	if err != nil {
+		return time.Duration(0), 0, err
+	}
+
+	runs := 86400 / i
+	return time.Duration(runs) * d, runs, nil
+}
+
+// formatInterval renders an interval in seconds for logging, as a duration such as "1h0m0s" when human is set.
+func formatInterval(interval string, human bool) string {
+	if !human {
+		return interval
+	}
+	i, err := strconv.Atoi(interval)
+	if err != nil {
+		return interval
+	}
+	return (time.Duration(i) * time.Second).String()
+}
+
+// expectedResults returns the fewest rows a query should return: its min_results directive, or --min-results.
+func expectedResults(m *query.Metadata, c Config) int {
+	if m.MinResults > 0 {
+		return m.MinResults
+	}
+	return c.MinResults
+}
+
+// checkResultsPerHour returns an error if the projected number of rows emitted per hour exceeds limit.
+func checkResultsPerHour(interval string, rows int, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	_, runsPerDay, err := dailyQueryDuration(interval, 0)
+	if err != nil {
+		return err
+	}
+
+	perHour := rows * runsPerDay / 24
+	if perHour > limit {
+		return fmt.Errorf("%d results per hour (%d rows * %d runs/day) exceeds --max-results-per-hour=%d", perHour, rows, runsPerDay, limit)
+	}
+	return nil
+}
+
+// checkIntervalUtilization returns an error if a single run of a query takes more than the limit
+// fraction of its interval, in which case osquery may never keep up with its schedule.
+func checkIntervalUtilization(interval string, elapsed time.Duration, limit float64) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	i, err := strconv.Atoi(interval)
+	if err != nil {
+		return err
+	}
+	if i <= 0 {
+		return nil
+	}
+
+	ratio := elapsed.Seconds() / float64(i)
+	if ratio > limit {
+		return fmt.Errorf("%s runtime is %.2fx its %ds interval, exceeding --max-interval-utilization=%.2f", elapsed.Round(time.Millisecond), ratio, i, limit)
+	}
+	return nil
+}
+
+// retryable returns true if a query failure may be transient, rather than a missing table, a timeout, or an interruption.
+func retryable(err error) bool {
+	return !strings.Contains(err.Error(), "no such table") && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled)
+}
+
+// runWithRetries runs a query, retrying transient failures up to --retries times with an exponential backoff.
+// Only the final attempt is returned, so failed attempts do not count toward the daily duration budget.
+func runWithRetries(ctx context.Context, m *query.Metadata, c Config) (*query.RunResult, error) {
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		vf, err := c.runQueryContext(ctx, m)
+		if err == nil || attempt >= c.Retries || !retryable(err) {
+			return vf, err
+		}
+
+		klog.Warningf("%q failed (attempt %d of %d), retrying in %s: %v", m.Name, attempt+1, c.Retries+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// verifyQuery runs a single query and checks it against the configured limits.
+func verifyQuery(ctx context.Context, m *query.Metadata, c Config, totals *verifyTotals) (*query.RunResult, error) {
+	name := m.Name
+	klog.Infof("Verifying: %q ", name)
+	if c.PrintQuery {
+		logQuery(m)
+	}
+
+	vf, verr := runWithRetries(ctx, m, c)
+	if verr != nil {
+		klog.Errorf("%q failed validation: %v", name, verr)
+		return nil, fmt.Errorf("%s: %w", name, verr)
+	}
+
+	for _, w := range vf.Warnings {
+		klog.Warningf("%q: osqueryi warning: %s", name, w)
+	}
+
+	// Short-circuit out of remaining tests if the query is not compatible with the local platform
+	if vf.IncompatiblePlatform != "" {
+		return vf, nil
+	}
+
+	cols := vf.Columns()
+	klog.V(1).Infof("%q returned %d columns: %s", name, len(cols), strings.Join(cols, ", "))
+
+	if vf.Elapsed > c.maxQueryDuration {
+		return vf, fmt.Errorf("%q: %s exceeds --max-query-duration=%s", name, vf.Elapsed.Round(time.Millisecond), c.maxQueryDuration)
+	}
+
+	queryDurationPerDay, runsPerDay, err := dailyQueryDuration(m.Interval, vf.Elapsed)
+	if err != nil {
+		return vf, fmt.Errorf("%q: failed to parse interval: %v", name, err)
+	}
+
+	atomic.AddInt64(&totals.queryDuration, int64(queryDurationPerDay))
+	atomic.AddInt64(&totals.runs, int64(runsPerDay))
+
+	if queryDurationPerDay > c.maxQueryDurationPerDay {
+		return vf, fmt.Errorf("%q: %s exceeds --max-daily-query-duration=%s (%d runs * %s)", name, queryDurationPerDay.Round(time.Second), c.maxQueryDurationPerDay, runsPerDay, vf.Elapsed.Round(time.Millisecond))
+	}
+
+	if err := checkIntervalUtilization(m.Interval, vf.Elapsed, c.MaxIntervalUtilization); err != nil {
+		if !c.WarnIntervalUtilization {
+			return vf, fmt.Errorf("%q: %w", name, err)
+		}
+		klog.Warningf("%q: %v", name, err)
+	}
+
+	if c.MaxResults > 0 && len(vf.Rows) > c.MaxResults {
+		shortResult := []string{}
+		for _, r := range vf.Rows {
+			shortResult = append(shortResult, r.String())
+		}
+		if len(shortResult) >= 10 {
+			shortResult = shortResult[0:10]
+			shortResult = append(shortResult, "...")
+		}
+
+		return vf, fmt.Errorf("%q: %d results exceeds --max-results=%d:\n  %s", name, len(vf.Rows), c.MaxResults, strings.Join(shortResult, "\n  "))
+	}
+
+	if c.MaxColumns > 0 && len(cols) > c.MaxColumns {
+		return vf, fmt.Errorf("%q: %d columns exceeds --max-columns=%d: %s", name, len(cols), c.MaxColumns, strings.Join(cols, ", "))
+	}
+
+	if minResults := expectedResults(m, c); len(vf.Rows) < minResults {
+		return vf, fmt.Errorf("%q: %d results is fewer than the minimum of %d", name, len(vf.Rows), minResults)
+	}
+
+	if err := checkResultsPerHour(m.Interval, len(vf.Rows), c.MaxResultsPerHour); err != nil {
+		return vf, fmt.Errorf("%q: %w", name, err)
+	}
+
+	klog.Infof("%q returned %d rows in %s, daily cost for interval %s (%d runs): %s", name, len(vf.Rows), vf.Elapsed.Round(time.Millisecond), formatInterval(m.Interval, c.HumanIntervals), runsPerDay, queryDurationPerDay.Round(time.Second))
+	return vf, nil
+}
+
+// queryValue returns the value of a query as a numeric score, if it is one.
+func queryValue(m *query.Metadata) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(m.Value), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// verifyOrder returns the order in which to verify queries: by name, or by descending value
+// when byValue is set, with queries lacking a numeric value last.
+func verifyOrder(mm map[string]*query.Metadata, byValue bool) []string {
+	names := []string{}
+	for name := range mm {
+		names = append(names, name)
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		if byValue {
+			vi, iok := queryValue(mm[names[i]])
+			vj, jok := queryValue(mm[names[j]])
+			if iok != jok {
+				return iok
+			}
+			if vi != vj {
+				return vi > vj
+			}
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// valueSummary describes the distribution of numeric query values, and the top highest-value queries.
+func valueSummary(mm map[string]*query.Metadata, top int) []string {
+	counts := map[float64]int{}
+	scored := 0
+	for _, m := range mm {
+		if v, ok := queryValue(m); ok {
+			counts[v]++
+			scored++
+		}
+	}
+	if scored == 0 {
+		return nil
+	}
+
+	values := []float64{}
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(values)))
+
+	dist := []string{}
+	for _, v := range values {
+		dist = append(dist, fmt.Sprintf("%s=%d", strconv.FormatFloat(v, 'f', -1, 64), counts[v]))
+	}
+
+	lines := []string{fmt.Sprintf("value distribution (%d of %d queries scored): %s", scored, len(mm), strings.Join(dist, " "))}
+
+	highest := []string{}
+	for _, name := range verifyOrder(mm, true) {
+		if len(highest) == top {
+			break
+		}
+		if _, ok := queryValue(mm[name]); ok {
+			highest = append(highest, fmt.Sprintf("%s (%s)", name, mm[name].Value))
+		}
+	}
+	return append(lines, fmt.Sprintf("highest value queries: %s", strings.Join(highest, ", ")))
+}
+
+// Verify verifies the queries within a directory or pack. If ctx is cancelled, running queries are killed,
+// no further queries are started, and a summary of the queries that completed is logged.
+func Verify(ctx context.Context, path []string, c Config) error {
+	mm, err := loadAndApply(path, c)
+	if err != nil {
+		return err
+	}
+
+	var progress *progressWriter
+	switch c.JSONLinesProgress {
+	case "":
+	case "-":
+		progress = &progressWriter{w: os.Stdout}
+	default:
+		f, err := os.OpenFile(c.JSONLinesProgress, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return fmt.Errorf("unable to open progress output: %w", err)
+		}
+		defer f.Close()
+		progress = &progressWriter{w: f}
+	}
+
+	if c.ReuseOsqueryi {
+		pool := newSessionPool(c.Workers, c.runConfig())
+		defer pool.Close()
+		c.run = pool.Run
+	}
+
+	var junit *junitReport
+	if c.JUnit != "" {
+		junit = &junitReport{}
+	}
+
+	var summary *summaryReport
+	if c.Summary != "" {
+		summary = &summaryReport{}
+	}
+
+	start := time.Now()
+	totals := &verifyTotals{}
+	sg := semgroup.NewGroup(ctx, int64(c.Workers))
+
+	for _, name := range verifyOrder(mm, c.SortByValue) {
+		if ctx.Err() != nil {
+			break
+		}
+		m := mm[name]
+		name := name
+
+		sg.Go(func() error {
+			vf, err := verifyQuery(ctx, m, c, totals)
+			if err != nil && ctx.Err() != nil {
+				atomic.AddUint64(&totals.interrupted, 1)
+				return nil
+			}
+
+			status := query.StatusVerified
+			switch {
+			case err != nil:
+				status = query.StatusErrored
+				atomic.AddUint64(&totals.errored, 1)
+				var mt *query.MissingTableError
+				if errors.As(err, &mt) {
+					totals.addMissingTable(mt.Table)
+				}
+			case vf.IncompatiblePlatform != "":
+				status = query.StatusPartial
+				atomic.AddUint64(&totals.partial, 1)
+			default:
+				atomic.AddUint64(&totals.verified, 1)
+			}
+
+			if progress != nil {
+				progress.emit(name, status, vf, err)
+			}
+			if junit != nil {
+				junit.add(name, status, vf, err)
+			}
+			if summary != nil {
+				summary.add(name, status, vf, err)
+			}
+			return err
+		})
+	}
+
+	errs := []error{}
+	// Someday this might return new go errors
+	errs = append(errs, sg.Wait())
+
+	if junit != nil {
+		if err := junit.write(c.JUnit, time.Since(start)); err != nil {
+			errs = append(errs, fmt.Errorf("junit: %w", err))
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		completed := totals.verified + totals.errored + totals.partial
+		klog.Warningf("interrupted: %d of %d queries completed before cancellation, %d abandoned while running, %d not started",
+			completed, len(mm), totals.interrupted, uint64(len(mm))-completed-totals.interrupted)
+		errs = append(errs, fmt.Errorf("interrupted after %d of %d queries: %w", completed, len(mm), ctx.Err()))
+	case totals.verified == 0 && c.FailOnEmpty:
+		errs = append(errs, fmt.Errorf("0 queries were fully verified"))
+	case totals.verified+totals.partial == 0:
+		errs = append(errs, fmt.Errorf("0 queries were verified, even partially"))
+	}
+
+	totalQueryDuration := time.Duration(totals.queryDuration)
+	if totalQueryDuration > c.MaxTotalQueryDurationPerDay {
+		errs = append(errs, fmt.Errorf("total query duration per day (%s) exceeds --max-total-daily-duration=%s", totalQueryDuration.Round(time.Second), c.MaxTotalQueryDurationPerDay))
+	}
+
+	if summary != nil {
+		if err := summary.write(c.Summary, totalQueryDuration, totals.runs); err != nil {
+			errs = append(errs, fmt.Errorf("summary: %w", err))
+		}
+	}
+
+	klog.Infof("%d queries found: %d verified, %d errored, %d partial", len(mm), totals.verified, totals.errored, totals.partial)
+	for _, l := range missingTableSummary(totals.missingTables) {
+		klog.Infof("%s", l)
+	}
+	klog.Infof("total daily query runs: %d", totals.runs)
+	klog.Infof("total daily execution time: %s", totalQueryDuration)
+	for _, l := range valueSummary(mm, 5) {
+		klog.Infof("%s", l)
+	}
+
+	return errors.Join(errs...)
+}
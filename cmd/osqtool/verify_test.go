@@ -0,0 +1,739 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/query"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/klog/v2"
+)
+
+func TestCheckResultsPerHour(t *testing.T) {
+	// hourly, 10k rows: 10k results per hour
+	if err := checkResultsPerHour("3600", 10000, 50000); err != nil {
+		t.Errorf("rare-but-large query: got %v, want nil", err)
+	}
+
+	// every 20s, 10k rows: 1.8M results per hour
+	err := checkResultsPerHour("20", 10000, 50000)
+	if err == nil {
+		t.Fatalf("frequent-and-large query: got nil, want error")
+	}
+	if !strings.Contains(err.Error(), "1800000 results per hour") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := checkResultsPerHour("20", 10000, 0); err != nil {
+		t.Errorf("disabled check: got %v, want nil", err)
+	}
+}
+
+func TestCheckIntervalUtilization(t *testing.T) {
+	// every 60s, 3s per run
+	if err := checkIntervalUtilization("60", 3*time.Second, 0.8); err != nil {
+		t.Errorf("quick query: got %v, want nil", err)
+	}
+
+	// every 2s, 3s per run: it never keeps up
+	err := checkIntervalUtilization("2", 3*time.Second, 0.8)
+	if err == nil {
+		t.Fatalf("saturated query: got nil, want error")
+	}
+	if !strings.Contains(err.Error(), "1.50x its 2s interval") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// every 4s, 3.5s per run: close enough to overrun
+	if err := checkIntervalUtilization("4", 3500*time.Millisecond, 0.8); err == nil {
+		t.Errorf("nearly saturated query: got nil, want error")
+	}
+
+	if err := checkIntervalUtilization("2", 3*time.Second, 0); err != nil {
+		t.Errorf("disabled check: got %v, want nil", err)
+	}
+}
+
+func TestVerifyJSONLinesProgress(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *broken*) echo "Error: near line 1: syntax error" >&2; exit 1 ;;
+  *) echo '[{"a":"1"},{"a":"2"}]' ;;
+esac
+`)
+	dir := writeQueries(t, map[string]string{
+		"good.sql":      "SELECT 1 AS a;",
+		"broken.sql":    "SELECT broken;",
+		"elsewhere.sql": "-- platform: plan9\nSELECT 1 AS a;",
+	})
+	progress := filepath.Join(t.TempDir(), "progress.jsonl")
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     2,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		JSONLinesProgress:           progress,
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err == nil {
+		t.Errorf("Verify() = nil, want error for broken query")
+	}
+
+	bs, err := os.ReadFile(progress)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	got := map[string]progressLine{}
+	for _, line := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		var l progressLine
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("unmarshal %q: %v", line, err)
+		}
+		l.ElapsedMS = 0
+		got[l.Query] = l
+	}
+
+	names := []string{}
+	for n := range got {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if diff := cmp.Diff([]string{"broken", "elsewhere", "good"}, names); diff != "" {
+		t.Errorf("progress queries mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(progressLine{Query: "good", Status: query.StatusVerified, Rows: 2}, got["good"]); diff != "" {
+		t.Errorf("good progress mismatch (-want +got):\n%s", diff)
+	}
+	if got["broken"].Status != query.StatusErrored || !strings.Contains(got["broken"].Error, "syntax error") {
+		t.Errorf("broken progress = %+v, want errored with syntax error", got["broken"])
+	}
+	if got["elsewhere"].Status != query.StatusPartial {
+		t.Errorf("elsewhere progress = %+v, want partial", got["elsewhere"])
+	}
+}
+
+func TestVerifyHumanIntervals(t *testing.T) {
+	stubOsqueryi(t, `echo '[{"a":"1"}]'`)
+	dir := writeQueries(t, map[string]string{
+		"hourly.sql": "-- interval: 3600\nSELECT 1 AS a;",
+	})
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     1,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+	}
+
+	for _, human := range []bool{true, false} {
+		buf := captureLogs(t)
+		c.HumanIntervals = human
+		if err := Verify(context.Background(), []string{dir}, c); err != nil {
+			t.Fatalf("Verify() = %v", err)
+		}
+
+		want := "daily cost for interval 3600 (24 runs)"
+		if human {
+			want = "daily cost for interval 1h0m0s (24 runs)"
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("human=%v: logs = %q, want %q", human, buf.String(), want)
+		}
+	}
+}
+
+func TestVerifyOrderByValue(t *testing.T) {
+	mm := map[string]*query.Metadata{
+		"low":      {Name: "low", Value: "1"},
+		"critical": {Name: "critical", Value: "10"},
+		"unscored": {Name: "unscored", Value: "Artifact used by this malware"},
+		"high":     {Name: "high", Value: "7.5"},
+		"also-low": {Name: "also-low", Value: "1"},
+	}
+
+	if diff := cmp.Diff([]string{"also-low", "critical", "high", "low", "unscored"}, verifyOrder(mm, false)); diff != "" {
+		t.Errorf("name order mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"critical", "high", "also-low", "low", "unscored"}, verifyOrder(mm, true)); diff != "" {
+		t.Errorf("value order mismatch (-want +got):\n%s", diff)
+	}
+
+	want := []string{
+		"value distribution (4 of 5 queries scored): 10=1 7.5=1 1=2",
+		"highest value queries: critical (10), high (7.5)",
+	}
+	if diff := cmp.Diff(want, valueSummary(mm, 2)); diff != "" {
+		t.Errorf("value summary mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestVerifyReuseOsqueryi(t *testing.T) {
+	starts := filepath.Join(t.TempDir(), "starts")
+	stubOsqueryi(t, `echo started >> "`+starts+`"
+while IFS= read -r line; do
+  case "$line" in
+    *"AS osqtool_sentinel;") echo "[{\"osqtool_sentinel\":\"$(echo "$line" | sed "s/.*'\(.*\)'.*/\1/")\"}]" ;;
+    "SELECT osqtool_sentinel_"*) echo "Error: no such column: $(echo "$line" | sed 's/SELECT \(.*\);/\1/')" >&2 ;;
+    *) echo '[{"a":"1"}]' ;;
+  esac
+done
+`)
+	dir := writeQueries(t, map[string]string{
+		"one.sql":   "SELECT 1 AS a;",
+		"two.sql":   "SELECT 2 AS a;",
+		"three.sql": "SELECT 3 AS a;",
+	})
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     1,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		ReuseOsqueryi:               true,
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+
+	bs, err := os.ReadFile(starts)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := strings.Count(string(bs), "started"); got != 1 {
+		t.Errorf("osqueryi started %d times, want 1", got)
+	}
+}
+
+func TestVerifyCancel(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *hang*) exec sleep 5 ;;
+  *) echo '[{"a":"1"}]' ;;
+esac
+`)
+	dir := writeQueries(t, map[string]string{
+		"a.sql": "SELECT 1 AS a;",
+		"b.sql": "SELECT 'hang' AS a;",
+		"c.sql": "SELECT 'hang' AS a;",
+		"d.sql": "SELECT 'hang' AS a;",
+		"e.sql": "SELECT 'hang' AS a;",
+	})
+	progress := filepath.Join(t.TempDir(), "progress.jsonl")
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     2,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		JSONLinesProgress:           progress,
+	}
+
+	before := runtime.NumGoroutine()
+	// Cancel as an interrupt would, once the fast query is done and the slow ones are running
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := Verify(ctx, []string{dir}, c)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Verify() = %v, want interrupted error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Verify() took %s, want running queries to be killed", elapsed)
+	}
+
+	bs, err := os.ReadFile(progress)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got, want := strings.Count(string(bs), "\n"), 1; got != want {
+		t.Errorf("progress has %d lines, want %d for the query completed before cancellation: %s", got, want, bs)
+	}
+
+	// Goroutines waiting on killed osqueryi processes should exit promptly
+	deadline := time.Now().Add(3 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines running after Verify(), want at most %d", after, before)
+	}
+}
+
+func TestVerifyWarnings(t *testing.T) {
+	stubOsqueryi(t, `
+cat > /dev/null
+echo "Warning: the uptime column is deprecated" >&2
+echo '[{"uptime":"42"}]'
+`)
+	dir := writeQueries(t, map[string]string{"uptime.sql": "SELECT * FROM uptime;"})
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     1,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+	}
+
+	buf := captureLogs(t)
+	if err := Verify(context.Background(), []string{dir}, c); err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	klog.Flush()
+
+	if want := `"uptime": osqueryi warning: Warning: the uptime column is deprecated`; !strings.Contains(buf.String(), want) {
+		t.Errorf("Verify() logs missing %q:\n%s", want, buf.String())
+	}
+}
+
+func TestVerifyQueryTimeout(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *hang*) exec sleep 5 ;;
+  *) echo '[{"a":"1"}]' ;;
+esac
+`)
+	dir := writeQueries(t, map[string]string{
+		"fast.sql": "SELECT 1 AS a;",
+		"slow.sql": "SELECT 'hang' AS a;",
+	})
+	progress := filepath.Join(t.TempDir(), "progress.jsonl")
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     2,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		QueryTimeout:                200 * time.Millisecond,
+		JSONLinesProgress:           progress,
+	}
+
+	start := time.Now()
+	err := Verify(context.Background(), []string{dir}, c)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Verify() = %v, want timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Verify() took %s, want the slow query to be abandoned", elapsed)
+	}
+
+	bs, err := os.ReadFile(progress)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	got := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		pl := progressLine{}
+		if err := json.Unmarshal([]byte(l), &pl); err != nil {
+			t.Fatalf("unmarshal %q: %v", l, err)
+		}
+		got[pl.Query] = pl.Status
+	}
+	want := map[string]string{"fast": query.StatusVerified, "slow": query.StatusErrored}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("statuses mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestVerifyOsqueryFlags(t *testing.T) {
+	stubOsqueryi(t, `
+cat > /dev/null
+if [ "$*" != "--json --disable_extensions=false --extensions_socket=/tmp/osquery.em" ]; then
+  echo "Error: unexpected arguments: $*" >&2
+  exit 1
+fi
+echo '[{"a":"1"}]'
+`)
+	dir := writeQueries(t, map[string]string{"one.sql": "SELECT 1 AS a;"})
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     1,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		OsqueryFlags:                []string{"--disable_extensions=false", "--extensions_socket=/tmp/osquery.em"},
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
+
+func TestVerifyJUnit(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *broken*) echo "Error: near line 1: syntax error" >&2; exit 1 ;;
+  *xprotect*) echo "Error: no such table: xprotect_reports" >&2; exit 1 ;;
+  *) echo '[{"a":"1"}]' ;;
+esac
+`)
+	other := "darwin"
+	if runtime.GOOS == "darwin" {
+		other = "linux"
+	}
+	dir := writeQueries(t, map[string]string{
+		"ok.sql":       "SELECT 1 AS a;",
+		"broken.sql":   "SELECT broken;",
+		"xprotect.sql": "-- platform: " + other + "\nSELECT * FROM xprotect_reports;",
+	})
+	report := filepath.Join(t.TempDir(), "junit.xml")
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     2,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		JUnit:                       report,
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err == nil {
+		t.Errorf("Verify() = nil, want error for broken query")
+	}
+
+	bs, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	s := &junitSuite{}
+	if err := xml.Unmarshal(bs, s); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, bs)
+	}
+
+	type outcome struct{ Name, Failure, Skipped string }
+	got := []outcome{}
+	for _, tc := range s.Cases {
+		o := outcome{Name: tc.Name}
+		if tc.Failure != nil {
+			o.Failure = tc.Failure.Message
+		}
+		if tc.Skipped != nil {
+			o.Skipped = tc.Skipped.Message
+		}
+		got = append(got, o)
+	}
+	want := []outcome{
+		{Name: "broken", Failure: "query failed verification"},
+		{Name: "ok"},
+		{Name: "xprotect", Skipped: "incompatible platform: " + other},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("test cases mismatch (-want +got):\n%s", diff)
+	}
+	if s.Tests != 3 || s.Failures != 1 || s.Skipped != 1 {
+		t.Errorf("suite totals = %d tests, %d failures, %d skipped; want 3, 1, 1", s.Tests, s.Failures, s.Skipped)
+	}
+}
+
+func TestVerifySummary(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *broken*) echo "Error: near line 1: syntax error" >&2; exit 1 ;;
+  *xprotect*) echo "Error: no such table: xprotect_reports" >&2; exit 1 ;;
+  *) echo '[{"a":"1"},{"a":"2"}]' ;;
+esac
+`)
+	other := "darwin"
+	if runtime.GOOS == "darwin" {
+		other = "linux"
+	}
+	dir := writeQueries(t, map[string]string{
+		"ok.sql":       "-- interval: 3600\nSELECT 1 AS a;",
+		"broken.sql":   "SELECT broken;",
+		"xprotect.sql": "-- platform: " + other + "\nSELECT * FROM xprotect_reports;",
+	})
+	path := filepath.Join(t.TempDir(), "summary.json")
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     2,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+		Summary:                     path,
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err == nil {
+		t.Errorf("Verify() = nil, want error for broken query")
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	s := query.VerifySummary{}
+	if err := json.Unmarshal(bs, &s); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, bs)
+	}
+
+	type outcome struct {
+		Name, Status string
+		Rows         int
+		Errored      bool
+	}
+	got := []outcome{}
+	for _, r := range s.Queries {
+		got = append(got, outcome{Name: r.Name, Status: r.Status, Rows: r.Rows, Errored: r.Error != ""})
+	}
+	want := []outcome{
+		{Name: "broken", Status: query.StatusErrored, Errored: true},
+		{Name: "ok", Status: query.StatusVerified, Rows: 2},
+		{Name: "xprotect", Status: query.StatusPartial},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("summary queries mismatch (-want +got):\n%s", diff)
+	}
+	if s.Verified != 1 || s.Partial != 1 || s.Errored != 1 {
+		t.Errorf("summary counts = %d verified, %d partial, %d errored; want 1, 1, 1", s.Verified, s.Partial, s.Errored)
+	}
+	if s.TotalDailyRuns != 24 {
+		t.Errorf("TotalDailyRuns = %d, want 24", s.TotalDailyRuns)
+	}
+}
+
+func TestVerifyMinResults(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *empty*) echo '[]' ;;
+  *xprotect*) echo "Error: no such table: xprotect_reports" >&2; exit 1 ;;
+  *) echo '[{"a":"1"},{"a":"2"}]' ;;
+esac
+`)
+	other := "darwin"
+	if runtime.GOOS == "darwin" {
+		other = "linux"
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		minResults int
+		wantErr    string
+	}{
+		{name: "disabled", query: "SELECT 'empty' AS a;"},
+		{name: "flag satisfied", query: "SELECT 1 AS a;", minResults: 2},
+		{name: "flag", query: "SELECT 'empty' AS a;", minResults: 1, wantErr: "0 results is fewer than the minimum of 1"},
+		{name: "directive", query: "-- min_results: 3\nSELECT 1 AS a;", wantErr: "2 results is fewer than the minimum of 3"},
+		{name: "directive overrides flag", query: "-- min_results: 1\nSELECT 1 AS a;", minResults: 5},
+		{name: "incompatible", query: "-- platform: " + other + "\n-- min_results: 1\nSELECT * FROM xprotect_reports;", minResults: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Verify fails if no query is fully verified, so include one that always passes.
+			dir := writeQueries(t, map[string]string{"q.sql": tc.query, "ok.sql": "-- min_results: 1\nSELECT 1 AS a;"})
+			c := Config{
+				DefaultInterval:             time.Hour,
+				MaxInterval:                 24 * time.Hour,
+				Workers:                     1,
+				MaxResults:                  100,
+				MinResults:                  tc.minResults,
+				maxQueryDuration:            time.Minute,
+				maxQueryDurationPerDay:      time.Hour,
+				MaxTotalQueryDurationPerDay: time.Hour,
+			}
+
+			err := Verify(context.Background(), []string{dir}, c)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("Verify() = %v, want nil", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("Verify() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyMaxColumns(t *testing.T) {
+	stubOsqueryi(t, `
+case "$(cat)" in
+  *wide*) echo '[{"a":"1","b":"2"},{"a":"3","c":"4"}]' ;;
+  *xprotect*) echo "Error: no such table: xprotect_reports" >&2; exit 1 ;;
+  *) echo '[{"a":"1"}]' ;;
+esac
+`)
+	other := "darwin"
+	if runtime.GOOS == "darwin" {
+		other = "linux"
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		maxColumns int
+		wantErr    string
+	}{
+		{name: "disabled", query: "SELECT 'wide' AS a;"},
+		{name: "within limit", query: "SELECT 'wide' AS a;", maxColumns: 3},
+		{name: "distinct keys across rows", query: "SELECT 'wide' AS a;", maxColumns: 2, wantErr: "3 columns exceeds --max-columns=2: a, b, c"},
+		{name: "incompatible", query: "-- platform: " + other + "\nSELECT * FROM xprotect_reports;", maxColumns: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeQueries(t, map[string]string{"q.sql": tc.query, "ok.sql": "SELECT 1 AS a;"})
+			c := Config{
+				DefaultInterval:             time.Hour,
+				MaxInterval:                 24 * time.Hour,
+				Workers:                     1,
+				MaxResults:                  100,
+				MaxColumns:                  tc.maxColumns,
+				maxQueryDuration:            time.Minute,
+				maxQueryDurationPerDay:      time.Hour,
+				MaxTotalQueryDurationPerDay: time.Hour,
+			}
+
+			err := Verify(context.Background(), []string{dir}, c)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("Verify() = %v, want nil", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("Verify() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyFailOnEmpty(t *testing.T) {
+	stubOsqueryi(t, `
+cat > /dev/null
+echo "Error: no such table: xprotect_reports" >&2
+exit 1
+`)
+	other := "darwin"
+	if runtime.GOOS == "darwin" {
+		other = "linux"
+	}
+	dir := writeQueries(t, map[string]string{"xprotect.sql": "-- platform: " + other + "\nSELECT * FROM xprotect_reports;"})
+	empty := t.TempDir()
+
+	tests := []struct {
+		path        string
+		failOnEmpty bool
+		wantErr     string
+	}{
+		{path: dir, failOnEmpty: true, wantErr: "0 queries were fully verified"},
+		{path: dir, failOnEmpty: false},
+		{path: empty, failOnEmpty: false, wantErr: "0 queries were verified, even partially"},
+	}
+
+	for _, tc := range tests {
+		c := Config{
+			DefaultInterval:             time.Hour,
+			MaxInterval:                 24 * time.Hour,
+			Workers:                     1,
+			MaxResults:                  100,
+			maxQueryDuration:            time.Minute,
+			maxQueryDurationPerDay:      time.Hour,
+			MaxTotalQueryDurationPerDay: time.Hour,
+			FailOnEmpty:                 tc.failOnEmpty,
+		}
+
+		err := Verify(context.Background(), []string{tc.path}, c)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("Verify(%s, fail-on-empty=%v) = %v, want nil", tc.path, tc.failOnEmpty, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("Verify(%s, fail-on-empty=%v) = %v, want error containing %q", tc.path, tc.failOnEmpty, err, tc.wantErr)
+		}
+	}
+}
+
+func TestVerifyRetries(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "started")
+	stubOsqueryi(t, `
+cat > /dev/null
+if [ ! -f `+state+` ]; then
+  touch `+state+`
+  echo "Error: database is locked" >&2
+  exit 1
+fi
+echo '[{"a":"1"}]'
+`)
+	dir := writeQueries(t, map[string]string{"one.sql": "SELECT 1 AS a;"})
+
+	c := Config{
+		DefaultInterval:             time.Hour,
+		MaxInterval:                 24 * time.Hour,
+		Workers:                     1,
+		MaxResults:                  100,
+		maxQueryDuration:            time.Minute,
+		maxQueryDurationPerDay:      time.Hour,
+		MaxTotalQueryDurationPerDay: time.Hour,
+	}
+	if err := Verify(context.Background(), []string{dir}, c); err == nil || !strings.Contains(err.Error(), "database is locked") {
+		t.Errorf("Verify() without retries = %v, want locked error", err)
+	}
+
+	if err := os.Remove(state); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	c.Retries = 2
+	c.retryBackoff = time.Millisecond
+	if err := Verify(context.Background(), []string{dir}, c); err != nil {
+		t.Errorf("Verify() with retries = %v, want nil", err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: errors.New("osqueryi: Error: database is locked"), want: true},
+		{err: errors.New("osqueryi: Error: no such table: xprotect_reports"), want: false},
+		{err: fmt.Errorf("\"slow\" timed out after 1s: %w", context.DeadlineExceeded), want: false},
+	}
+	for _, tc := range tests {
+		if got := retryable(tc.err); got != tc.want {
+			t.Errorf("retryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestMissingTableSummary(t *testing.T) {
+	got := missingTableSummary(map[string]int{"foo": 3, "bar": 1, "baz": 3})
+	want := []string{
+		"3 queries reference missing table `baz`",
+		"3 queries reference missing table `foo`",
+		"1 query references missing table `bar`",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("missingTableSummary() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// watchExtensions are the file suffixes whose changes trigger a new run in watch mode.
+var watchExtensions = []string{".sql", ".conf", ".json", ".yaml", ".yml"}
+
+// Intervals used by Watch to poll for changes, and to wait for a burst of saves to finish.
+const (
+	watchPollInterval = 500 * time.Millisecond
+	watchDebounce     = 300 * time.Millisecond
+)
+
+// fileState is what watch mode compares to detect a changed file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchSnapshot returns the state of the watched files within paths.
+func watchSnapshot(paths []string) (map[string]fileState, error) {
+	files := map[string]fileState{}
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			for _, ext := range watchExtensions {
+				if strings.HasSuffix(path, ext) {
+					files[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// changed returns true if any file was added, removed, or modified between two snapshots.
+func changed(a map[string]fileState, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for path, s := range a {
+		if b[path] != s {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch runs verify for paths, and runs it again each time a query file changes, until ctx is done.
+func Watch(ctx context.Context, paths []string, w io.Writer, c Config) error {
+	return watch(ctx, paths, w, watchPollInterval, watchDebounce, func() error { return Verify(ctx, paths, c) })
+}
+
+// watch calls run, and then calls it again whenever the files within paths change. Changes are only acted
+// upon once the files have been stable for the debounce period, so that a burst of saves causes one run.
+func watch(ctx context.Context, paths []string, w io.Writer, poll time.Duration, debounce time.Duration, run func() error) error {
+	last, err := watchSnapshot(paths)
+	if err != nil {
+		return err
+	}
+
+	for {
+		fmt.Fprintf(w, "==== %s: verifying %s ====\n", time.Now().Format(time.RFC3339), strings.Join(paths, ", "))
+		if err := run(); err != nil {
+			fmt.Fprintf(w, "verify failed: %v\n", err)
+		} else {
+			fmt.Fprintln(w, "verify passed")
+		}
+		fmt.Fprintln(w, "waiting for changes (Ctrl-C to exit) ...")
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(poll):
+			}
+
+			current, err := watchSnapshot(paths)
+			if err != nil {
+				klog.Warningf("watch: %v", err)
+				continue
+			}
+			if !changed(last, current) {
+				continue
+			}
+
+			// Wait for the files to settle before running again
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(debounce):
+				}
+				settled, err := watchSnapshot(paths)
+				if err == nil && !changed(current, settled) {
+					break
+				}
+				current = settled
+			}
+			last = current
+			break
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a strings.Builder that is safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	sb strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.String()
+}
+
+func TestWatch(t *testing.T) {
+	dir := writeQueries(t, map[string]string{"users.sql": "SELECT 1;"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan struct{}, 10)
+	out := &syncBuffer{}
+	done := make(chan error)
+	go func() {
+		done <- watch(ctx, []string{dir}, out, 10*time.Millisecond, 50*time.Millisecond, func() error {
+			runs <- struct{}{}
+			return nil
+		})
+	}()
+
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+	wait("the initial run")
+
+	// a burst of saves results in a single run
+	path := filepath.Join(dir, "users.sql")
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(path, []byte("SELECT "+strings.Repeat("1, ", i)+"1;"), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	wait("a run after the change")
+
+	select {
+	case <-runs:
+		t.Errorf("got a second run for a single burst of saves")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("watch() = %v, want nil after cancel", err)
+	}
+	if got := strings.Count(out.String(), "===="); got != 4 {
+		t.Errorf("output has %d separator markers, want 4 (two runs):\n%s", got, out.String())
+	}
+}
@@ -0,0 +1,525 @@
+package query
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/osqtool/pkg/schema"
+	"k8s.io/klog/v2"
+)
+
+// Config configures how Apply modifies a set of queries.
+type Config struct {
+	// MinInterval and MaxInterval bound the interval of every query.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// DefaultInterval is used for queries which do not specify an interval.
+	DefaultInterval time.Duration
+	// RoundInterval rounds intervals to a multiple of this duration, if set.
+	RoundInterval time.Duration
+	// TagIntervals and PlatformIntervals are name=modifier entries, such as "often=x/3" or "darwin=2x",
+	// which modify the default interval of queries with a matching tag or platform.
+	TagIntervals      []string
+	PlatformIntervals []string
+	// TableIntervals are table=interval entries, used by queries with an "interval: auto" directive.
+	TableIntervals []string
+	TagRules       []TagRule
+	// Exclude lists query names or globs to exclude.
+	Exclude     []string
+	ExcludeTags []string
+	// RequireTags excludes queries without any of these tags, or without all of them if RequireAllTags is set.
+	RequireTags    []string
+	RequireAllTags bool
+	// Platforms excludes queries that do not run on any of these platforms.
+	Platforms []string
+	// DisableExcluded marks excluded queries as removed, rather than dropping them.
+	DisableExcluded bool
+	// Vars are substituted into query templates.
+	Vars      map[string]string
+	MultiLine bool
+	// Formatter reformats each query into a canonical form, if set.
+	Formatter Formatter
+	// Splay perturbs each interval by up to this fraction, such as 0.1.
+	Splay float64
+	// Report records the changes made, if set.
+	Report *ApplyReport
+	// Referenced collects the variables referenced by the queries, if set. Unreferenced variables are then
+	// left for the caller to check with UnusedVars, once every set of queries has been applied.
+	Referenced map[string]bool
+}
+
+// ClampEvent records an interval that was overridden by the minimum or maximum interval.
+type ClampEvent struct {
+	Name      string
+	Requested int
+	Clamped   int
+	Bound     string
+}
+
+// ApplyReport records the changes made by Apply.
+type ApplyReport struct {
+	Clamps []ClampEvent
+	// Queries is the number of queries considered, including those excluded.
+	Queries int
+	// Overridden is the set of queries whose interval was clamped or rounded.
+	Overridden map[string]bool
+	// Excluded is the number of queries dropped, or disabled with DisableExcluded.
+	Excluded int
+}
+
+func (r *ApplyReport) clamp(name string, requested int, clamped int, bound string) {
+	if r == nil {
+		return
+	}
+	r.Clamps = append(r.Clamps, ClampEvent{Name: name, Requested: requested, Clamped: clamped, Bound: bound})
+	r.override(name)
+}
+
+func (r *ApplyReport) override(name string) {
+	if r == nil {
+		return
+	}
+	if r.Overridden == nil {
+		r.Overridden = map[string]bool{}
+	}
+	r.Overridden[name] = true
+}
+
+// Apply applies the configuration to a set of queries keyed by name, modifying them in place: expanding
+// variables, formatting, applying tag rules, dropping or disabling excluded queries, and calculating,
+// bounding, rounding and splaying intervals.
+func Apply(mm map[string]*Metadata, c Config) error {
+	klog.V(1).Infof("applying config: %+v", c)
+	minSeconds := int(c.MinInterval.Seconds())
+	maxSeconds := int(c.MaxInterval.Seconds())
+	roundSeconds := int(c.RoundInterval.Seconds())
+	excludeMap := map[string]bool{}
+	excludeGlobs := []string{}
+	for _, v := range c.Exclude {
+		if v == "" {
+			continue
+		}
+		if !strings.ContainsAny(v, "*?[") {
+			excludeMap[v] = true
+			continue
+		}
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("exclude %q: %w", v, err)
+		}
+		excludeGlobs = append(excludeGlobs, v)
+	}
+
+	excludeTagsMap := map[string]bool{}
+	for _, v := range c.ExcludeTags {
+		if v != "" {
+			excludeTagsMap[v] = true
+		}
+	}
+
+	requireTags := []string{}
+	for _, v := range c.RequireTags {
+		if v != "" {
+			requireTags = append(requireTags, v)
+		}
+	}
+
+	platformsMap := map[string]bool{}
+	for _, v := range c.Platforms {
+		if v == "" {
+			continue
+		}
+
+		platformsMap[v] = true
+	}
+
+	referenced := c.Referenced
+	if referenced == nil {
+		referenced = map[string]bool{}
+	}
+	for name, m := range mm {
+		if c.Report != nil {
+			c.Report.Queries++
+		}
+
+		if len(c.Vars) > 0 {
+			used, err := ExpandTemplate(m, c.Vars)
+			if err != nil {
+				return fmt.Errorf("%q: template: %w", name, err)
+			}
+			for k := range used {
+				referenced[k] = true
+			}
+		}
+
+		if c.Formatter != nil {
+			if err := canonicalize(m, c.Formatter); err != nil {
+				return fmt.Errorf("%q: format: %w", name, err)
+			}
+		}
+
+		if !c.MultiLine {
+			m.Query = m.SingleLineQuery
+		}
+
+		ApplyTagRules(m, c.TagRules)
+
+		reason := ""
+		if excludeMap[name] {
+			reason = "excluded by name"
+		}
+		for _, g := range excludeGlobs {
+			if ok, _ := path.Match(g, name); ok && reason == "" {
+				reason = fmt.Sprintf("excluded by pattern %s", g)
+			}
+		}
+
+		for _, t := range m.Tags {
+			if reason == "" && excludeTagsMap[t] {
+				reason = fmt.Sprintf("excluded by tag %s", t)
+			}
+		}
+
+		if reason == "" && len(requireTags) > 0 && !hasRequiredTags(m, requireTags, c.RequireAllTags) {
+			reason = fmt.Sprintf("missing required tags %s", strings.Join(requireTags, ","))
+		}
+
+		if reason == "" && len(platformsMap) > 0 && m.Platform != "" && !anyPlatformListed(m, platformsMap) {
+			reason = fmt.Sprintf("%q not in the listed platforms", m.Platform)
+		}
+
+		if reason != "" {
+			if c.Report != nil {
+				c.Report.Excluded++
+			}
+			if !c.DisableExcluded {
+				klog.Infof("Skipping %s, %s", name, reason)
+				delete(mm, name)
+				continue
+			}
+			klog.Infof("Disabling %s, %s", name, reason)
+			m.Removed = true
+		}
+
+		if m.Interval == AutoInterval {
+			interval, table := autoInterval(m, c)
+			if table == "" {
+				klog.Warningf("%q: no table interval covers its tables, using default interval of %ds", name, interval)
+			} else {
+				klog.V(1).Infof("setting %q interval to %ds (auto, based on %s)", name, interval, table)
+			}
+			m.Interval = strconv.Itoa(interval)
+		}
+
+		if m.Interval == "" {
+			interval := CalculateInterval(m, c)
+			klog.V(1).Infof("setting %q interval to %ds", name, interval)
+			m.Interval = strconv.Itoa(interval)
+		}
+
+		i, err := strconv.Atoi(m.Interval)
+		if err != nil {
+			return fmt.Errorf("%q: failed to parse %q: %w", name, m.Interval, err)
+		}
+
+		if i > maxSeconds {
+			klog.Infof("overriding %q interval to %ds (max)", name, maxSeconds)
+			c.Report.clamp(name, i, maxSeconds, "max")
+			i = maxSeconds
+			m.Interval = strconv.Itoa(i)
+		}
+		if i < minSeconds {
+			klog.Infof("overriding %q interval to %ds (min)", name, minSeconds)
+			c.Report.clamp(name, i, minSeconds, "min")
+			i = minSeconds
+			m.Interval = strconv.Itoa(i)
+		}
+
+		// Splay before rounding, so that rounding has the final say. Both stay within the bounds.
+		if c.Splay > 0 {
+			splayed := splayInterval(name, i, c.Splay, minSeconds, maxSeconds)
+			if splayed != i {
+				klog.V(1).Infof("splaying %q interval from %ds to %ds", name, i, splayed)
+				c.Report.override(name)
+				i = splayed
+				m.Interval = strconv.Itoa(i)
+			}
+		}
+
+		if roundSeconds > 0 {
+			rounded := roundInterval(i, roundSeconds, minSeconds, maxSeconds)
+			if rounded != i {
+				klog.Infof("rounding %q interval from %ds to %ds", name, i, rounded)
+				c.Report.override(name)
+				i = rounded
+				m.Interval = strconv.Itoa(i)
+			}
+		}
+	}
+
+	if c.Referenced != nil {
+		return nil
+	}
+	return UnusedVars(c.Vars, referenced)
+}
+
+// UnusedVars returns an error listing the variables that are not within the referenced set.
+func UnusedVars(vars map[string]string, referenced map[string]bool) error {
+	unused := []string{}
+	for k := range vars {
+		if !referenced[k] {
+			unused = append(unused, k)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("variables not referenced by any query: %s", strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+// CalculateInterval calculates the default interval to use for a query, applying any TagIntervals
+// modifiers for its tags, followed by any PlatformIntervals modifiers for its platforms.
+func CalculateInterval(m *Metadata, c Config) int {
+	tagMap := map[string]bool{}
+	for _, t := range m.Tags {
+		tagMap[t] = true
+	}
+
+	interval := int(c.DefaultInterval.Seconds())
+
+	for _, k := range c.TagIntervals {
+		tag, modifier, found := strings.Cut(k, "=")
+		klog.V(1).Infof("processing tag interval: %s=%s (map: %v) - currently: %d", tag, modifier, tagMap, interval)
+
+		if !found {
+			klog.Errorf("unparseable tag interval: %v", k)
+			continue
+		}
+
+		if !tagMap[tag] {
+			klog.V(1).Infof("%s is not mentioned by this query, moving on", tag)
+			continue
+		}
+
+		interval = modifyInterval(interval, modifier)
+	}
+
+	for _, k := range c.PlatformIntervals {
+		platform, modifier, found := strings.Cut(k, "=")
+		if !found {
+			if k != "" {
+				klog.Errorf("unparseable platform interval: %v", k)
+			}
+			continue
+		}
+
+		if !m.HasPlatform(platform) {
+			continue
+		}
+
+		klog.V(1).Infof("%q matches platform interval %s=%s - currently: %d", m.Name, platform, modifier, interval)
+		interval = modifyInterval(interval, modifier)
+	}
+	return interval
+}
+
+// modifyInterval applies a modifier to an interval, where the modifier may be a number of seconds,
+// a duration such as "30m", a multiplier such as "2x", or a divisor such as "x/3".
+func modifyInterval(interval int, modifier string) int {
+	f, err := ParseIntervalModifier(modifier)
+	if err != nil {
+		klog.Errorf("%v", err)
+		return interval
+	}
+	return f(interval)
+}
+
+// ParseIntervalModifier parses an interval modifier, returning a function that applies it. Modifiers are
+// checked in order: a divisor such as "x/3", a multiplier such as "2x", a number of seconds, or a duration.
+func ParseIntervalModifier(modifier string) (func(interval int) int, error) {
+	if divisor, ok := strings.CutPrefix(modifier, "x/"); ok {
+		d, err := strconv.ParseFloat(divisor, 64)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("unparseable interval divisor: %v", modifier)
+		}
+
+		return func(interval int) int {
+			klog.V(1).Infof("dividing interval by %0.2f", d)
+			return int(float64(interval) / d)
+		}, nil
+	}
+
+	if multiplier, ok := strings.CutSuffix(modifier, "x"); ok {
+		x, err := strconv.ParseFloat(multiplier, 64)
+		if err != nil || x <= 0 {
+			return nil, fmt.Errorf("unparseable interval multiplier: %v", modifier)
+		}
+
+		return func(interval int) int {
+			klog.V(1).Infof("multiplying interval by %0.2f", x)
+			return int(float64(interval) * x)
+		}, nil
+	}
+
+	if i, err := strconv.Atoi(modifier); err == nil {
+		if i <= 0 {
+			return nil, fmt.Errorf("interval must be positive: %v", modifier)
+		}
+		return func(int) int {
+			klog.V(1).Infof("%s is an int, setting interval to %d", modifier, i)
+			return i
+		}, nil
+	}
+
+	if d, err := time.ParseDuration(modifier); err == nil {
+		if d < time.Second {
+			return nil, fmt.Errorf("interval must be at least 1s: %v", modifier)
+		}
+		return func(int) int {
+			klog.V(1).Infof("%s is a duration, setting interval to %0.f", modifier, d.Seconds())
+			return int(d.Seconds())
+		}, nil
+	}
+
+	return nil, fmt.Errorf("do not understand modifier: %s", modifier)
+}
+
+// autoInterval calculates the interval for a query based on the tables it references, returning the
+// shortest interval recommended by TableIntervals, and the table that recommended it. If no table is
+// covered, the default interval is returned along with an empty table name.
+func autoInterval(m *Metadata, c Config) (int, string) {
+	recommended := map[string]int{}
+	for _, k := range c.TableIntervals {
+		table, value, found := strings.Cut(k, "=")
+		if !found {
+			if k != "" {
+				klog.Errorf("unparseable table interval: %v", k)
+			}
+			continue
+		}
+
+		if i, err := strconv.Atoi(value); err == nil {
+			recommended[table] = i
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			klog.Errorf("unparseable table interval: %v", k)
+			continue
+		}
+		recommended[table] = int(d.Seconds())
+	}
+
+	interval := 0
+	chosen := ""
+	for _, t := range schema.Tables(m.Query) {
+		i, ok := recommended[t]
+		if !ok {
+			continue
+		}
+		if chosen == "" || i < interval {
+			interval = i
+			chosen = t
+		}
+	}
+
+	if chosen == "" {
+		return int(c.DefaultInterval.Seconds()), ""
+	}
+	return interval, chosen
+}
+
+// roundInterval rounds an interval to the nearest multiple of granularity (halves round up).
+// If the nearest multiple falls outside of the [min, max] bounds, the closest multiple
+// within the bounds is used instead, and if no such multiple exists, the bound itself is returned.
+func roundInterval(interval int, granularity int, minSeconds int, maxSeconds int) int {
+	if granularity <= 0 {
+		return interval
+	}
+
+	rounded := ((interval + granularity/2) / granularity) * granularity
+
+	if rounded < minSeconds {
+		rounded = ((minSeconds + granularity - 1) / granularity) * granularity
+	}
+
+	if maxSeconds > 0 && rounded > maxSeconds {
+		rounded = (maxSeconds / granularity) * granularity
+	}
+
+	if rounded < minSeconds {
+		return minSeconds
+	}
+
+	return rounded
+}
+
+// splayInterval perturbs an interval by up to +/- the splay fraction, by an amount derived from a hash
+// of the query name so that it is the same on every run, staying within the [min, max] bounds.
+func splayInterval(name string, interval int, splay float64, minSeconds int, maxSeconds int) int {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	// A factor between -1 and 1
+	factor := float64(h.Sum64()%20001)/10000 - 1
+
+	splayed := interval + int(math.Round(float64(interval)*splay*factor))
+	if maxSeconds > 0 && splayed > maxSeconds {
+		splayed = maxSeconds
+	}
+	if splayed < minSeconds {
+		splayed = minSeconds
+	}
+	return splayed
+}
+
+// canonicalize reformats the query, updating both the multi-line and single-line forms.
+func canonicalize(m *Metadata, f Formatter) error {
+	formatted, err := f.Format(m.Query)
+	if err != nil {
+		return err
+	}
+
+	singles := []string{}
+	for _, line := range strings.Split(formatted, "\n") {
+		singles = append(singles, strings.TrimSpace(line))
+	}
+
+	m.Query = formatted
+	m.SingleLineQuery = strings.Join(singles, " ")
+	return nil
+}
+
+// hasRequiredTags returns true if a query has any of the required tags, or all of them if all is set.
+func hasRequiredTags(m *Metadata, required []string, all bool) bool {
+	tags := map[string]bool{}
+	for _, t := range m.Tags {
+		tags[t] = true
+	}
+
+	for _, t := range required {
+		if tags[t] && !all {
+			return true
+		}
+		if !tags[t] && all {
+			return false
+		}
+	}
+	return all
+}
+
+// anyPlatformListed returns true if any of the platforms of a query are within the platforms map.
+func anyPlatformListed(m *Metadata, platformsMap map[string]bool) bool {
+	for _, p := range m.Platforms() {
+		if platformsMap[p] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,474 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRoundInterval(t *testing.T) {
+	tests := []struct {
+		name        string
+		interval    int
+		granularity int
+		min         int
+		max         int
+		want        int
+	}{
+		{name: "nearest down", interval: 3743, granularity: 60, min: 20, max: 86400, want: 3720},
+		{name: "nearest up", interval: 3751, granularity: 60, min: 20, max: 86400, want: 3780},
+		{name: "exact", interval: 3600, granularity: 60, min: 20, max: 86400, want: 3600},
+		{name: "below min", interval: 40, granularity: 60, min: 50, max: 86400, want: 60},
+		{name: "above max", interval: 86390, granularity: 60, min: 20, max: 86399, want: 86340},
+		{name: "no multiple within bounds", interval: 50, granularity: 60, min: 45, max: 55, want: 45},
+		{name: "disabled", interval: 3743, granularity: 0, min: 20, max: 86400, want: 3743},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := roundInterval(tc.interval, tc.granularity, tc.min, tc.max)
+			if got != tc.want {
+				t.Errorf("roundInterval(%d, %d, %d, %d) = %d, want %d", tc.interval, tc.granularity, tc.min, tc.max, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestModifyInterval(t *testing.T) {
+	tests := []struct {
+		modifier string
+		want     int
+	}{
+		{modifier: "x/3", want: 1200},
+		{modifier: "x/1.5", want: 2400},
+		{modifier: "3x", want: 10800},
+		{modifier: "1.25x", want: 4500},
+		{modifier: "600", want: 600},
+		{modifier: "6m", want: 360},
+		{modifier: "1h30m", want: 5400},
+		// unparseable modifiers leave the interval unchanged
+		{modifier: "x/0", want: 3600},
+		{modifier: "x/-3", want: 3600},
+		{modifier: "x/", want: 3600},
+		{modifier: "x", want: 3600},
+		{modifier: "-2x", want: 3600},
+		{modifier: "2xx", want: 3600},
+		{modifier: "3/x", want: 3600},
+		{modifier: "0", want: 3600},
+		{modifier: "500ms", want: 3600},
+		{modifier: "6mm", want: 3600},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.modifier, func(t *testing.T) {
+			if got := modifyInterval(3600, tc.modifier); got != tc.want {
+				t.Errorf("modifyInterval(3600, %q) = %d, want %d", tc.modifier, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCalculateIntervalDivisor(t *testing.T) {
+	c := Config{DefaultInterval: time.Hour, TagIntervals: []string{"often=x/3", "seldom=3x"}}
+	m := &Metadata{Name: "shells", Tags: []string{"often"}}
+	if got := CalculateInterval(m, c); got != 1200 {
+		t.Errorf("CalculateInterval(often) = %d, want 1200", got)
+	}
+}
+
+func TestApplyAutoInterval(t *testing.T) {
+	m, err := Parse("users", []byte("-- interval: auto\nSELECT u.username FROM users u JOIN user_groups ug USING (uid);"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	unknown, err := Parse("mystery", []byte("-- interval: auto\nSELECT * FROM acme_agents;"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	c := Config{
+		DefaultInterval: time.Hour,
+		MinInterval:     20 * time.Second,
+		MaxInterval:     24 * time.Hour,
+		TableIntervals:  []string{"processes=10m", "users=12h", "user_groups=43201"},
+	}
+	mm := map[string]*Metadata{"users": m, "mystery": unknown}
+	if err := Apply(mm, c); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if got := mm["users"].Interval; got != "43200" {
+		t.Errorf("users interval = %q, want 43200", got)
+	}
+	if got := mm["mystery"].Interval; got != "3600" {
+		t.Errorf("mystery interval = %q, want default of 3600", got)
+	}
+}
+
+func TestApplyPlatformIntervals(t *testing.T) {
+	c := Config{
+		DefaultInterval:   time.Hour,
+		MinInterval:       time.Minute,
+		MaxInterval:       3 * time.Hour,
+		TagIntervals:      []string{"seldom=2x"},
+		PlatformIntervals: []string{"darwin=2x", "windows=30m", "linux=x/120"},
+	}
+
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{sql: "-- platform: darwin\nSELECT 1;", want: "7200"},
+		{sql: "-- platform: windows\nSELECT 1;", want: "1800"},
+		{sql: "-- platform: posix\nSELECT 1;", want: "3600"},
+		// Platform modifiers are applied after tag modifiers, and the result is still clamped
+		{sql: "-- platform: darwin\n-- tags: seldom\nSELECT 1;", want: "10800"},
+		{sql: "-- platform: linux\nSELECT 1;", want: "60"},
+		{sql: "SELECT 1;", want: "3600"},
+	}
+
+	for _, tc := range tests {
+		m, err := Parse("q", []byte("-- A query\n"+tc.sql))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		if err := Apply(map[string]*Metadata{"q": m}, c); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+		if m.Interval != tc.want {
+			t.Errorf("%q interval = %s, want %s", tc.sql, m.Interval, tc.want)
+		}
+	}
+}
+
+func TestApplyTagFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.yaml")
+	if err := os.WriteFile(path, []byte("process-*: [process]\n\"*-events\":\n  - events\n  - process\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rules, err := LoadTagFile(path)
+	if err != nil {
+		t.Fatalf("LoadTagFile: %v", err)
+	}
+
+	mm := map[string]*Metadata{
+		"process-tree":   {Name: "process-tree", Interval: "3600"},
+		"process-events": {Name: "process-events", Interval: "3600", Tags: []string{"often"}},
+		"users":          {Name: "users", Interval: "3600", Tags: []string{"seldom"}},
+	}
+	c := Config{MaxInterval: 24 * time.Hour, TagRules: rules}
+	if err := Apply(mm, c); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := map[string][]string{
+		"process-tree":   {"process"},
+		"process-events": {"often", "process", "events"},
+		"users":          {"seldom"},
+	}
+	got := map[string][]string{}
+	for name, m := range mm {
+		got[name] = m.Tags
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyDisableExcluded(t *testing.T) {
+	newQueries := func() map[string]*Metadata {
+		return map[string]*Metadata{
+			"users":   {Name: "users", Interval: "3600"},
+			"legacy":  {Name: "legacy", Interval: "3600"},
+			"noisy":   {Name: "noisy", Interval: "3600", Tags: []string{"often", "noisy"}},
+			"windows": {Name: "windows", Interval: "3600", Platform: "windows"},
+		}
+	}
+	c := Config{MaxInterval: 24 * time.Hour, Exclude: []string{"legacy"}, ExcludeTags: []string{"noisy"}, Platforms: []string{"linux"}}
+
+	tests := []struct {
+		disable bool
+		want    map[string]bool
+	}{
+		{disable: false, want: map[string]bool{"users": false}},
+		{disable: true, want: map[string]bool{"users": false, "legacy": true, "noisy": true, "windows": true}},
+	}
+
+	for _, tc := range tests {
+		mm := newQueries()
+		c.DisableExcluded = tc.disable
+		if err := Apply(mm, c); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+
+		got := map[string]bool{}
+		for name, m := range mm {
+			got[name] = m.Removed
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("disable=%v: removed mismatch (-want +got):\n%s", tc.disable, diff)
+		}
+	}
+}
+
+func TestApplyExcludeGlobs(t *testing.T) {
+	newQueries := func() map[string]*Metadata {
+		mm := map[string]*Metadata{}
+		for _, name := range []string{"exp-dns", "exp-tls", "deprecated-kexts", "users", "users-extended", "exp"} {
+			mm[name] = &Metadata{Name: name, Interval: "3600"}
+		}
+		return mm
+	}
+
+	tests := []struct {
+		name    string
+		exclude []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "literal", exclude: []string{"users"}, want: []string{"deprecated-kexts", "exp", "exp-dns", "exp-tls", "users-extended"}},
+		{name: "glob", exclude: []string{"exp-*"}, want: []string{"deprecated-kexts", "exp", "users", "users-extended"}},
+		{name: "several", exclude: []string{"exp-*", "deprecated-*", "users"}, want: []string{"exp", "users-extended"}},
+		{name: "single character", exclude: []string{"exp-?ns"}, want: []string{"deprecated-kexts", "exp", "exp-tls", "users", "users-extended"}},
+		{name: "bad pattern", exclude: []string{"exp-["}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mm := newQueries()
+			err := Apply(mm, Config{MaxInterval: 24 * time.Hour, Exclude: tc.exclude})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Apply() = nil, want bad pattern error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			got := []string{}
+			for name := range mm {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("queries mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyRequireTags(t *testing.T) {
+	newQueries := func() map[string]*Metadata {
+		return map[string]*Metadata{
+			"timeline":  {Name: "timeline", Interval: "3600", Tags: []string{"postmortem", "persistent"}},
+			"artifacts": {Name: "artifacts", Interval: "3600", Tags: []string{"postmortem"}, Platform: "windows"},
+			"shells":    {Name: "shells", Interval: "3600", Tags: []string{"persistent"}},
+			"noisy":     {Name: "noisy", Interval: "3600", Tags: []string{"postmortem", "noisy"}},
+			"users":     {Name: "users", Interval: "3600"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		require []string
+		all     bool
+		want    []string
+	}{
+		{name: "none", want: []string{"artifacts", "shells", "timeline", "users"}},
+		{name: "any of one", require: []string{"postmortem"}, want: []string{"artifacts", "timeline"}},
+		{name: "any of two", require: []string{"postmortem", "persistent"}, want: []string{"artifacts", "shells", "timeline"}},
+		{name: "all of two", require: []string{"postmortem", "persistent"}, all: true, want: []string{"timeline"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mm := newQueries()
+			c := Config{MaxInterval: 24 * time.Hour, ExcludeTags: []string{"noisy"}, Platforms: []string{"linux", "windows"}, RequireTags: tc.require, RequireAllTags: tc.all}
+			if err := Apply(mm, c); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			got := []string{}
+			for name := range mm {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("queries mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyVars(t *testing.T) {
+	newQueries := func() map[string]*Metadata {
+		return map[string]*Metadata{
+			"listeners": {Name: "listeners", Interval: "3600", Query: "SELECT * FROM listening_ports WHERE port > {{.min_port}};"},
+		}
+	}
+	c := Config{MaxInterval: 24 * time.Hour, MultiLine: true}
+
+	tests := []struct {
+		name    string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "substituted", vars: map[string]string{"min_port": "1024"}, want: "SELECT * FROM listening_ports WHERE port > 1024;"},
+		{name: "missing", vars: map[string]string{"min_prot": "1024"}, wantErr: "min_port"},
+		{name: "unreferenced", vars: map[string]string{"min_port": "1024", "agent": "x"}, wantErr: "not referenced by any query: agent"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mm := newQueries()
+			c.Vars = tc.vars
+			err := Apply(mm, c)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("Apply() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() = %v", err)
+			}
+			if got := mm["listeners"].Query; got != tc.want {
+				t.Errorf("Query = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplySplay(t *testing.T) {
+	newQueries := func() map[string]*Metadata {
+		mm := map[string]*Metadata{}
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("q%d", i)
+			mm[name] = &Metadata{Name: name, Query: "SELECT 1;", Interval: "3600"}
+		}
+		// Intervals at the bounds may only move inwards
+		mm["fast"] = &Metadata{Name: "fast", Query: "SELECT 1;", Interval: "60"}
+		mm["slow"] = &Metadata{Name: "slow", Query: "SELECT 1;", Interval: "86400"}
+		return mm
+	}
+	c := Config{MinInterval: time.Minute, MaxInterval: 24 * time.Hour, Splay: 0.1}
+
+	first := newQueries()
+	if err := Apply(first, c); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	second := newQueries()
+	if err := Apply(second, c); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+
+	distinct := map[string]bool{}
+	for name, m := range first {
+		if m.Interval != second[name].Interval {
+			t.Errorf("%s interval = %s, then %s; want the same on every run", name, m.Interval, second[name].Interval)
+		}
+
+		i, err := strconv.Atoi(m.Interval)
+		if err != nil {
+			t.Fatalf("%s interval %q: %v", name, m.Interval, err)
+		}
+		if i < 60 || i > 86400 {
+			t.Errorf("%s interval = %d, want within [60, 86400]", name, i)
+		}
+		if strings.HasPrefix(name, "q") {
+			if i < 3240 || i > 3960 {
+				t.Errorf("%s interval = %d, want within 10%% of 3600", name, i)
+			}
+			distinct[m.Interval] = true
+		}
+	}
+
+	if len(distinct) < 10 {
+		t.Errorf("got %d distinct intervals for 50 queries, want them spread out: %v", len(distinct), distinct)
+	}
+}
+
+func TestApplyReport(t *testing.T) {
+	mm := map[string]*Metadata{
+		"rapid":  {Name: "rapid", Interval: "5"},
+		"odd":    {Name: "odd", Interval: "3500"},
+		"normal": {Name: "normal", Interval: "3600"},
+		"legacy": {Name: "legacy"},
+	}
+	r := &ApplyReport{}
+	c := Config{MinInterval: 20 * time.Second, MaxInterval: 24 * time.Hour, RoundInterval: time.Hour, Exclude: []string{"legacy"}, Report: r}
+	if err := Apply(mm, c); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := &ApplyReport{
+		Clamps:     []ClampEvent{{Name: "rapid", Requested: 5, Clamped: 20, Bound: "min"}},
+		Queries:    4,
+		Overridden: map[string]bool{"rapid": true, "odd": true},
+		Excluded:   1,
+	}
+	if diff := cmp.Diff(want, r); diff != "" {
+		t.Errorf("report mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplySplayThenRound(t *testing.T) {
+	mm := map[string]*Metadata{}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("q%d", i)
+		mm[name] = &Metadata{Name: name, Query: "SELECT 1;", Interval: "3600"}
+	}
+	c := Config{MinInterval: time.Minute, MaxInterval: 24 * time.Hour, Splay: 0.1, RoundInterval: 5 * time.Minute}
+	if err := Apply(mm, c); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+
+	got := map[string]bool{}
+	for name, m := range mm {
+		i, err := strconv.Atoi(m.Interval)
+		if err != nil {
+			t.Fatalf("%s interval %q: %v", name, m.Interval, err)
+		}
+		if i%300 != 0 {
+			t.Errorf("%s interval = %d, want a multiple of 300", name, i)
+		}
+		got[m.Interval] = true
+	}
+
+	// Rounding must not undo the splay, which spreads hourly queries across the neighbouring multiples
+	want := map[string]bool{"3300": true, "3600": true, "3900": true}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("intervals mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyReferenced(t *testing.T) {
+	vars := map[string]string{"min_port": "1024", "agent": "x"}
+	referenced := map[string]bool{}
+	first := map[string]*Metadata{"users": {Name: "users", Interval: "3600", Query: "SELECT * FROM users;"}}
+	second := map[string]*Metadata{"listeners": {Name: "listeners", Interval: "3600", Query: "SELECT * FROM listening_ports WHERE port > {{.min_port}};"}}
+
+	c := Config{MaxInterval: 24 * time.Hour, Vars: vars, Referenced: referenced}
+	for _, mm := range []map[string]*Metadata{first, second} {
+		if err := Apply(mm, c); err != nil {
+			t.Fatalf("Apply() = %v, want unreferenced variables left to the caller", err)
+		}
+	}
+
+	if diff := cmp.Diff(map[string]bool{"min_port": true}, referenced); diff != "" {
+		t.Errorf("referenced mismatch (-want +got):\n%s", diff)
+	}
+	if err := UnusedVars(vars, referenced); err == nil || !strings.Contains(err.Error(), "not referenced by any query: agent") {
+		t.Errorf("UnusedVars() = %v, want error for agent", err)
+	}
+}
@@ -0,0 +1,130 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// rawObject is a JSON object which remembers the order of its keys.
+type rawObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func parseRawObject(bs []byte) (*rawObject, error) {
+	o := &rawObject{values: map[string]json.RawMessage{}}
+	d := json.NewDecoder(bytes.NewReader(bs))
+
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object, got %v", t)
+	}
+
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a key, got %v", t)
+		}
+
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		o.set(key, v)
+	}
+
+	if _, err := d.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected content after object")
+	}
+	return o, nil
+}
+
+func (o *rawObject) set(key string, v json.RawMessage) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+func (o *rawObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(kb)
+		b.WriteString(":")
+		b.Write(o.values[k])
+	}
+	b.WriteString("}")
+	return b.Bytes(), nil
+}
+
+// MergeSchedule adds or replaces the schedule entries of an osquery configuration with the queries of a pack,
+// preserving all other configuration, such as options and file_paths, and the order of existing keys.
+func MergeSchedule(conf []byte, p *Pack) ([]byte, error) {
+	o, err := parseRawObject(conf)
+	if err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+
+	schedule := &rawObject{values: map[string]json.RawMessage{}}
+	if raw, ok := o.values["schedule"]; ok && string(raw) != "null" {
+		schedule, err = parseRawObject(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse schedule: %w", err)
+		}
+	}
+
+	names := []string{}
+	for name := range p.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(p.Queries[name]); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		schedule.set(name, bytes.TrimSpace(b.Bytes()))
+	}
+
+	sb, err := schedule.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	o.set("schedule", sb)
+
+	ob, err := o.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, ob, "", "  "); err != nil {
+		return nil, fmt.Errorf("indent: %w", err)
+	}
+	out.WriteString("\n")
+	return out.Bytes(), nil
+}
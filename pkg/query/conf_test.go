@@ -0,0 +1,71 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeSchedule(t *testing.T) {
+	conf := `{
+  "options": {"host_identifier": "hostname", "schedule_splay_percent": 10},
+  "schedule": {
+    "uptime": {"query": "SELECT * FROM uptime;", "interval": 60},
+    "users": {"query": "SELECT * FROM users;", "interval": 3600}
+  },
+  "file_paths": {"etc": ["/etc/%%"]}
+}`
+
+	p := &Pack{Queries: map[string]*Metadata{
+		"users":     {Query: "SELECT uid, username FROM users;", Interval: "86400"},
+		"processes": {Query: "SELECT pid FROM processes WHERE name <> 'init';", Interval: "600", Platform: "linux"},
+	}}
+
+	got, err := MergeSchedule([]byte(conf), p)
+	if err != nil {
+		t.Fatalf("MergeSchedule: %v", err)
+	}
+
+	want := `{
+  "options": {
+    "host_identifier": "hostname",
+    "schedule_splay_percent": 10
+  },
+  "schedule": {
+    "uptime": {
+      "query": "SELECT * FROM uptime;",
+      "interval": 60
+    },
+    "users": {
+      "query": "SELECT uid, username FROM users;",
+      "interval": "86400"
+    },
+    "processes": {
+      "query": "SELECT pid FROM processes WHERE name <> 'init';",
+      "interval": "600",
+      "platform": "linux"
+    }
+  },
+  "file_paths": {
+    "etc": [
+      "/etc/%%"
+    ]
+  }
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("MergeSchedule() mismatch (-want +got):\n%s", diff)
+	}
+
+	got, err = MergeSchedule([]byte(`{"options": {"verbose": true}}`), p)
+	if err != nil {
+		t.Fatalf("MergeSchedule without schedule: %v", err)
+	}
+	o, err := parseRawObject(got)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if diff := cmp.Diff([]string{"options", "schedule"}, o.keys); diff != "" {
+		t.Errorf("keys mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,50 @@
+package query
+
+import (
+	"sort"
+	"strings"
+)
+
+// NormalizeQuery returns a canonical form of a query for comparison, based on its single-line form.
+// Comments are removed and whitespace is collapsed. If foldCase is set, text outside of quoted strings
+// is lowercased, so that keyword case does not matter.
+func NormalizeQuery(m *Metadata, foldCase bool) string {
+	sql := m.SingleLineQuery
+	if sql == "" {
+		sql = m.Query
+	}
+
+	words := []string{}
+	for _, t := range tokenize(sql) {
+		text := t.text
+		switch {
+		case strings.HasPrefix(text, "--"), strings.HasPrefix(text, "/*"):
+			continue
+		case foldCase && !strings.ContainsAny(text[:1], "'\"`"):
+			text = strings.ToLower(text)
+		}
+		words = append(words, text)
+	}
+	return strings.Join(words, " ")
+}
+
+// DuplicateQueries returns groups of query names that share the same normalized query. Names within
+// a group are sorted, and groups are sorted by their first name.
+func DuplicateQueries(mm map[string]*Metadata, foldCase bool) [][]string {
+	byQuery := map[string][]string{}
+	for name, m := range mm {
+		q := NormalizeQuery(m, foldCase)
+		byQuery[q] = append(byQuery[q], name)
+	}
+
+	groups := [][]string{}
+	for _, names := range byQuery {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		groups = append(groups, names)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
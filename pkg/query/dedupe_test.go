@@ -0,0 +1,38 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDuplicateQueries(t *testing.T) {
+	parse := func(name string, sql string) *Metadata {
+		m, err := Parse(name, []byte(sql))
+		if err != nil {
+			t.Fatalf("parse %s: %v", name, err)
+		}
+		return m
+	}
+
+	mm := map[string]*Metadata{
+		"users":        parse("users", "SELECT uid, username FROM users;"),
+		"users-copy":   parse("users-copy", "-- A copy\nSELECT uid,username\n  FROM users; -- again"),
+		"users-lower":  parse("users-lower", "select uid, username from users;"),
+		"named-root":   parse("named-root", "SELECT uid FROM users WHERE username = 'root';"),
+		"named-ROOT":   parse("named-ROOT", "SELECT uid FROM users WHERE username = 'ROOT';"),
+		"unrelated":    parse("unrelated", "SELECT pid FROM processes;"),
+		"users-spaced": parse("users-spaced", "SELECT  uid , username  FROM   users ;"),
+	}
+
+	want := [][]string{{"users", "users-copy", "users-spaced"}}
+	if diff := cmp.Diff(want, DuplicateQueries(mm, false)); diff != "" {
+		t.Errorf("DuplicateQueries() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Folding case must not conflate different string literals
+	want = [][]string{{"users", "users-copy", "users-lower", "users-spaced"}}
+	if diff := cmp.Diff(want, DuplicateQueries(mm, true)); diff != "" {
+		t.Errorf("DuplicateQueries(foldCase) mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,218 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// FieldChange is a change to a single field of a query.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// PackDiff describes the differences between the queries of two packs.
+type PackDiff struct {
+	Added   []string                 `json:"added"`
+	Removed []string                 `json:"removed"`
+	Changed map[string][]FieldChange `json:"changed"`
+}
+
+// Empty returns true if the packs have the same queries.
+func (d *PackDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffFields returns the fields of a query that are compared by DiffPacks, in display order.
+func diffFields(m *Metadata) [][2]string {
+	return [][2]string{
+		{"query", m.Query},
+		{"interval", m.Interval},
+		{"platform", m.Platform},
+		{"version", m.Version},
+		{"shard", strconv.Itoa(m.Shard)},
+		{"snapshot", strconv.FormatBool(m.Snapshot)},
+		{"removed", strconv.FormatBool(m.Removed)},
+		{"denylist", strconv.FormatBool(m.DenyList)},
+		{"description", m.Description},
+		{"value", m.Value},
+		{"author", m.Author},
+	}
+}
+
+// DiffPacks compares the queries of two packs by name.
+func DiffPacks(a *Pack, b *Pack) *PackDiff {
+	d := &PackDiff{Added: []string{}, Removed: []string{}, Changed: map[string][]FieldChange{}}
+
+	for name, am := range a.Queries {
+		bm, ok := b.Queries[name]
+		if !ok {
+			d.Removed = append(d.Removed, name)
+			continue
+		}
+
+		bf := diffFields(bm)
+		for i, f := range diffFields(am) {
+			if f[1] != bf[i][1] {
+				d.Changed[name] = append(d.Changed[name], FieldChange{Field: f[0], Old: f[1], New: bf[i][1]})
+			}
+		}
+	}
+
+	for name := range b.Queries {
+		if _, ok := a.Queries[name]; !ok {
+			d.Added = append(d.Added, name)
+		}
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// String renders the differences as a human-readable summary.
+func (d *PackDiff) String() string {
+	s := ""
+	for _, name := range d.Added {
+		s += fmt.Sprintf("+ %s\n", name)
+	}
+	for _, name := range d.Removed {
+		s += fmt.Sprintf("- %s\n", name)
+	}
+
+	names := []string{}
+	for name := range d.Changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s += fmt.Sprintf("~ %s\n", name)
+		for _, c := range d.Changed[name] {
+			s += fmt.Sprintf("    %s: %q -> %q\n", c.Field, c.Old, c.New)
+		}
+	}
+	return s
+}
+
+// RowChange is a row whose values changed between two results of a query.
+type RowChange struct {
+	Before Row `json:"before"`
+	After  Row `json:"after"`
+}
+
+// RowDiff describes the rows added, removed, and changed between two results of a query.
+type RowDiff struct {
+	Added   []Row       `json:"added"`
+	Removed []Row       `json:"removed"`
+	Changed []RowChange `json:"changed"`
+}
+
+// Empty returns true if the results have the same rows.
+func (d *RowDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// similarity returns the number of columns two rows have in common, or -1 if the rows are too
+// different to be considered the same row: they have different columns, or differ in more than half of them.
+func similarity(a Row, b Row) int {
+	if len(a) != len(b) {
+		return -1
+	}
+	same := 0
+	for k, v := range a {
+		bv, ok := b[k]
+		if !ok {
+			return -1
+		}
+		if v == bv {
+			same++
+		}
+	}
+	if same == 0 || len(a)-same > len(a)/2 {
+		return -1
+	}
+	return same
+}
+
+// withoutColumns returns a copy of a row without the ignored columns.
+func withoutColumns(r Row, ignore map[string]bool) Row {
+	out := Row{}
+	for k, v := range r {
+		if !ignore[k] {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// DiffRows compares the rows of two results of a query, regardless of order, after removing
+// volatile columns such as pid from each row. Duplicate rows are counted. A removed row is paired with
+// the most similar added row, if any, and reported as changed when they differ in at most half of their columns.
+func DiffRows(before []Row, after []Row, ignoreColumns []string) *RowDiff {
+	ignore := map[string]bool{}
+	for _, c := range ignoreColumns {
+		ignore[c] = true
+	}
+
+	counts := map[string]int{}
+	for _, r := range before {
+		counts[withoutColumns(r, ignore).String()]++
+	}
+
+	d := &RowDiff{Added: []Row{}, Removed: []Row{}}
+	for _, r := range after {
+		nr := withoutColumns(r, ignore)
+		k := nr.String()
+		if counts[k] > 0 {
+			counts[k]--
+			continue
+		}
+		d.Added = append(d.Added, nr)
+	}
+
+	for _, r := range before {
+		br := withoutColumns(r, ignore)
+		k := br.String()
+		if counts[k] > 0 {
+			counts[k]--
+			d.Removed = append(d.Removed, br)
+		}
+	}
+
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].String() < d.Added[j].String() })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].String() < d.Removed[j].String() })
+
+	d.Changed = []RowChange{}
+	paired := map[int]bool{}
+	removed := []Row{}
+	for _, br := range d.Removed {
+		best, bestSame := -1, -1
+		for i, ar := range d.Added {
+			if paired[i] {
+				continue
+			}
+			if same := similarity(br, ar); same > bestSame {
+				best, bestSame = i, same
+			}
+		}
+		if best < 0 {
+			removed = append(removed, br)
+			continue
+		}
+		paired[best] = true
+		d.Changed = append(d.Changed, RowChange{Before: br, After: d.Added[best]})
+	}
+
+	added := []Row{}
+	for i, ar := range d.Added {
+		if !paired[i] {
+			added = append(added, ar)
+		}
+	}
+	d.Added = added
+	d.Removed = removed
+	return d
+}
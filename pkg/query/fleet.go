@@ -0,0 +1,104 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// plainYAML matches strings that are safe to emit as unquoted YAML scalars.
+	plainYAML = regexp.MustCompile(`^[A-Za-z0-9_(][A-Za-z0-9_ ()./,=*;'<>!%+-]*$`)
+	// nonStringYAML matches plain scalars that YAML would not read as a string.
+	nonStringYAML = regexp.MustCompile(`(?i)^(true|false|yes|no|on|off|null|~|[-+]?[0-9][0-9_.]*)$`)
+)
+
+// yamlScalar renders a single-line string as a YAML scalar, quoting it if necessary.
+func yamlScalar(s string) string {
+	if plainYAML.MatchString(s) && strings.TrimSpace(s) == s && !nonStringYAML.MatchString(s) {
+		return s
+	}
+	// JSON strings are valid double-quoted YAML scalars
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return strconv.Quote(s)
+	}
+	return string(bs)
+}
+
+// fleetPlatforms returns the Fleet platform list for a query, where an empty string means every platform.
+func fleetPlatforms(m *Metadata) string {
+	ps := []string{}
+	seen := map[string]bool{}
+	for _, p := range m.Platforms() {
+		expanded := []string{p}
+		switch p {
+		case "any", "all":
+			return ""
+		case "posix":
+			expanded = []string{"darwin", "linux"}
+		}
+		for _, e := range expanded {
+			if !seen[e] {
+				seen[e] = true
+				ps = append(ps, e)
+			}
+		}
+	}
+	sort.Strings(ps)
+	return strings.Join(ps, ",")
+}
+
+// RenderFleetYAML renders the queries of a pack as Fleet query documents, one YAML document per query.
+func RenderFleetYAML(p *Pack) ([]byte, error) {
+	names := []string{}
+	for name := range p.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	docs := []string{}
+	for _, name := range names {
+		m := p.Queries[name]
+
+		lines := []string{
+			"apiVersion: v1",
+			"kind: query",
+			"spec:",
+			"  name: " + yamlScalar(name),
+		}
+
+		if m.Description != "" {
+			lines = append(lines, "  description: "+yamlScalar(m.Description))
+		}
+
+		query := strings.TrimSpace(m.Query)
+		if strings.Contains(query, "\n") {
+			lines = append(lines, "  query: |-")
+			for _, l := range strings.Split(query, "\n") {
+				lines = append(lines, strings.TrimRight("    "+l, " "))
+			}
+		} else {
+			lines = append(lines, "  query: "+yamlScalar(query))
+		}
+
+		if m.Interval != "" {
+			interval, err := strconv.Atoi(m.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("%q: interval %q is not a number of seconds", name, m.Interval)
+			}
+			lines = append(lines, fmt.Sprintf("  interval: %d", interval))
+		}
+
+		if platforms := fleetPlatforms(m); platforms != "" {
+			lines = append(lines, "  platform: "+yamlScalar(platforms))
+		}
+
+		docs = append(docs, strings.Join(lines, "\n"))
+	}
+
+	return []byte("---\n" + strings.Join(docs, "\n---\n")), nil
+}
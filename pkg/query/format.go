@@ -0,0 +1,175 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"unicode"
+)
+
+// Formatter reformats SQL into a canonical form.
+type Formatter interface {
+	Format(sql string) (string, error)
+}
+
+// CommandFormatter formats SQL by piping it through an external command, such as "sqlformat -r -k upper -".
+type CommandFormatter struct {
+	Command []string
+}
+
+// Format sends the SQL to the command via stdin, and returns its output.
+func (f *CommandFormatter) Format(sql string) (string, error) {
+	if len(f.Command) == 0 {
+		return "", fmt.Errorf("no formatter command")
+	}
+
+	cmd := exec.Command(f.Command[0], f.Command[1:]...)
+	cmd.Stdin = strings.NewReader(sql)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s [%w]: %s", cmd, err, stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ClauseFormatter is a simple formatter which collapses whitespace and places each top-level clause on its own line.
+type ClauseFormatter struct{}
+
+// clauseKeywords start a new line when found outside of parentheses.
+var clauseKeywords = map[string]bool{
+	"SELECT": true,
+	"FROM":   true,
+	"WHERE":  true,
+	"GROUP":  true,
+	"HAVING": true,
+	"ORDER":  true,
+	"LIMIT":  true,
+	"UNION":  true,
+	"JOIN":   true,
+}
+
+// joinModifiers may precede JOIN, and start an indented line.
+var joinModifiers = map[string]bool{
+	"LEFT":    true,
+	"INNER":   true,
+	"CROSS":   true,
+	"OUTER":   true,
+	"NATURAL": true,
+}
+
+// keywords are uppercased when found alongside clause keywords.
+var keywords = map[string]bool{
+	"BY":  true,
+	"ALL": true,
+}
+
+type sqlToken struct {
+	text       string
+	spaceAfter bool
+	depth      int
+}
+
+// tokenize splits SQL into words, quoted strings, comments, and punctuation.
+func tokenize(sql string) []sqlToken {
+	rs := []rune(sql)
+	tokens := []sqlToken{}
+	depth := 0
+
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.$*", r)
+	}
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			if len(tokens) > 0 {
+				tokens[len(tokens)-1].spaceAfter = true
+			}
+			i++
+			continue
+		case r == '\'' || r == '"' || r == '`':
+			i++
+			for i < len(rs) {
+				if rs[i] == r {
+					// doubled quotes are escapes
+					if i+1 < len(rs) && rs[i+1] == r {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			i++
+		case r == '-' && i+1 < len(rs) && rs[i+1] == '-':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			i += 2
+			for i < len(rs) && !(rs[i-1] == '*' && rs[i] == '/' && i-1 > start+1) {
+				i++
+			}
+			i++
+		case isWord(r):
+			for i < len(rs) && isWord(rs[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+
+		if i > len(rs) {
+			i = len(rs)
+		}
+		text := string(rs[start:i])
+		if text == ")" {
+			depth--
+		}
+		tokens = append(tokens, sqlToken{text: text, depth: depth})
+		if text == "(" {
+			depth++
+		}
+	}
+	return tokens
+}
+
+// Format reformats the SQL, leaving quoted strings untouched.
+func (f *ClauseFormatter) Format(sql string) (string, error) {
+	var sb strings.Builder
+	prev := ""
+	tokens := tokenize(sql)
+
+	for i, t := range tokens {
+		text := t.text
+		upper := strings.ToUpper(text)
+		clause := t.depth == 0 && (clauseKeywords[upper] || joinModifiers[upper])
+
+		if clause || keywords[upper] && clauseKeywords[prev] {
+			text = upper
+		}
+
+		switch {
+		case i == 0:
+		case clause && (joinModifiers[upper] || upper == "JOIN") && !joinModifiers[prev]:
+			sb.WriteString("\n  ")
+		case clause && !joinModifiers[prev] && upper != "JOIN" && !joinModifiers[upper]:
+			sb.WriteString("\n")
+		case strings.HasPrefix(tokens[i-1].text, "--"):
+			sb.WriteString("\n")
+		case tokens[i-1].spaceAfter:
+			sb.WriteString(" ")
+		}
+
+		sb.WriteString(text)
+		prev = upper
+	}
+	return sb.String(), nil
+}
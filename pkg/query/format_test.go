@@ -0,0 +1,63 @@
+package query
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClauseFormatter(t *testing.T) {
+	messy := `select   p.name, count(*) AS n
+	from processes p left   join users u ON p.uid = u.uid
+   join (SELECT * FROM groups where gid > 0) g ON u.gid = g.gid
+WHERE p.name   != 'select  from   where' group by p.name
+order by n DESC limit 10;`
+
+	want := `SELECT p.name, count(*) AS n
+FROM processes p
+  LEFT JOIN users u ON p.uid = u.uid
+  JOIN (SELECT * FROM groups where gid > 0) g ON u.gid = g.gid
+WHERE p.name != 'select  from   where'
+GROUP BY p.name
+ORDER BY n DESC
+LIMIT 10;`
+
+	got, err := (&ClauseFormatter{}).Format(messy)
+	if err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Format() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Formatting should be idempotent
+	again, err := (&ClauseFormatter{}).Format(got)
+	if err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if diff := cmp.Diff(want, again); diff != "" {
+		t.Errorf("Format() not idempotent (-want +got):\n%s", diff)
+	}
+}
+
+func TestCommandFormatter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub formatter requires a POSIX shell")
+	}
+
+	stub := filepath.Join(t.TempDir(), "fmt")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\ntr 'a-z' 'A-Z'\n"), 0o700); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err := (&CommandFormatter{Command: []string{stub}}).Format("select 1;\n")
+	if err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if want := "SELECT 1;"; got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package query
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is a single gitignore-style pattern from an ignore file.
+type ignoreRule struct {
+	// base is the directory containing the ignore file
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreMatcher tracks the ignore rules found while walking a directory tree.
+type ignoreMatcher struct {
+	filename string
+	root     string
+	rules    map[string][]ignoreRule
+}
+
+func newIgnoreMatcher(root string, filename string) *ignoreMatcher {
+	return &ignoreMatcher{filename: filename, root: filepath.Clean(root), rules: map[string][]ignoreRule{}}
+}
+
+// loadDir loads the ignore file within a directory, if one exists.
+func (im *ignoreMatcher) loadDir(dir string) error {
+	if im.filename == "" {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(dir, im.filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r := ignoreRule{base: filepath.Clean(dir)}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return fmt.Errorf("%s: bad pattern %q: %w", f.Name(), line, err)
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+
+	im.rules[filepath.Clean(dir)] = rules
+	return scanner.Err()
+}
+
+// ignored returns true if the path should be skipped. Rules in deeper directories take precedence,
+// and within a file the last matching rule wins.
+func (im *ignoreMatcher) ignored(p string, isDir bool) bool {
+	p = filepath.Clean(p)
+
+	dirs := []string{}
+	for d := filepath.Dir(p); ; d = filepath.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+		if d == im.root || d == filepath.Dir(d) {
+			break
+		}
+	}
+
+	ignored := false
+	for _, d := range dirs {
+		for _, r := range im.rules[d] {
+			if r.matches(p, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (r ignoreRule) matches(p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	rel, err := filepath.Rel(r.base, p)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, where "**" matches any number of segments.
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
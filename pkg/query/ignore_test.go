@@ -0,0 +1,57 @@
+package query
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadFromDirIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".osqtoolignore":        "# work in progress\ndraft/\n*.wip.sql\n",
+		"users.sql":             "SELECT * FROM users;",
+		"draft/groups.sql":      "SELECT * FROM groups;",
+		"processes.wip.sql":     "SELECT * FROM processes;",
+		"sub/.osqtoolignore":    "!mounts.wip.sql\n",
+		"sub/mounts.wip.sql":    "SELECT * FROM mounts;",
+		"sub/listening.wip.sql": "SELECT * FROM listening_ports;",
+		"sub/deep/draft/x.sql":  "SELECT 1;",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	mm, err := LoadFromDirWithConfig(dir, &ParseConfig{IgnoreFile: ".osqtoolignore"})
+	if err != nil {
+		t.Fatalf("LoadFromDir: %v", err)
+	}
+
+	got := []string{}
+	for name := range mm {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+
+	want := []string{"mounts.wip", "users"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("LoadFromDir() names mismatch (-want +got):\n%s", diff)
+	}
+
+	mm, err = LoadFromDir(dir)
+	if err != nil {
+		t.Fatalf("LoadFromDir: %v", err)
+	}
+	if len(mm) != 6 {
+		t.Errorf("LoadFromDir() without ignore file loaded %d queries, want 6", len(mm))
+	}
+}
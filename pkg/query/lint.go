@@ -0,0 +1,224 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Severity is how serious a lint finding is.
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Finding is an issue found within a query by a lint rule.
+type Finding struct {
+	Query    string
+	Rule     string
+	Severity Severity
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: [%s] %s: %s", f.Query, f.Severity, f.Rule, f.Message)
+}
+
+// LintRule checks a query for an issue, such as a missing description.
+type LintRule interface {
+	// ID is a short unique name for the rule, such as "select-star".
+	ID() string
+	// Check returns the findings for a query, or nil if there are none.
+	Check(m *Metadata) []Finding
+}
+
+var (
+	lintMu    sync.Mutex
+	lintRules = map[string]LintRule{}
+)
+
+func init() {
+	for _, r := range []LintRule{missingDescription{}, selectStar{}, leadingWildcard{}, missingWhere{}, missingSemicolon{}} {
+		if err := RegisterLintRule(r); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterLintRule adds a rule to the set run by Lint, for example to enforce an organization-specific policy.
+func RegisterLintRule(r LintRule) error {
+	lintMu.Lock()
+	defer lintMu.Unlock()
+
+	if r.ID() == "" {
+		return fmt.Errorf("lint rule has no ID")
+	}
+	if lintRules[r.ID()] != nil {
+		return fmt.Errorf("lint rule %q is already registered", r.ID())
+	}
+	lintRules[r.ID()] = r
+	return nil
+}
+
+// LintRules returns the registered lint rules, sorted by ID.
+func LintRules() []LintRule {
+	lintMu.Lock()
+	defer lintMu.Unlock()
+
+	rs := []LintRule{}
+	for _, r := range lintRules {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ID() < rs[j].ID() })
+	return rs
+}
+
+// Lint runs the registered lint rules against a query.
+func Lint(m *Metadata) []Finding {
+	fs := []Finding{}
+	for _, r := range LintRules() {
+		for _, f := range r.Check(m) {
+			if f.Query == "" {
+				f.Query = m.Name
+			}
+			if f.Rule == "" {
+				f.Rule = r.ID()
+			}
+			if f.Severity == "" {
+				f.Severity = SeverityWarning
+			}
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// missingDescription flags queries without a description.
+type missingDescription struct{}
+
+func (missingDescription) ID() string { return "missing-description" }
+
+func (missingDescription) Check(m *Metadata) []Finding {
+	if strings.TrimSpace(m.Description) != "" {
+		return nil
+	}
+	return []Finding{{Message: "query has no description"}}
+}
+
+// selectStar flags queries selecting every column, as new columns in osquery upgrades change the results.
+type selectStar struct{}
+
+func (selectStar) ID() string { return "select-star" }
+
+func (selectStar) Check(m *Metadata) []Finding {
+	prev := ""
+	for _, t := range tokenize(m.Query) {
+		if prev == "SELECT" && (t.text == "*" || strings.HasSuffix(t.text, ".*")) {
+			return []Finding{{Message: "SELECT * returns unstable columns; list the columns you need"}}
+		}
+		prev = strings.ToUpper(t.text)
+	}
+	return nil
+}
+
+// leadingWildcard flags LIKE patterns starting with %, which can not use an index.
+type leadingWildcard struct{}
+
+func (leadingWildcard) ID() string { return "leading-wildcard" }
+
+func (leadingWildcard) Check(m *Metadata) []Finding {
+	fs := []Finding{}
+	tokens := tokenize(m.Query)
+	for i, t := range tokens {
+		if !strings.EqualFold(t.text, "LIKE") || i+1 == len(tokens) {
+			continue
+		}
+		if p := tokens[i+1].text; strings.HasPrefix(p, "'%") || strings.HasPrefix(p, `"%`) {
+			fs = append(fs, Finding{Message: fmt.Sprintf("LIKE %s has a leading wildcard, which requires a full scan", p)})
+		}
+	}
+	return fs
+}
+
+// largeTables are tables which are expensive to scan without constraints, and how serious an unconstrained scan is.
+var largeTables = map[string]Severity{
+	"file":                SeverityError,
+	"hash":                SeverityError,
+	"yara":                SeverityError,
+	"bpf_process_events":  SeverityWarning,
+	"bpf_socket_events":   SeverityWarning,
+	"es_process_events":   SeverityWarning,
+	"file_events":         SeverityWarning,
+	"hardware_events":     SeverityWarning,
+	"ntfs_journal_events": SeverityWarning,
+	"process_events":      SeverityWarning,
+	"socket_events":       SeverityWarning,
+}
+
+// missingWhere flags queries of large tables without a WHERE clause.
+type missingWhere struct{}
+
+func (missingWhere) ID() string { return "missing-where" }
+
+func (missingWhere) Check(m *Metadata) []Finding {
+	tables := []string{}
+	prev := ""
+	for _, t := range tokenize(m.Query) {
+		upper := strings.ToUpper(t.text)
+		if upper == "WHERE" {
+			return nil
+		}
+		if prev == "FROM" || prev == "JOIN" {
+			tables = append(tables, strings.ToLower(t.text))
+		}
+		prev = upper
+	}
+
+	fs := []Finding{}
+	for _, t := range tables {
+		if sev, ok := largeTables[t]; ok {
+			fs = append(fs, Finding{Severity: sev, Message: fmt.Sprintf("%s is scanned without a WHERE clause", t)})
+		}
+	}
+	return fs
+}
+
+// missingSemicolon flags queries which Parse had to terminate with a semicolon.
+type missingSemicolon struct{}
+
+func (missingSemicolon) ID() string { return "missing-semicolon" }
+
+func (missingSemicolon) Check(m *Metadata) []Finding {
+	if !m.MissingSemicolon {
+		return nil
+	}
+	return []Finding{{Message: "query does not end with a semicolon"}}
+}
+
+// BannedFunctions flags calls to SQL functions which are not permitted, such as those provided by extensions.
+type BannedFunctions struct {
+	Names []string
+}
+
+func (BannedFunctions) ID() string { return "banned-function" }
+
+func (b BannedFunctions) Check(m *Metadata) []Finding {
+	banned := map[string]bool{}
+	for _, n := range b.Names {
+		if n = strings.TrimSpace(n); n != "" {
+			banned[strings.ToLower(n)] = true
+		}
+	}
+
+	fs := []Finding{}
+	tokens := tokenize(m.Query)
+	for i, t := range tokens {
+		if i+1 < len(tokens) && tokens[i+1].text == "(" && banned[strings.ToLower(t.text)] {
+			fs = append(fs, Finding{Severity: SeverityError, Message: fmt.Sprintf("call to banned function %s()", t.text)})
+		}
+	}
+	return fs
+}
@@ -0,0 +1,148 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// noCron is a trivial custom rule, as an organization might register.
+type noCron struct{}
+
+func (noCron) ID() string { return "acme-no-crontab" }
+
+func (noCron) Check(m *Metadata) []Finding {
+	if strings.Contains(m.Query, "crontab") {
+		return []Finding{{Severity: SeverityError, Message: "crontab is banned"}}
+	}
+	return nil
+}
+
+func TestLint(t *testing.T) {
+	if err := RegisterLintRule(noCron{}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	t.Cleanup(func() {
+		lintMu.Lock()
+		delete(lintRules, noCron{}.ID())
+		lintMu.Unlock()
+	})
+
+	if err := RegisterLintRule(noCron{}); err == nil {
+		t.Errorf("RegisterLintRule() = nil error, want duplicate error")
+	}
+
+	m, err := Parse("cron", []byte("SELECT c.* FROM crontab c;"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := []Finding{
+		{Query: "cron", Rule: "acme-no-crontab", Severity: SeverityError, Message: "crontab is banned"},
+		{Query: "cron", Rule: "missing-description", Severity: SeverityWarning, Message: "query has no description"},
+		{Query: "cron", Rule: "select-star", Severity: SeverityWarning, Message: "SELECT * returns unstable columns; list the columns you need"},
+	}
+	if diff := cmp.Diff(want, Lint(m)); diff != "" {
+		t.Errorf("Lint() mismatch (-want +got):\n%s", diff)
+	}
+
+	m, err = Parse("users", []byte("-- Local users\nSELECT username, 'SELECT *' AS note FROM users;"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if diff := cmp.Diff([]Finding{}, Lint(m)); diff != "" {
+		t.Errorf("Lint() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestBannedFunctions(t *testing.T) {
+	rule := BannedFunctions{Names: []string{"readfile", "curl"}}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []Finding
+	}{
+		{
+			name:  "call",
+			query: "SELECT ReadFile (path) AS content FROM file WHERE path = '/etc/passwd';",
+			want:  []Finding{{Severity: SeverityError, Message: "call to banned function ReadFile()"}},
+		},
+		{
+			name:  "string literal",
+			query: "SELECT path FROM file WHERE path LIKE '%readfile(%';",
+			want:  []Finding{},
+		},
+		{
+			name:  "comment",
+			query: "SELECT path /* not readfile(path) */ FROM file; -- curl(url)",
+			want:  []Finding{},
+		},
+		{
+			name:  "column",
+			query: "SELECT curl FROM acme_agents;",
+			want:  []Finding{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, rule.Check(&Metadata{Query: tc.query})); diff != "" {
+				t.Errorf("Check() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuiltinRules(t *testing.T) {
+	tests := []struct {
+		rule  LintRule
+		query string
+		want  []Finding
+	}{
+		{
+			rule:  leadingWildcard{},
+			query: "SELECT name FROM processes WHERE cmdline LIKE '%curl%' OR name LIKE 'bash%';",
+			want:  []Finding{{Message: "LIKE '%curl%' has a leading wildcard, which requires a full scan"}},
+		},
+		{
+			rule:  missingWhere{},
+			query: "SELECT path, sha256 FROM hash JOIN processes USING (path);",
+			want:  []Finding{{Severity: SeverityError, Message: "hash is scanned without a WHERE clause"}},
+		},
+		{
+			rule:  missingWhere{},
+			query: "SELECT path FROM process_events;",
+			want:  []Finding{{Severity: SeverityWarning, Message: "process_events is scanned without a WHERE clause"}},
+		},
+		{
+			rule:  missingWhere{},
+			query: "SELECT sha256 FROM hash WHERE path = '/bin/sh';",
+			want:  nil,
+		},
+		{
+			rule:  missingSemicolon{},
+			query: "SELECT uid FROM users",
+			want:  []Finding{{Message: "query does not end with a semicolon"}},
+		},
+		{
+			rule:  missingSemicolon{},
+			query: "SELECT uid FROM users;",
+			want:  nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.rule.ID()+"/"+tc.query, func(t *testing.T) {
+			m, err := Parse("q", []byte(tc.query))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, tc.rule.Check(m), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Check() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Orders in which RenderPack may serialize queries.
+const (
+	// OrderByName sorts queries by name, and is the default.
+	OrderByName = "name"
+	// OrderByPlatform groups queries by platform, and then sorts them by name.
+	OrderByPlatform = "platform-then-name"
+	// OrderByInterval sorts queries by ascending interval, and then by name. Non-numeric intervals are last.
+	OrderByInterval = "interval"
+)
+
+// SortQueries returns the names of queries in the given order.
+func SortQueries(mm map[string]*Metadata, order string) ([]string, error) {
+	names := make([]string, 0, len(mm))
+	for name := range mm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch order {
+	case "", OrderByName:
+	case OrderByPlatform:
+		sort.SliceStable(names, func(i, j int) bool { return mm[names[i]].Platform < mm[names[j]].Platform })
+	case OrderByInterval:
+		seconds := func(name string) (int, bool) {
+			i, err := strconv.Atoi(mm[name].Interval)
+			return i, err == nil
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			si, iok := seconds(names[i])
+			sj, jok := seconds(names[j])
+			if iok != jok {
+				return iok
+			}
+			return si < sj
+		})
+	default:
+		return nil, fmt.Errorf("unknown order %q, want %s, %s, or %s", order, OrderByName, OrderByPlatform, OrderByInterval)
+	}
+	return names, nil
+}
+
+// orderedQueries is a set of queries that serializes as a JSON object with its keys in slice order.
+type orderedQueries struct {
+	names []string
+	mm    map[string]*Metadata
+}
+
+func (o orderedQueries) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	buf.WriteByte('{')
+	for i, name := range o.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := enc.Encode(name); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := enc.Encode(o.mm[name]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// orderedPack mirrors the fields of Pack, with its queries in a chosen order.
+type orderedPack struct {
+	Queries   *orderedQueries `json:"queries,omitempty"`
+	Discovery []string        `json:"discovery,omitempty"`
+	Shard     int             `json:"shard,omitempty"`
+	Platform  string          `json:"platform,omitempty"`
+	Version   string          `json:"version,omitempty"`
+	Oncall    string          `json:"oncall,omitempty"`
+}
+
+// newOrderedPack returns a pack that serializes its queries in the given order.
+func newOrderedPack(p *Pack, order string) (*orderedPack, error) {
+	op := &orderedPack{Discovery: p.Discovery, Shard: p.Shard, Platform: p.Platform, Version: p.Version, Oncall: p.Oncall}
+	if len(p.Queries) == 0 {
+		return op, nil
+	}
+
+	names, err := SortQueries(p.Queries, order)
+	if err != nil {
+		return nil, err
+	}
+	op.Queries = &orderedQueries{names: names, mm: p.Queries}
+	return op, nil
+}
@@ -4,38 +4,45 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"k8s.io/klog/v2"
 )
 
 type Pack struct {
-	Queries   map[string]*Metadata `json:"queries,omitempty"`
-	Discovery map[string]*Metadata `json:"discovery,omitempty"`
+	Queries map[string]*Metadata `json:"queries,omitempty"`
+	// Discovery queries gate the pack: osquery only schedules it if each of them returns a row.
+	Discovery []string `json:"discovery,omitempty"`
 
 	// Refer to obj.HasMember() calls in osquery/config/packs.cpp
 	Shard    int    `json:"shard,omitempty"`
 	Platform string `json:"platform,omitempty"`
 	Version  string `json:"version,omitempty"`
 	Oncall   string `json:"oncall,omitempty"`
+
+	// Includes are the packs named by "-- include: path" lines, which LoadPack merges into this one.
+	Includes []string `json:"-"`
 }
 
-// FlattenPacks flattens an array of Pack objects
+// FlattenPacks flattens an array of Pack objects. Queries from later packs replace those of the same
+// name from earlier packs, as do pack-level fields. Discovery queries are combined, skipping duplicates.
 func FlattenPacks(ps []*Pack) *Pack {
-	var c *Pack
+	c := &Pack{
+		Queries: map[string]*Metadata{},
+	}
 
 	for _, p := range ps {
 		for k, v := range p.Queries {
 			c.Queries[k] = v
 		}
-		for k, v := range p.Discovery {
-			c.Discovery[k] = v
-		}
+		c.Discovery = appendDiscovery(c.Discovery, p.Discovery...)
 
 		c.Shard = p.Shard
 		c.Platform = p.Platform
@@ -46,30 +53,130 @@ func FlattenPacks(ps []*Pack) *Pack {
 }
 
 type RenderConfig struct {
+	// SingleQuotes rewrites double-quoted strings within queries as single-quoted strings.
 	SingleQuotes bool
+	// ValidateJSON checks that the rendered pack is strictly valid JSON that round-trips the queries.
+	ValidateJSON bool
+	// CommentPrefix is the marker Render uses for description and directive lines, such as "#".
+	// The default is DefaultCommentPrefix.
+	CommentPrefix string
+	// Order is the order in which RenderPack serializes queries, such as OrderByPlatform. The default is OrderByName.
+	Order string
+}
+
+// commentPrefix returns the marker to use for description and directive lines.
+func (c *RenderConfig) commentPrefix() string {
+	if c == nil || c.CommentPrefix == "" {
+		return DefaultCommentPrefix
+	}
+	return c.CommentPrefix
+}
+
+// appendDiscovery appends discovery queries that are not already present.
+func appendDiscovery(discovery []string, queries ...string) []string {
+	seen := map[string]bool{}
+	for _, q := range discovery {
+		seen[q] = true
+	}
+	for _, q := range queries {
+		if !seen[q] {
+			seen[q] = true
+			discovery = append(discovery, q)
+		}
+	}
+	return discovery
 }
 
-// RenderPack renders an osquery pack file from a set of queries.
+// RenderPack renders an osquery pack file from a set of queries. A nil *RenderConfig uses the defaults.
 func RenderPack(pack *Pack, c *RenderConfig) ([]byte, error) {
-	out, err := json.MarshalIndent(pack, "", "  ")
-	if err != nil {
-		return out, err
+	if c == nil {
+		c = &RenderConfig{}
 	}
 
-	// This does not yet handle the case where someone double-quote:
-	// a single quote, for example: mdfind.query="item == 'latest'"
+	// Encode without HTML escaping, so that characters such as <, >, and & appear in queries as written.
+	// Control characters, including newlines, remain escaped.
 	if c.SingleQuotes {
-		out = bytes.ReplaceAll(out, []byte(`\"`), []byte("'"))
+		pack = singleQuotePack(pack)
+	}
+
+	op, err := newOrderedPack(pack, c.Order)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(op); err != nil {
+		return nil, err
+	}
+	out := multiLineQueries(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+
+	if c.ValidateJSON {
+		if err := validateJSON(pack, out); err != nil {
+			return out, fmt.Errorf("validate: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// multiLineQueries renders the escaped newlines of each query as osquery's line continuations.
+// Other fields, such as extended_description, keep their escaped newlines so that they remain valid JSON.
+func multiLineQueries(bs []byte) []byte {
+	lines := bytes.Split(bs, []byte("\n"))
+	for i, l := range lines {
+		if bytes.HasPrefix(bytes.TrimLeft(l, " "), []byte(`"query": `)) {
+			lines[i] = bytes.ReplaceAll(l, []byte(`\n`), []byte(" \\\n    "))
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// validateJSON checks that a rendered pack is valid JSON, and that each query survived unchanged.
+func validateJSON(pack *Pack, bs []byte) error {
+	got := &Pack{}
+	if err := json.Unmarshal(bs, got); err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			return fmt.Errorf("invalid JSON at offset %d: %w", se.Offset, err)
+		}
+		return err
 	}
-	out = bytes.ReplaceAll(out, []byte(`\u003e`), []byte(">"))
-	out = bytes.ReplaceAll(out, []byte(`\u003c`), []byte("<"))
-	out = bytes.ReplaceAll(out, []byte(`\u0026`), []byte("&"))
-	return bytes.ReplaceAll(out, []byte(`\n`), []byte(" \\\n    ")), nil
+
+	for name, m := range pack.Queries {
+		g := got.Queries[name]
+		if g == nil {
+			return fmt.Errorf("%q: missing from rendered output", name)
+		}
+		if g.Query != m.Query {
+			return fmt.Errorf("%q: query does not round-trip: got %q, want %q", name, g.Query, m.Query)
+		}
+	}
+	return nil
 }
 
-// LoadPack loads and parses an osquery pack file.
+var (
+	// workaround: cannot unmarshal number into Go struct field Metadata.queries.interval of type string
+	nakedInterval = regexp.MustCompile(`"interval"\s*:\s*(\d+),`)
+	trailingComma = regexp.MustCompile(`,(\s*[}\]])`)
+	// -- include: other.conf
+	includeDirective = regexp.MustCompile(`(?m)^[ \t]*--[ \t]*include:[ \t]*(.*?)[ \t]*$`)
+)
+
+// LoadPack loads and parses an osquery pack file, merging in any packs it includes.
 func LoadPack(path string) (*Pack, error) {
-	pack := &Pack{}
+	return LoadPackWithConfig(path, nil)
+}
+
+// LoadPackWithConfig loads a pack file like LoadPack. A nil *ParseConfig uses the defaults.
+func LoadPackWithConfig(path string, c *ParseConfig) (*Pack, error) {
+	return loadPack(path, c, nil)
+}
+
+// loadPack loads a pack and the packs it includes, relative to its directory. stack holds the
+// absolute paths of the packs that include this one, to detect cycles.
+func loadPack(path string, c *ParseConfig, stack []string) (*Pack, error) {
 	var err error
 	var bs []byte
 
@@ -83,17 +190,92 @@ func LoadPack(path string) (*Pack, error) {
 		return nil, fmt.Errorf("read: %v", err)
 	}
 
-	// workaround: invalid character '\n' in string escape code
-	// replace trailing \<newline> with \<escaped newline>
-	bs = bytes.ReplaceAll(bs, []byte("\\\n"), []byte("\\\\n"))
+	pack, err := ParsePack(bs, c)
+	if err != nil || len(pack.Includes) == 0 {
+		return pack, err
+	}
 
-	// workaround: cannot unmarshal number into Go struct field Metadata.queries.interval of type string
-	nakedInterval := regexp.MustCompile(`"interval"\s*:\s*(\d+),`)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stack {
+		if p == abs {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+		}
+	}
+	stack = append(stack, abs)
+
+	for _, inc := range pack.Includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(abs), inc)
+		}
+
+		sub, err := loadPack(inc, c, stack)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", inc, err)
+		}
+		for name, m := range sub.Queries {
+			if pack.Queries[name] != nil {
+				return nil, fmt.Errorf("include %s: conflict: %q already loaded", inc, name)
+			}
+			if pack.Queries == nil {
+				pack.Queries = map[string]*Metadata{}
+			}
+			pack.Queries[name] = m
+		}
+		pack.Discovery = appendDiscovery(pack.Discovery, sub.Discovery...)
+	}
+	return pack, nil
+}
+
+// ParsePack parses the content of an osquery pack file.
+func ParsePack(bs []byte, c *ParseConfig) (*Pack, error) {
+	if c == nil {
+		c = &ParseConfig{}
+	}
+	pack := &Pack{}
+
+	// Include directives are blanked out, preserving offsets for error messages
+	bs = includeDirective.ReplaceAllFunc(bs, func(line []byte) []byte {
+		pack.Includes = append(pack.Includes, string(includeDirective.FindSubmatch(line)[1]))
+		return bytes.Repeat([]byte(" "), len(line))
+	})
+
+	// Numeric intervals are valid JSON, so they are converted even in strict mode
 	bs = nakedInterval.ReplaceAll(bs, []byte("\"interval\": \"$1\","))
+	if c.RepairTrailingCommas && !c.StrictJSON {
+		bs = trailingComma.ReplaceAll(bs, []byte("$1"))
+	}
+
+	repaired := bs
+	offsets := make([]int, len(bs)+1)
+	for i := range offsets {
+		offsets[i] = i
+	}
+
+	// workaround: invalid character '\n' in string escape code
+	// replace trailing \<newline> with \<escaped newline>
+	if !c.StrictJSON {
+		repaired, offsets = repairContinuations(bs)
+	}
 
-	err = json.Unmarshal(bs, pack)
+	err := json.Unmarshal(repaired, pack)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal: %v", err)
+		offset := -1
+		var se *json.SyntaxError
+		var te *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &se):
+			offset = int(se.Offset)
+		case errors.As(err, &te):
+			offset = int(te.Offset)
+		}
+
+		if offset < 0 {
+			return nil, fmt.Errorf("unmarshal: %v", err)
+		}
+		return nil, fmt.Errorf("unmarshal: %v\n%s", err, snippet(bs, offsets[offset]))
 	}
 
 	// Final repairs
@@ -115,10 +297,68 @@ func LoadPack(path string) (*Pack, error) {
 	return pack, nil
 }
 
+// repairContinuations replaces trailing \<newline> line continuations with an escaped newline,
+// returning the offsets within the original content for each byte of the output.
+func repairContinuations(bs []byte) ([]byte, []int) {
+	out := make([]byte, 0, len(bs))
+	offsets := make([]int, 0, len(bs)+1)
+
+	for i := 0; i < len(bs); i++ {
+		if bs[i] == '\\' && i+1 < len(bs) && bs[i+1] == '\n' {
+			out = append(out, '\\', '\\', 'n')
+			offsets = append(offsets, i, i, i+1)
+			i++
+			continue
+		}
+		out = append(out, bs[i])
+		offsets = append(offsets, i)
+	}
+
+	offsets = append(offsets, len(bs))
+	return out, offsets
+}
+
+// snippet describes the location of an error after reading offset bytes, showing the surrounding lines.
+func snippet(bs []byte, offset int) string {
+	// The error is at the last byte read
+	if offset > 0 {
+		offset--
+	}
+	if offset > len(bs) {
+		offset = len(bs)
+	}
+
+	start := bytes.LastIndexByte(bs[:offset], '\n') + 1
+	end := bytes.IndexByte(bs[offset:], '\n')
+	if end < 0 {
+		end = len(bs)
+	} else {
+		end += offset
+	}
+
+	line := bytes.Count(bs[:offset], []byte("\n")) + 1
+	col := utf8.RuneCount(bs[start:offset]) + 1
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "at line %d, column %d:\n", line, col)
+	if start > 0 {
+		prevStart := bytes.LastIndexByte(bs[:start-1], '\n') + 1
+		fmt.Fprintf(&sb, "%5d | %s\n", line-1, bs[prevStart:start-1])
+	}
+	fmt.Fprintf(&sb, "%5d | %s\n", line, bs[start:end])
+	fmt.Fprintf(&sb, "      | %s^", strings.Repeat(" ", col-1))
+	return sb.String()
+}
+
 // SaveToDirectory saves a map of queries into a directory.
 func SaveToDirectory(mm map[string]*Metadata, destination string) error {
+	return SaveToDirectoryWithConfig(mm, destination, nil)
+}
+
+// SaveToDirectoryWithConfig saves a map of queries into a directory. A nil *RenderConfig uses the defaults.
+func SaveToDirectoryWithConfig(mm map[string]*Metadata, destination string, c *RenderConfig) error {
 	for name, m := range mm {
-		s, err := Render(m)
+		s, err := RenderWithConfig(m, c)
 		if err != nil {
 			return fmt.Errorf("render: %v", err)
 		}
@@ -133,3 +373,52 @@ func SaveToDirectory(mm map[string]*Metadata, destination string) error {
 	}
 	return nil
 }
+
+// DiscoveryDir is the subdirectory that SaveDiscovery writes discovery queries to, and LoadDiscovery reads them from.
+const DiscoveryDir = "discovery"
+
+// SaveDiscovery writes each discovery query to a numbered SQL file within the DiscoveryDir subdirectory of destination.
+func SaveDiscovery(queries []string, destination string) error {
+	if len(queries) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(destination, DiscoveryDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	for i, q := range queries {
+		path := filepath.Join(dir, fmt.Sprintf("%03d.sql", i+1))
+		klog.Infof("Writing discovery query to %s ...", path)
+		if err := os.WriteFile(path, []byte(strings.TrimSpace(q)+"\n"), 0o600); err != nil {
+			return fmt.Errorf("write file: %v", err)
+		}
+	}
+	return nil
+}
+
+// LoadDiscovery loads the discovery queries within the DiscoveryDir subdirectory of a directory, in file name order.
+// It returns no queries if the subdirectory does not exist.
+func LoadDiscovery(path string) ([]string, error) {
+	dir := filepath.Join(path, DiscoveryDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	queries := []string{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read: %v", err)
+		}
+		queries = append(queries, strings.TrimSpace(string(bytes.TrimPrefix(bs, utf8BOM))))
+	}
+	return queries, nil
+}
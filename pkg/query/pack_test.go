@@ -1,6 +1,11 @@
 package query
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -14,11 +19,12 @@ func TestLoad(t *testing.T) {
 	}
 
 	want := &Metadata{
-		Name:        "xprotect-reports",
-		Query:       "SELECT * FROM xprotect_reports;",
-		Interval:    "1200",
-		Description: "Returns a list of malware matches from macOS XProtect",
-		Platform:    "darwin",
+		Name:            "xprotect-reports",
+		Query:           "SELECT\n  *\nFROM\n  xprotect_reports;",
+		SingleLineQuery: "SELECT * FROM xprotect_reports;",
+		Interval:        "1200",
+		Description:     "Returns a list of malware matches from macOS XProtect",
+		Platform:        "darwin",
 	}
 
 	if diff := cmp.Diff(got, want, cmpopts.IgnoreUnexported(Metadata{})); diff != "" {
@@ -51,3 +57,434 @@ SELECT * FROM xprotect_reports;
 		t.Errorf("Load() got = %v, want %v\n diff: %s", got, want, diff)
 	}
 }
+
+func TestRenderPackValidateJSON(t *testing.T) {
+	valid := &Pack{Queries: map[string]*Metadata{
+		"braces": {Query: `SELECT json_extract('{"a": {"b": 1}}', '$.a.b') AS b;`},
+		"yara":   {Query: `SELECT * FROM yara WHERE sigrule = 'rule x { condition: true }';`},
+	}}
+	if _, err := RenderPack(valid, &RenderConfig{ValidateJSON: true}); err != nil {
+		t.Errorf("RenderPack() = %v, want no error", err)
+	}
+
+	multi := &Pack{Queries: map[string]*Metadata{
+		"braces": {Query: "SELECT json_extract('{\"a\": 1}', '$.a')\nFROM time;"},
+	}}
+	if _, err := RenderPack(multi, &RenderConfig{}); err != nil {
+		t.Errorf("RenderPack() without validation = %v, want no error", err)
+	}
+	_, err := RenderPack(multi, &RenderConfig{ValidateJSON: true})
+	if err == nil {
+		t.Fatalf("RenderPack() = nil, want invalid JSON error")
+	}
+	if !strings.Contains(err.Error(), "invalid JSON at offset") {
+		t.Errorf("RenderPack() error = %v, want offset", err)
+	}
+}
+
+func TestRenderPackExtendedDescription(t *testing.T) {
+	m, err := Parse("users", []byte("-- Local users\n--\n-- Lists accounts,\n-- including system accounts\nSELECT * FROM users;"))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	if !strings.Contains(m.ExtendedDescription, "\n") {
+		t.Fatalf("ExtendedDescription = %q, want multiple lines", m.ExtendedDescription)
+	}
+
+	bs, err := RenderPack(&Pack{Queries: map[string]*Metadata{"users": m}}, nil)
+	if err != nil {
+		t.Fatalf("RenderPack() = %v", err)
+	}
+	got := &Pack{}
+	if err := json.Unmarshal(bs, got); err != nil {
+		t.Fatalf("rendered pack is not valid JSON: %v\n%s", err, bs)
+	}
+	if got.Queries["users"].ExtendedDescription != m.ExtendedDescription {
+		t.Errorf("ExtendedDescription = %q, want %q", got.Queries["users"].ExtendedDescription, m.ExtendedDescription)
+	}
+}
+
+func TestRenderPackUnescaped(t *testing.T) {
+	p := &Pack{Queries: map[string]*Metadata{
+		"sockets": {Query: "SELECT * FROM process_open_sockets WHERE remote_port > 1024 AND state = 'ESTABLISHED' AND family & 2;"},
+		"quotes":  {Query: "SELECT * FROM users WHERE description = ‘admin’ AND shell LIKE '%\\u0026%';"},
+	}}
+	bs, err := RenderPack(p, &RenderConfig{ValidateJSON: true})
+	if err != nil {
+		t.Fatalf("RenderPack() = %v", err)
+	}
+
+	want := `{
+  "queries": {
+    "quotes": {
+      "query": "SELECT * FROM users WHERE description = ‘admin’ AND shell LIKE '%\\u0026%';"
+    },
+    "sockets": {
+      "query": "SELECT * FROM process_open_sockets WHERE remote_port > 1024 AND state = 'ESTABLISHED' AND family & 2;"
+    }
+  }
+}`
+	if diff := cmp.Diff(want, string(bs)); diff != "" {
+		t.Errorf("RenderPack() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRenderPackOrder(t *testing.T) {
+	p := &Pack{
+		Queries: map[string]*Metadata{
+			"users":    {Query: "SELECT uid FROM users;", Interval: "3600"},
+			"kmods":    {Query: "SELECT name FROM kernel_modules;", Interval: "600", Platform: "linux"},
+			"launchd":  {Query: "SELECT name FROM launchd;", Interval: "86400", Platform: "darwin"},
+			"auto":     {Query: "SELECT pid FROM processes;", Interval: AutoInterval},
+			"services": {Query: "SELECT name FROM services;", Interval: "600", Platform: "windows"},
+		},
+		Version: "5.0.0",
+	}
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{order: "", want: []string{"auto", "kmods", "launchd", "services", "users"}},
+		{order: OrderByName, want: []string{"auto", "kmods", "launchd", "services", "users"}},
+		{order: OrderByPlatform, want: []string{"auto", "users", "launchd", "kmods", "services"}},
+		{order: OrderByInterval, want: []string{"kmods", "services", "users", "launchd", "auto"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.order, func(t *testing.T) {
+			bs, err := RenderPack(p, &RenderConfig{Order: tc.order, ValidateJSON: true})
+			if err != nil {
+				t.Fatalf("RenderPack() = %v", err)
+			}
+
+			got := []string{}
+			for _, line := range strings.Split(string(bs), "\n") {
+				if strings.HasPrefix(line, "    \"") {
+					got = append(got, strings.Split(line, "\"")[1])
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("order mismatch (-want +got):\n%s", diff)
+			}
+			if !strings.HasSuffix(string(bs), "\"version\": \"5.0.0\"\n}") {
+				t.Errorf("RenderPack() = %s, want pack-level fields after the queries", bs)
+			}
+		})
+	}
+
+	if _, err := RenderPack(p, &RenderConfig{Order: "random"}); err == nil {
+		t.Errorf("RenderPack(random) = nil error, want unknown order")
+	}
+}
+
+func TestParsePackErrorLocation(t *testing.T) {
+	pack := `{
+  "queries": {
+    "users": {
+      "query": "SELECT * \
+        FROM users;",
+      "interval": 3600,
+    },
+  }
+}
+`
+	_, err := ParsePack([]byte(pack), nil)
+	if err == nil {
+		t.Fatalf("ParsePack() = nil error, want syntax error")
+	}
+	if !strings.Contains(err.Error(), "at line 7, column 5") {
+		t.Errorf("ParsePack() error = %v, want line 7, column 5", err)
+	}
+	if !strings.Contains(err.Error(), `    7 |     },`) {
+		t.Errorf("ParsePack() error = %v, want snippet", err)
+	}
+
+	p, err := ParsePack([]byte(pack), &ParseConfig{RepairTrailingCommas: true})
+	if err != nil {
+		t.Fatalf("ParsePack() with repair = %v", err)
+	}
+	if got := p.Queries["users"].Interval; got != "3600" {
+		t.Errorf("Interval = %q, want 3600", got)
+	}
+}
+
+func TestParsePackStrictJSON(t *testing.T) {
+	pack := `{
+  "queries": {
+    "users": {
+      "query": "SELECT * \
+        FROM users;",
+      "interval": "3600"
+    }
+  }
+}
+`
+	p, err := ParsePack([]byte(pack), nil)
+	if err != nil {
+		t.Fatalf("ParsePack() = %v, want multi-line workaround to apply", err)
+	}
+	if got := p.Queries["users"].SingleLineQuery; got != "SELECT * FROM users;" {
+		t.Errorf("SingleLineQuery = %q, want %q", got, "SELECT * FROM users;")
+	}
+
+	_, err = ParsePack([]byte(pack), &ParseConfig{StrictJSON: true})
+	if err == nil {
+		t.Fatalf("ParsePack() = nil error, want strict mode to reject multi-line query")
+	}
+	if !strings.Contains(err.Error(), "at line 4, column") {
+		t.Errorf("ParsePack() error = %v, want line 4", err)
+	}
+}
+
+func TestFlattenPacks(t *testing.T) {
+	a := &Pack{
+		Queries: map[string]*Metadata{
+			"users":     {Query: "SELECT * FROM users;", Interval: "3600"},
+			"processes": {Query: "SELECT * FROM processes;"},
+		},
+		Discovery: []string{"SELECT 1 FROM os_version WHERE platform = 'ubuntu';"},
+		Platform:  "linux",
+	}
+	b := &Pack{
+		Queries: map[string]*Metadata{
+			"users":     {Query: "SELECT uid FROM users;", Interval: "60"},
+			"processes": {Query: "SELECT pid FROM processes;"},
+			"uptime":    {Query: "SELECT * FROM uptime;"},
+		},
+		Discovery: []string{
+			"SELECT 1 FROM os_version WHERE platform = 'ubuntu';",
+			"SELECT pid FROM processes WHERE name = 'sshd';",
+		},
+		Version: "5.0.0",
+	}
+
+	// overlapping queries and pack-level fields are taken from the last pack, and discovery queries are combined
+	want := &Pack{
+		Queries: map[string]*Metadata{
+			"users":     {Query: "SELECT uid FROM users;", Interval: "60"},
+			"processes": {Query: "SELECT pid FROM processes;"},
+			"uptime":    {Query: "SELECT * FROM uptime;"},
+		},
+		Discovery: []string{
+			"SELECT 1 FROM os_version WHERE platform = 'ubuntu';",
+			"SELECT pid FROM processes WHERE name = 'sshd';",
+		},
+		Version: "5.0.0",
+	}
+	if diff := cmp.Diff(want, FlattenPacks([]*Pack{a, b})); diff != "" {
+		t.Errorf("FlattenPacks() mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(&Pack{Queries: map[string]*Metadata{}}, FlattenPacks(nil)); diff != "" {
+		t.Errorf("FlattenPacks(nil) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSplitPack(t *testing.T) {
+	p := &Pack{
+		Oncall:  "secops",
+		Version: "1.2.3",
+		Queries: map[string]*Metadata{
+			"users":     {Query: "SELECT uid FROM users;"},
+			"shells":    {Query: "SELECT pid FROM processes;", Platform: "posix"},
+			"xprotect":  {Query: "SELECT * FROM xprotect_reports;", Platform: "darwin"},
+			"services":  {Query: "SELECT name FROM services;", Platform: "windows"},
+			"kmods":     {Query: "SELECT name FROM kernel_modules;", Platform: "linux,darwin"},
+			"processes": {Query: "SELECT pid FROM processes;", Platform: "all"},
+		},
+	}
+
+	names := func(packs map[string]*Pack) map[string][]string {
+		got := map[string][]string{}
+		for platform, sp := range packs {
+			if sp.Oncall != p.Oncall || sp.Version != p.Version {
+				t.Errorf("%s pack = %+v, want pack-level fields preserved", platform, sp)
+			}
+			for name := range sp.Queries {
+				got[platform] = append(got[platform], name)
+			}
+			sort.Strings(got[platform])
+		}
+		return got
+	}
+
+	want := map[string][]string{
+		"any":     {"processes", "users"},
+		"posix":   {"shells"},
+		"darwin":  {"kmods", "xprotect"},
+		"linux":   {"kmods"},
+		"windows": {"services"},
+	}
+	if diff := cmp.Diff(want, names(SplitPack(p, false))); diff != "" {
+		t.Errorf("SplitPack() mismatch (-want +got):\n%s", diff)
+	}
+
+	want = map[string][]string{
+		"any":     {"processes", "users"},
+		"darwin":  {"kmods", "shells", "xprotect"},
+		"linux":   {"kmods", "shells"},
+		"windows": {"services"},
+	}
+	if diff := cmp.Diff(want, names(SplitPack(p, true))); diff != "" {
+		t.Errorf("SplitPack(expandPosix) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRenderFleetYAML(t *testing.T) {
+	p := &Pack{Queries: map[string]*Metadata{
+		"users": {Query: "SELECT uid, username FROM users;", Interval: "3600", Description: "Local users: who are they?"},
+		"shells": {
+			Query:    "SELECT p.pid\nFROM processes p\nWHERE p.name = 'sh';",
+			Interval: "600",
+			Platform: "posix,darwin",
+		},
+		"true": {Query: "SELECT 1;", Interval: "60", Platform: "all"},
+	}}
+
+	got, err := RenderFleetYAML(p)
+	if err != nil {
+		t.Fatalf("RenderFleetYAML() = %v", err)
+	}
+
+	want := `---
+apiVersion: v1
+kind: query
+spec:
+  name: shells
+  query: |-
+    SELECT p.pid
+    FROM processes p
+    WHERE p.name = 'sh';
+  interval: 600
+  platform: darwin,linux
+---
+apiVersion: v1
+kind: query
+spec:
+  name: "true"
+  query: SELECT 1;
+  interval: 60
+---
+apiVersion: v1
+kind: query
+spec:
+  name: users
+  description: "Local users: who are they?"
+  query: SELECT uid, username FROM users;
+  interval: 3600`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("RenderFleetYAML() mismatch (-want +got):\n%s", diff)
+	}
+
+	p.Queries["users"].Interval = "auto"
+	if _, err := RenderFleetYAML(p); err == nil {
+		t.Errorf("RenderFleetYAML() with non-numeric interval = nil error, want error")
+	}
+}
+
+func writePackFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestLoadPackIncludes(t *testing.T) {
+	dir := writePackFiles(t, map[string]string{
+		"top.conf": `-- include: teams/detection.conf
+{
+  "queries": {
+    "users": {"query": "SELECT * FROM users;", "interval": "3600"}
+  }
+}`,
+		"teams/detection.conf": `-- include: ../shared/base.conf
+{
+  "platform": "linux",
+  "queries": {
+    "shells": {"query": "SELECT * FROM processes WHERE name = 'sh';", "interval": "60"}
+  }
+}`,
+		"shared/base.conf": `{
+  "discovery": ["SELECT 1 FROM os_version;"],
+  "queries": {
+    "os": {"query": "SELECT * FROM os_version;", "interval": "86400"}
+  }
+}`,
+	})
+
+	p, err := LoadPack(filepath.Join(dir, "top.conf"))
+	if err != nil {
+		t.Fatalf("LoadPack() = %v", err)
+	}
+
+	got := map[string]string{}
+	for name, m := range p.Queries {
+		got[name] = m.Platform
+	}
+	want := map[string]string{"users": "", "shells": "linux", "os": ""}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("queries mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"SELECT 1 FROM os_version;"}, p.Discovery); diff != "" {
+		t.Errorf("discovery mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadPackIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name: "cycle",
+			files: map[string]string{
+				"top.conf": "-- include: a.conf\n{\"queries\": {}}",
+				"a.conf":   "-- include: b.conf\n{\"queries\": {}}",
+				"b.conf":   "-- include: a.conf\n{\"queries\": {}}",
+			},
+			wantErr: "include cycle",
+		},
+		{
+			name: "self",
+			files: map[string]string{
+				"top.conf": "-- include: top.conf\n{\"queries\": {}}",
+			},
+			wantErr: "include cycle",
+		},
+		{
+			name: "conflict",
+			files: map[string]string{
+				"top.conf": "-- include: a.conf\n{\"queries\": {\"users\": {\"query\": \"SELECT 1;\"}}}",
+				"a.conf":   "{\"queries\": {\"users\": {\"query\": \"SELECT 2;\"}}}",
+			},
+			wantErr: `conflict: "users" already loaded`,
+		},
+		{
+			name: "missing",
+			files: map[string]string{
+				"top.conf": "-- include: nope.conf\n{\"queries\": {}}",
+			},
+			wantErr: "nope.conf",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writePackFiles(t, tc.files)
+			_, err := LoadPack(filepath.Join(dir, "top.conf"))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("LoadPack() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
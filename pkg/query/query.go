@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/klog/v2"
 )
@@ -27,44 +31,191 @@ type Metadata struct {
 	// Custom fields
 	ExtendedDescription string   `json:"extended_description,omitempty"` // not an official field
 	Value               string   `json:"value,omitempty"`                // not an official field, but used in packs
+	Author              string   `json:"author,omitempty"`               // not an official field
 	Name                string   `json:"-"`
 	Tags                []string `json:"-"`
 
 	SingleLineQuery string `json:"-"`
+	// MissingSemicolon is set when the query did not end with a semicolon, which Parse adds unless NoAutoSemicolon is set.
+	MissingSemicolon bool `json:"-"`
+	// MinResults is the fewest rows the query is expected to return on a compatible platform, checked by verify.
+	MinResults int `json:"-"`
+}
+
+// AutoInterval is the interval directive value requesting that an interval be derived from the tables a query references.
+const AutoInterval = "auto"
+
+// ParseConfig controls how query files are parsed.
+type ParseConfig struct {
+	// PreserveComments keeps inline SQL comments within the query body.
+	PreserveComments bool
+	// RepairTrailingCommas removes trailing commas from objects and arrays when loading packs.
+	RepairTrailingCommas bool
+	// StrictJSON disables the repairs applied to invalid JSON packs, such as multi-line queries and trailing commas.
+	StrictJSON bool
+	// RichHeader treats the leading comment block as structured: the first line is the description,
+	// directives may appear anywhere within it, and the remaining prose is the extended description.
+	RichHeader bool
+	// IgnoreFile is the name of the gitignore-style file consulted by LoadFromDir, for example ".osqtoolignore".
+	IgnoreFile string
+	// DirectivesOverrideSidecar gives in-file directives precedence over sidecar metadata, rather than the reverse.
+	DirectivesOverrideSidecar bool
+	// CommentPrefix is the marker used by the leading description and directive lines, as written by Render.
+	// The default is DefaultCommentPrefix.
+	CommentPrefix string
+	// PlatformSuffixes maps additional query name suffixes to the platform they indicate, such as "mac" to "darwin".
+	// They are checked before the built-in suffixes, such as "linux" and "win".
+	PlatformSuffixes map[string]string
+	// NoAutoSemicolon leaves queries that do not end with a semicolon as they are, rather than appending one.
+	NoAutoSemicolon bool
+}
+
+// DefaultCommentPrefix is the SQL comment marker used for descriptions and directives.
+const DefaultCommentPrefix = "--"
+
+// headerComments rewrites the leading comment lines of a query that use prefix into SQL comments.
+func headerComments(bs []byte, prefix string) []byte {
+	lines := bytes.Split(bs, []byte("\n"))
+	for i, l := range lines {
+		trimmed := bytes.TrimSpace(l)
+		if len(trimmed) == 0 {
+			continue
+		}
+		after, ok := bytes.CutPrefix(trimmed, []byte(prefix))
+		if !ok {
+			break
+		}
+		lines[i] = append([]byte(DefaultCommentPrefix), after...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// directives are the comment directives understood by Parse.
+var directives = map[string]bool{
+	"interval": true,
+	"platform": true,
+	"version":  true,
+	"tags":     true,
+	"shard":    true,
+	"value":    true,
+	"author":   true,
+	"denylist": true,
+	"snapshot": true,
+	"removed":  true,
+
+	"description": true,
+	"min_results": true,
 }
 
 // LoadFromDir recursively loads osquery queries from a directory.
 func LoadFromDir(path string) (map[string]*Metadata, error) {
+	return LoadFromDirWithConfig(path, nil)
+}
+
+// LoadFromDirWithConfig recursively loads osquery queries from a directory. A nil *ParseConfig uses the defaults.
+func LoadFromDirWithConfig(path string, c *ParseConfig) (map[string]*Metadata, error) {
+	return loadFromDir(path, c, runtime.NumCPU())
+}
+
+// loadFromDir finds the queries within a directory, and then loads them using up to workers goroutines.
+// If several files fail to load, the error for the first file found is returned.
+func loadFromDir(path string, c *ParseConfig, workers int) (map[string]*Metadata, error) {
+	if c == nil {
+		c = &ParseConfig{}
+	}
+
 	mm := map[string]*Metadata{}
+	im := newIgnoreMatcher(path, c.IgnoreFile)
+	paths := []string{}
+	root := path
 
 	err := filepath.Walk(path,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
+
+			if im.ignored(path, info.IsDir()) {
+				klog.V(1).Infof("ignoring %s (matched %s)", path, c.IgnoreFile)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.IsDir() {
+				// Discovery queries written by SaveDiscovery are loaded separately by LoadDiscovery
+				if path == filepath.Join(root, DiscoveryDir) {
+					return filepath.SkipDir
+				}
+				return im.loadDir(path)
+			}
+
 			if strings.HasSuffix(path, ".sql") {
 				klog.V(1).Infof("found query: %s", path)
-				m, err := Load(path)
-				if err != nil {
-					return fmt.Errorf("load: %v", err)
-				}
-				mm[m.Name] = m
+				paths = append(paths, path)
 			}
 			return nil
 		})
+	if err != nil {
+		return mm, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	loaded := make([]*Metadata, len(paths))
+	errs := make([]error, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				loaded[i], errs[i] = LoadWithConfig(paths[i], c)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
 
-	return mm, err
+	// Results are merged in the order the files were found, so that later files replace earlier ones as before
+	for i, m := range loaded {
+		if errs[i] != nil {
+			return mm, fmt.Errorf("load: %v", errs[i])
+		}
+		mm[m.Name] = m
+	}
+	return mm, nil
 }
 
-// Load loads a query from a file.
+// Load loads a query from a file, merging metadata from a sidecar file such as "foo.sql.yaml" or "foo.yaml" if one is present.
 func Load(path string) (*Metadata, error) {
+	return LoadWithConfig(path, nil)
+}
+
+// LoadWithConfig loads a query from a file like Load. A nil *ParseConfig uses the defaults.
+func LoadWithConfig(path string, c *ParseConfig) (*Metadata, error) {
 	bs, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read: %v", err)
 	}
 
+	sc, err := loadSidecar(path)
+	if err != nil {
+		return nil, err
+	}
+
 	name := strings.ReplaceAll(filepath.Base(path), ".sql", "")
-	m, err := Parse(name, bs)
+	m, err := parse(name, bs, c, sc)
 	if err != nil {
 		return nil, fmt.Errorf("parse: %v", err)
 	}
@@ -74,6 +225,11 @@ func Load(path string) (*Metadata, error) {
 
 // Render renders query metadata into a string.
 func Render(m *Metadata) (string, error) {
+	return RenderWithConfig(m, nil)
+}
+
+// RenderWithConfig renders query metadata into a string. A nil *RenderConfig uses the defaults.
+func RenderWithConfig(m *Metadata, c *RenderConfig) (string, error) {
 	lines := []string{}
 
 	if m.Description != "" {
@@ -106,10 +262,41 @@ func Render(m *Metadata) (string, error) {
 		lines = append(lines, fmt.Sprintf("-- value: %s", m.Value))
 	}
 
+	if m.Author != "" {
+		lines = append(lines, fmt.Sprintf("-- author: %s", m.Author))
+	}
+
 	if m.Version != "" {
 		lines = append(lines, fmt.Sprintf("-- version: %s", m.Version))
 	}
 
+	if m.Snapshot {
+		lines = append(lines, "-- snapshot: true")
+	}
+
+	if m.Removed {
+		lines = append(lines, "-- removed: true")
+	}
+
+	if m.DenyList {
+		lines = append(lines, "-- denylist: true")
+	}
+
+	if m.MinResults > 0 {
+		lines = append(lines, fmt.Sprintf("-- min_results: %d", m.MinResults))
+	}
+
+	if len(m.Tags) > 0 {
+		lines = append(lines, fmt.Sprintf("-- tags: %s", strings.Join(m.Tags, " ")))
+	}
+
+	// The description and directives use the configured comment prefix, but the query body is left as is
+	if prefix := c.commentPrefix(); prefix != DefaultCommentPrefix {
+		for i, l := range lines {
+			lines[i] = prefix + strings.TrimPrefix(l, DefaultCommentPrefix)
+		}
+	}
+
 	lines = append(lines, "")
 	lines = append(lines, m.Query)
 
@@ -117,15 +304,52 @@ func Render(m *Metadata) (string, error) {
 }
 
 // Parse parses query content and returns a Metadata object.
-func Parse(name string, bs []byte) (*Metadata, error) { //nolint: funlen // TODO: split into smaller functions
+func Parse(name string, bs []byte) (*Metadata, error) {
+	return ParseWithConfig(name, bs, nil)
+}
+
+// ParseWithConfig parses query content and returns a Metadata object. A nil *ParseConfig uses the defaults.
+func ParseWithConfig(name string, bs []byte, c *ParseConfig) (*Metadata, error) {
+	return parse(name, bs, c, nil)
+}
+
+// parse parses query content, with any sidecar metadata taking precedence over in-file directives
+// unless DirectivesOverrideSidecar is set.
+func parse(name string, bs []byte, c *ParseConfig, sidecar *sidecar) (*Metadata, error) { //nolint: funlen // TODO: split into smaller functions
+	if c == nil {
+		c = &ParseConfig{}
+	}
+
+	// Some editors prepend a byte order mark, which would otherwise become part of the first line
+	bs = bytes.TrimPrefix(bs, utf8BOM)
+
+	if c.CommentPrefix != "" && c.CommentPrefix != DefaultCommentPrefix {
+		bs = headerComments(bs, c.CommentPrefix)
+	}
+
 	// NOTE: The 'name' can be as simple as the file base path
 	m := &Metadata{
 		Name: name,
 	}
 
+	// Sidecar metadata applied up front is overridden by any in-file directives
+	if sidecar != nil && c.DirectivesOverrideSidecar {
+		if err := sidecar.apply(m); err != nil {
+			return nil, fmt.Errorf("sidecar: %w", err)
+		}
+	}
+
 	out := []string{}
+	// singles contains the same lines as out, but with any preserved comments in a single-line safe form
+	singles := []string{}
+	// extended contains the lines of the extended description
+	extended := []string{}
+	inExtended := true
+	inBody := false
+
 	for i, line := range bytes.Split(bs, []byte("\n")) {
-		s := strings.TrimSuffix(string(line), "\n")
+		// Files authored on Windows may have CRLF line endings
+		s := strings.TrimSuffix(string(line), "\r")
 
 		// Wait a minute buckaroo, are you really trying to parse SQL? Have you considered --flags?
 		// This is going to require work.
@@ -142,11 +366,22 @@ func Parse(name string, bs []byte) (*Metadata, error) { //nolint: funlen // TODO
 
 		if !hasComment {
 			out = append(out, s)
+			singles = append(singles, s)
+			if strings.TrimSpace(s) != "" {
+				inBody = true
+			}
 			continue
 		}
 
 		if !strings.HasPrefix(strings.TrimSpace(s), "--") {
-			out = append(out, before)
+			if c.PreserveComments {
+				out = append(out, s)
+				singles = append(singles, before+blockComment(after))
+			} else {
+				out = append(out, before)
+				singles = append(singles, before)
+			}
+			inBody = true
 			continue
 		}
 
@@ -161,75 +396,231 @@ func Parse(name string, bs []byte) (*Metadata, error) { //nolint: funlen // TODO
 			content = strings.TrimSpace(content)
 		}
 
-		// See https://github.com/osquery/osquery/blob/4ee0be8000d59742d4fe86d2cb0a6241b79d11ff/osquery/config/packs.cpp
-		switch directive {
-		case "interval":
-			m.Interval = content
-		case "platform":
-			m.Platform = content
-		case "version":
-			m.Version = content
-		case "tags":
-			m.Tags = strings.Split(content, " ")
-		case "shard":
-			shard, err := strconv.Atoi(content)
-			if err != nil {
-				return nil, err
+		// Comments within the query body are documentation rather than metadata
+		if c.PreserveComments && inBody && !(hasDirective && directives[directive]) {
+			out = append(out, s)
+			singles = append(singles, before+blockComment(after))
+			continue
+		}
+
+		isDirective := hasDirective && directives[directive]
+		if c.RichHeader && !inBody && i > 0 && !isDirective {
+			extended = append(extended, after)
+			continue
+		}
+
+		// The comment block following the description is the extended description, as written by Render
+		if !c.RichHeader && inExtended && !inBody && i > 0 {
+			switch {
+			case isDirective:
+				inExtended = false
+			case after == "" && i == 1:
+				// divider between the description and extended description
+				continue
+			case after == "":
+				inExtended = false
+				continue
+			default:
+				extended = append(extended, after)
+				continue
 			}
-			m.Shard = shard
-		case "value":
-			m.Value = content
+		}
+
+		if err := applyDirective(m, directive, content); err != nil {
+			return nil, err
 		}
 	}
 
+	if sidecar != nil && !c.DirectivesOverrideSidecar {
+		if err := sidecar.apply(m); err != nil {
+			return nil, fmt.Errorf("sidecar: %w", err)
+		}
+	}
+
+	if len(extended) > 0 {
+		m.ExtendedDescription = strings.Trim(strings.Join(extended, "\n"), "\n")
+	}
+
 	m.Query = strings.TrimSpace(strings.Join(out, "\n"))
 
 	// Single-line query form
 	trimmed := []string{}
-	for _, l := range out {
+	for _, l := range singles {
 		trimmed = append(trimmed, strings.TrimSpace(l))
 	}
 	m.SingleLineQuery = strings.TrimSpace(strings.Join(trimmed, " "))
 
 	if !strings.HasSuffix(m.Query, ";") {
-		m.Query += ";"
-		m.SingleLineQuery += ";"
+		m.MissingSemicolon = true
+		if !c.NoAutoSemicolon {
+			m.Query += ";"
+			m.SingleLineQuery += ";"
+		}
 	}
 
-	guessPlatform := ""
-
 	// If the platform field isn't filled in, try to guess via the name
-	switch {
-	case strings.HasSuffix(m.Name, "linux"):
-		guessPlatform = "linux"
-	case strings.HasSuffix(m.Name, "macos"):
-		guessPlatform = "darwin"
-	case strings.HasSuffix(m.Name, "darwin"):
-		guessPlatform = "darwin"
-	case strings.HasSuffix(m.Name, "posix"):
-		guessPlatform = "posix"
-	case strings.HasSuffix(m.Name, "unix"):
-		guessPlatform = "posix"
-	case strings.HasSuffix(m.Name, "windows"):
-		guessPlatform = "windows"
-	case strings.HasSuffix(m.Name, "win"):
-		guessPlatform = "windows"
-	}
-
-	switch m.Platform {
-	case "macos":
-		m.Platform = "darwin"
-	case "unix":
-		m.Platform = "posix"
-	case "win":
-		m.Platform = "windows"
-	case "":
+	guessPlatform := guessPlatformFromName(m.Name, c.PlatformSuffixes)
+
+	if m.Platform == "" {
 		m.Platform = guessPlatform
 	}
 
-	if guessPlatform != "" && m.Platform != guessPlatform {
+	if guessPlatform != "" && !m.HasPlatform(guessPlatform) {
 		return m, fmt.Errorf("platform is set to %q, but filename indicates %q", m.Platform, guessPlatform)
 	}
 
 	return m, nil
 }
+
+// applyDirective sets the metadata field corresponding to a directive.
+func applyDirective(m *Metadata, directive string, content string) error {
+	// See https://github.com/osquery/osquery/blob/4ee0be8000d59742d4fe86d2cb0a6241b79d11ff/osquery/config/packs.cpp
+	switch directive {
+	case "interval":
+		interval, err := normalizeInterval(content)
+		if err != nil {
+			return fmt.Errorf("interval: %w", err)
+		}
+		m.Interval = interval
+	case "platform":
+		m.Platform = content
+	case "version":
+		m.Version = content
+	case "description":
+		m.Description = content
+	case "tags":
+		m.Tags = strings.Fields(content)
+	case "shard":
+		shard, err := strconv.Atoi(content)
+		if err != nil {
+			return err
+		}
+		m.Shard = shard
+	case "value":
+		m.Value = content
+	case "author":
+		m.Author = content
+	case "min_results":
+		n, err := strconv.Atoi(content)
+		if err != nil {
+			return fmt.Errorf("min_results: %w", err)
+		}
+		m.MinResults = n
+	case "denylist":
+		v, err := strconv.ParseBool(content)
+		if err != nil {
+			return fmt.Errorf("denylist: %w", err)
+		}
+		m.DenyList = v
+	case "snapshot":
+		v, err := strconv.ParseBool(content)
+		if err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+		m.Snapshot = v
+	case "removed":
+		v, err := strconv.ParseBool(content)
+		if err != nil {
+			return fmt.Errorf("removed: %w", err)
+		}
+		m.Removed = v
+	}
+	return nil
+}
+
+// normalizeInterval converts an interval given as a duration, such as "15m", into seconds.
+// Other values, such as integers and AutoInterval, are returned unchanged.
+func normalizeInterval(interval string) (string, error) {
+	if _, err := strconv.Atoi(interval); err == nil {
+		return interval, nil
+	}
+
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return interval, nil
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return "", fmt.Errorf("%q is not a whole number of seconds", interval)
+	}
+	return strconv.Itoa(int(d.Seconds())), nil
+}
+
+// blockComment converts the text of a line comment into a comment that is safe to embed within a single line.
+func blockComment(text string) string {
+	return "/* " + strings.ReplaceAll(strings.TrimSpace(text), "*/", "* /") + " */"
+}
+
+// Platforms returns the list of platforms a query is scheduled for, as osquery accepts a comma-separated list.
+// Aliases such as macos are replaced with the osquery name, while Platform keeps the list as written.
+func (m *Metadata) Platforms() []string {
+	ps := []string{}
+	for _, p := range strings.Split(m.Platform, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if alias, ok := platformAliases[strings.ToLower(p)]; ok {
+			p = alias
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// guessPlatformFromName returns the platform indicated by the suffix of a query name, such as
+// "linux" for "users-linux", or "" if there is none. Custom suffixes are checked first, longest first.
+func guessPlatformFromName(name string, custom map[string]string) string {
+	suffixes := []string{}
+	for suffix := range custom {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool {
+		if len(suffixes[i]) != len(suffixes[j]) {
+			return len(suffixes[i]) > len(suffixes[j])
+		}
+		return suffixes[i] < suffixes[j]
+	})
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return custom[suffix]
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(name, "linux"):
+		return "linux"
+	case strings.HasSuffix(name, "macos"):
+		return "darwin"
+	case strings.HasSuffix(name, "darwin"):
+		return "darwin"
+	case strings.HasSuffix(name, "freebsd"):
+		return "freebsd"
+	case strings.HasSuffix(name, "posix"):
+		return "posix"
+	case strings.HasSuffix(name, "unix"):
+		return "posix"
+	case strings.HasSuffix(name, "windows"):
+		return "windows"
+	case strings.HasSuffix(name, "win"):
+		return "windows"
+	}
+	return ""
+}
+
+// platformAliases maps commonly written platform names to the names that osquery understands.
+var platformAliases = map[string]string{
+	"macos": "darwin",
+	"osx":   "darwin",
+	"unix":  "posix",
+	"win":   "windows",
+}
+
+// HasPlatform returns true if the platform is explicitly listed for this query.
+func (m *Metadata) HasPlatform(platform string) bool {
+	for _, p := range m.Platforms() {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,694 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePlatformList(t *testing.T) {
+	m, err := Parse("two-platforms", []byte("-- Two platforms\n-- platform: linux, macos\nSELECT 1"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if m.Platform != "linux, macos" {
+		t.Errorf("Platform = %q, want %q as written", m.Platform, "linux, macos")
+	}
+	if diff := cmp.Diff([]string{"linux", "darwin"}, m.Platforms()); diff != "" {
+		t.Errorf("Platforms() mismatch (-want +got):\n%s", diff)
+	}
+
+	s, err := Render(m)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(s, "-- platform: linux, macos\n") {
+		t.Errorf("Render() = %q, missing platform list", s)
+	}
+}
+
+func TestParsePlatformAliases(t *testing.T) {
+	tests := []struct {
+		platform string
+		want     string
+	}{
+		{platform: "macos", want: "darwin"},
+		{platform: "osx", want: "darwin"},
+		{platform: "macOS", want: "darwin"},
+		{platform: "win", want: "windows"},
+		{platform: "unix", want: "posix"},
+		{platform: "osx, linux", want: "darwin,linux"},
+		{platform: "freebsd", want: "freebsd"},
+	}
+
+	for _, tc := range tests {
+		m, err := Parse("users", []byte("-- platform: "+tc.platform+"\nSELECT 1"))
+		if err != nil {
+			t.Fatalf("parse(%s): %v", tc.platform, err)
+		}
+		if m.Platform != tc.platform {
+			t.Errorf("platform: %s gives Platform = %q, want it kept as written", tc.platform, m.Platform)
+		}
+		if got := strings.Join(m.Platforms(), ","); got != tc.want {
+			t.Errorf("platform: %s gives Platforms() = %q, want %q", tc.platform, got, tc.want)
+		}
+	}
+
+	m, err := Parse("users", []byte("-- platform: macos\nSELECT 1"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := incompatibleWith(m, "darwin"); got != "" {
+		t.Errorf("incompatibleWith(darwin) = %q, want compatible", got)
+	}
+	if got := incompatibleWith(m, "linux"); got != "macos" {
+		t.Errorf("incompatibleWith(linux) = %q, want macos", got)
+	}
+
+	p, err := ParsePack([]byte(`{"platform": "osx", "queries": {"users": {"query": "SELECT 1;"}}}`), nil)
+	if err != nil {
+		t.Fatalf("ParsePack: %v", err)
+	}
+	if got := p.Queries["users"].Platforms(); len(got) != 1 || got[0] != "darwin" {
+		t.Errorf("pack platform osx gives Platforms() = %q, want darwin", got)
+	}
+}
+
+func TestGuessPlatformFromName(t *testing.T) {
+	custom := map[string]string{"mac": "darwin", "bsd": "freebsd", "nix": "posix"}
+	tests := []struct {
+		name   string
+		custom map[string]string
+		want   string
+	}{
+		{name: "users-linux", want: "linux"},
+		{name: "users-macos", want: "darwin"},
+		{name: "users-darwin", want: "darwin"},
+		{name: "users-freebsd", want: "freebsd"},
+		{name: "users-posix", want: "posix"},
+		{name: "users-unix", want: "posix"},
+		{name: "users-windows", want: "windows"},
+		{name: "users-win", want: "windows"},
+		{name: "users", want: ""},
+		{name: "users-mac", want: ""},
+		{name: "users-mac", custom: custom, want: "darwin"},
+		{name: "users-bsd", custom: custom, want: "freebsd"},
+		// Built-in suffixes still apply alongside custom ones, unless a custom suffix matches first
+		{name: "users-linux", custom: custom, want: "linux"},
+		{name: "users-unix", custom: custom, want: "posix"},
+	}
+
+	for _, tc := range tests {
+		if got := guessPlatformFromName(tc.name, tc.custom); got != tc.want {
+			t.Errorf("guessPlatformFromName(%q, %v) = %q, want %q", tc.name, tc.custom, got, tc.want)
+		}
+	}
+
+	m, err := ParseWithConfig("kld-bsd", []byte("SELECT * FROM kernel_modules;"), &ParseConfig{PlatformSuffixes: custom})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if m.Platform != "freebsd" {
+		t.Errorf("Platform = %q, want freebsd", m.Platform)
+	}
+}
+
+func TestParseDescriptionDirective(t *testing.T) {
+	m, err := Parse("users", []byte("-- description: Local users\n-- tags:  persistent   often\nSELECT * FROM users;"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if m.Description != "Local users" {
+		t.Errorf("Description = %q, want %q", m.Description, "Local users")
+	}
+	if diff := cmp.Diff([]string{"persistent", "often"}, m.Tags); diff != "" {
+		t.Errorf("Tags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParsePlatformListMismatch(t *testing.T) {
+	if _, err := Parse("users-linux", []byte("-- platform: darwin,windows\nSELECT 1")); err == nil {
+		t.Errorf("Parse() = nil error, want filename mismatch")
+	}
+
+	if _, err := Parse("users-linux", []byte("-- platform: darwin,linux\nSELECT 1")); err != nil {
+		t.Errorf("Parse() = %v, want nil error", err)
+	}
+}
+
+func TestParseIntervalDuration(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     string
+		wantErr  bool
+	}{
+		{interval: "20s", want: "20"},
+		{interval: "1h", want: "3600"},
+		{interval: "1h30m", want: "5400"},
+		{interval: "300", want: "300"},
+		{interval: AutoInterval, want: AutoInterval},
+		{interval: "1500ms", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		m, err := Parse("q", []byte("-- A query\n-- interval: "+tc.interval+"\nSELECT 1;"))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Parse(interval: %s) = nil error, want error", tc.interval)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Parse(interval: %s): %v", tc.interval, err)
+		}
+		if m.Interval != tc.want {
+			t.Errorf("Parse(interval: %s).Interval = %q, want %q", tc.interval, m.Interval, tc.want)
+		}
+	}
+}
+
+func TestParseNoAutoSemicolon(t *testing.T) {
+	in := `-- Listening ports
+SELECT pid, port FROM listening_ports; -- excludes loopback
+`
+	m, err := ParseWithConfig("ports", []byte(in), &ParseConfig{PreserveComments: true, NoAutoSemicolon: true})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := "SELECT pid, port FROM listening_ports; -- excludes loopback"
+	if m.Query != want {
+		t.Errorf("Query = %q, want %q", m.Query, want)
+	}
+	if !m.MissingSemicolon {
+		t.Errorf("MissingSemicolon = false, want true")
+	}
+
+	m, err = ParseWithConfig("ports", []byte(in), &ParseConfig{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if want := "SELECT pid, port FROM listening_ports; -- excludes loopback;"; m.Query != want {
+		t.Errorf("Query without NoAutoSemicolon = %q, want %q", m.Query, want)
+	}
+}
+
+func TestParsePreserveComments(t *testing.T) {
+	in := `-- Users and their groups
+-- interval: 600
+SELECT u.username, g.groupname
+FROM users u
+-- clarify this join
+JOIN user_groups ug ON u.uid = ug.uid -- map uid to gid
+JOIN groups g ON ug.gid = g.gid
+`
+	m, err := ParseWithConfig("users", []byte(in), &ParseConfig{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if m.Interval != "600" {
+		t.Errorf("Interval = %q, want 600", m.Interval)
+	}
+
+	for _, want := range []string{"-- clarify this join\n", "-- map uid to gid"} {
+		if !strings.Contains(m.Query, want) {
+			t.Errorf("Query = %q, missing %q", m.Query, want)
+		}
+	}
+	if strings.Contains(m.Query, "Users and their groups") || strings.Contains(m.Query, "interval") {
+		t.Errorf("Query = %q, should not contain header directives", m.Query)
+	}
+
+	want := "SELECT u.username, g.groupname FROM users u /* clarify this join */ JOIN user_groups ug ON u.uid = ug.uid /* map uid to gid */ JOIN groups g ON ug.gid = g.gid;"
+	if m.SingleLineQuery != want {
+		t.Errorf("SingleLineQuery = %q, want %q", m.SingleLineQuery, want)
+	}
+
+	m, err = Parse("users", []byte(in))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if strings.Contains(m.Query, "clarify") {
+		t.Errorf("Query = %q, comments should be stripped by default", m.Query)
+	}
+}
+
+func TestDenyListRoundTrip(t *testing.T) {
+	m, err := Parse("noisy", []byte("-- Noisy query\n-- denylist: true\nSELECT * FROM processes"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !m.DenyList {
+		t.Fatalf("DenyList = false, want true")
+	}
+
+	s, err := Render(m)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	m, err = Parse("noisy", []byte(s))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !m.DenyList {
+		t.Errorf("DenyList = false after round trip of %q", s)
+	}
+}
+
+func TestLoadSidecar(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logged-in-users.sql")
+	if err := os.WriteFile(path, []byte("SELECT * FROM logged_in_users;\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sidecar := `# metadata for logged-in-users.sql
+description: Users currently logged in
+interval: 600
+platform: [linux, macos]
+tags:
+  - often
+  - "identity"
+`
+	if err := os.WriteFile(path+".yaml", []byte(sidecar), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	want := &Metadata{
+		Name:            "logged-in-users",
+		Description:     "Users currently logged in",
+		Interval:        "600",
+		Platform:        "linux,macos",
+		Tags:            []string{"often", "identity"},
+		Query:           "SELECT * FROM logged_in_users;",
+		SingleLineQuery: "SELECT * FROM logged_in_users;",
+	}
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("Load() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadFromDirSidecarWithoutExtension(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"generated.sql": "SELECT pid, name FROM processes WHERE on_disk = 0;\n",
+		"generated.yaml": `description: Processes without a binary on disk
+interval: 300
+platform: linux
+tags: [often, process]
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	mm, err := LoadFromDir(dir)
+	if err != nil {
+		t.Fatalf("LoadFromDir: %v", err)
+	}
+
+	want := map[string]*Metadata{
+		"generated": {
+			Name:            "generated",
+			Description:     "Processes without a binary on disk",
+			Interval:        "300",
+			Platform:        "linux",
+			Tags:            []string{"often", "process"},
+			Query:           "SELECT pid, name FROM processes WHERE on_disk = 0;",
+			SingleLineQuery: "SELECT pid, name FROM processes WHERE on_disk = 0;",
+		},
+	}
+	if diff := cmp.Diff(want, mm); diff != "" {
+		t.Errorf("LoadFromDir() mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "generated.sql.yml"), []byte("interval: 600\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := LoadFromDir(dir); err == nil || !strings.Contains(err.Error(), "conflicts with sidecar") {
+		t.Errorf("LoadFromDir() = %v, want conflicting sidecar error", err)
+	}
+}
+
+func TestLoadSidecarPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.sql")
+	if err := os.WriteFile(path, []byte("-- All users\n-- interval: 3600\n-- version: 5.0.0\nSELECT * FROM users;\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(path+".yml", []byte("interval: 86400\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if m.Interval != "86400" {
+		t.Errorf("Interval = %q, want sidecar value 86400", m.Interval)
+	}
+	if m.Version != "5.0.0" || m.Description != "All users" {
+		t.Errorf("Version = %q, Description = %q, want in-file directives to be kept", m.Version, m.Description)
+	}
+
+	m, err = LoadWithConfig(path, &ParseConfig{DirectivesOverrideSidecar: true})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if m.Interval != "3600" {
+		t.Errorf("Interval = %q, want in-file value 3600 with DirectivesOverrideSidecar", m.Interval)
+	}
+
+	if err := os.WriteFile(path+".yml", []byte("intervl: 86400\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("Load() = nil error, want unknown key error")
+	}
+}
+
+func TestParseRichHeader(t *testing.T) {
+	in := `-- Detect unexpected shell parents
+--
+-- Shells spawned by network services are a common sign of
+-- remote code execution.
+-- interval: 600
+-- platform: linux
+--
+-- References: https://attack.mitre.org/techniques/T1059/
+-- tags: often
+SELECT p.pid FROM processes p;
+`
+	m, err := ParseWithConfig("shell-parents", []byte(in), &ParseConfig{RichHeader: true})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := &Metadata{
+		Name:                "shell-parents",
+		Description:         "Detect unexpected shell parents",
+		ExtendedDescription: "Shells spawned by network services are a common sign of\nremote code execution.\n\nReferences: https://attack.mitre.org/techniques/T1059/",
+		Interval:            "600",
+		Platform:            "linux",
+		Tags:                []string{"often"},
+		Query:               "SELECT p.pid FROM processes p;",
+		SingleLineQuery:     "SELECT p.pid FROM processes p;",
+	}
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("Parse() mismatch (-want +got):\n%s", diff)
+	}
+
+	m, err = Parse("shell-parents", []byte(in))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	// by default, only the block before the first directive is the extended description
+	want.ExtendedDescription = "Shells spawned by network services are a common sign of\nremote code execution."
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("Parse() without rich header mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	m, err := Parse("shells", []byte("-- Unexpected shells\n-- interval: 600\n-- tags: transient often\nSELECT pid FROM processes;"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	s, err := Render(m)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !strings.Contains(s, "-- tags: transient often\n") {
+		t.Errorf("Render() = %q, missing tags", s)
+	}
+
+	got, err := Parse("shells", []byte(s))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if diff := cmp.Diff([]string{"transient", "often"}, got.Tags); diff != "" {
+		t.Errorf("Tags mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExtendedDescriptionRoundTrip(t *testing.T) {
+	in := `-- Unexpected kernel modules
+--
+-- Lists kernel modules which are not
+-- part of the distribution kernel,
+-- excluding well-known vendors.
+--
+-- interval: 3600
+-- platform: linux
+SELECT name FROM kernel_modules;
+`
+	m, err := Parse("kernel-modules", []byte(in))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if m.Description != "Unexpected kernel modules" {
+		t.Errorf("Description = %q, want %q", m.Description, "Unexpected kernel modules")
+	}
+	wantExtended := "Lists kernel modules which are not\npart of the distribution kernel,\nexcluding well-known vendors."
+	if m.ExtendedDescription != wantExtended {
+		t.Errorf("ExtendedDescription = %q, want %q", m.ExtendedDescription, wantExtended)
+	}
+	if m.Interval != "3600" || m.Platform != "linux" {
+		t.Errorf("Interval = %q, Platform = %q, want directives after the extended description", m.Interval, m.Platform)
+	}
+
+	s, err := Render(m)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	got, err := Parse("kernel-modules", []byte(s))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if diff := cmp.Diff(m, got); diff != "" {
+		t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestBoolDirectivesRoundTrip(t *testing.T) {
+	in := "-- Installed packages\n-- snapshot: true\n-- removed: true\n-- denylist: true\nSELECT name FROM deb_packages;"
+	m, err := Parse("packages", []byte(in))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	s, err := Render(m)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	for _, want := range []string{"-- snapshot: true\n", "-- removed: true\n", "-- denylist: true\n"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Render() = %q, missing %q", s, want)
+		}
+	}
+
+	got, err := Parse("packages", []byte(s))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !got.Snapshot || !got.Removed || !got.DenyList {
+		t.Errorf("Snapshot = %v, Removed = %v, DenyList = %v after round trip of %q; want all true", got.Snapshot, got.Removed, got.DenyList, s)
+	}
+
+	if _, err := Parse("packages", []byte("-- snapshot: sometimes\nSELECT 1;")); err == nil {
+		t.Errorf("Parse() = nil error, want invalid snapshot value")
+	}
+}
+
+func TestLoadCRLF(t *testing.T) {
+	m, err := Load("testdata/crlf.sql")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	want := &Metadata{
+		Name:            "crlf",
+		Description:     "Logged in users",
+		Interval:        "900",
+		Platform:        "windows",
+		Query:           "SELECT user,\n  host\nFROM logged_in_users;",
+		SingleLineQuery: "SELECT user, host FROM logged_in_users;",
+	}
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("Load() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadBOM(t *testing.T) {
+	m, err := Load("testdata/bom.sql")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	want := &Metadata{
+		Name:            "bom",
+		Description:     "Kernel modules",
+		Interval:        "600",
+		Query:           "SELECT name FROM kernel_modules;",
+		SingleLineQuery: "SELECT name FROM kernel_modules;",
+	}
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("Load() mismatch (-want +got):\n%s", diff)
+	}
+
+	// A directive on the first line must also survive the byte order mark
+	m, err = Parse("bom", []byte("\xef\xbb\xbf-- interval: 60\nSELECT 1;"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if m.Interval != "60" {
+		t.Errorf("Interval = %q, want 60", m.Interval)
+	}
+}
+
+// writeQueryTree writes n queries spread across nested directories, returning the root.
+func writeQueryTree(tb testing.TB, n int) string {
+	tb.Helper()
+	root := tb.TempDir()
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("group-%d", i%7), fmt.Sprintf("sub-%d", i%3))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			tb.Fatalf("mkdir: %v", err)
+		}
+		sql := fmt.Sprintf("-- Query %d\n--\n-- Finds things.\n--\n-- interval: %d\n-- tags: t%d\nSELECT pid, name\nFROM processes -- all of them\nWHERE pid > %d;\n", i, 60+i, i%5, i)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("query-%03d.sql", i)), []byte(sql), 0o600); err != nil {
+			tb.Fatalf("write: %v", err)
+		}
+	}
+	return root
+}
+
+func TestLoadFromDirParallel(t *testing.T) {
+	root := writeQueryTree(t, 100)
+
+	serial, err := loadFromDir(root, nil, 1)
+	if err != nil {
+		t.Fatalf("loadFromDir(serial): %v", err)
+	}
+	if len(serial) != 100 {
+		t.Errorf("loaded %d queries, want 100", len(serial))
+	}
+
+	parallel, err := loadFromDir(root, nil, 8)
+	if err != nil {
+		t.Fatalf("loadFromDir(parallel): %v", err)
+	}
+	if diff := cmp.Diff(serial, parallel); diff != "" {
+		t.Errorf("parallel load mismatch (-serial +parallel):\n%s", diff)
+	}
+
+	// The error for the first file found wins, as it did when loading serially
+	for name, platform := range map[string]string{"a-linux.sql": "darwin", "b-linux.sql": "windows"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("-- platform: "+platform+"\nSELECT 1;"), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for _, workers := range []int{1, 8} {
+		_, err := loadFromDir(root, nil, workers)
+		if err == nil || !strings.Contains(err.Error(), `"darwin"`) {
+			t.Errorf("loadFromDir(workers=%d) = %v, want error for a-linux.sql", workers, err)
+		}
+	}
+}
+
+func BenchmarkLoadFromDir(b *testing.B) {
+	root := writeQueryTree(b, 600)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := loadFromDir(root, nil, workers); err != nil {
+					b.Fatalf("loadFromDir: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sudoers.sql")
+	in := "-- Sudoers entries\n-- author: Jane Doe <jane@example.com>\n-- platform: linux\nSELECT * FROM sudoers;"
+	if err := os.WriteFile(path, []byte(in), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	want := "Jane Doe <jane@example.com>"
+	if m.Author != want {
+		t.Errorf("Author = %q, want %q", m.Author, want)
+	}
+
+	s, err := Render(m)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	got, err := Parse("sudoers", []byte(s))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if diff := cmp.Diff(m, got); diff != "" {
+		t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+	}
+
+	bs, err := RenderPack(&Pack{Queries: map[string]*Metadata{"sudoers": m}}, &RenderConfig{})
+	if err != nil {
+		t.Fatalf("render pack: %v", err)
+	}
+	if !strings.Contains(string(bs), `"author": "Jane Doe <jane@example.com>"`) {
+		t.Errorf("RenderPack() = %s, missing author", bs)
+	}
+	p, err := ParsePack(bs, nil)
+	if err != nil {
+		t.Fatalf("parse pack: %v", err)
+	}
+	if p.Queries["sudoers"].Author != want {
+		t.Errorf("pack Author = %q, want %q", p.Queries["sudoers"].Author, want)
+	}
+}
+
+func TestRenderCommentPrefix(t *testing.T) {
+	in := "-- Listening ports\n--\n-- Ports with a process attached.\n-- \n-- interval: 600\n-- platform: linux\n-- tags: network\n\nSELECT port, pid -- owning process\nFROM listening_ports;"
+	m, err := ParseWithConfig("ports", []byte(in), &ParseConfig{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	s, err := RenderWithConfig(m, &RenderConfig{CommentPrefix: "#"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	want := "# Listening ports\n#\n# Ports with a process attached.\n# \n# interval: 600\n# platform: linux\n# tags: network\n\nSELECT port, pid -- owning process\nFROM listening_ports;\n"
+	if diff := cmp.Diff(want, s); diff != "" {
+		t.Errorf("Render() mismatch (-want +got):\n%s", diff)
+	}
+
+	got, err := ParseWithConfig("ports", []byte(s), &ParseConfig{PreserveComments: true, CommentPrefix: "#"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if diff := cmp.Diff(m, got); diff != "" {
+		t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,96 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// singleQuoteStrings rewrites double-quoted SQL strings as single-quoted strings, doubling any single
+// quotes within them as SQL requires. Single-quoted strings, backtick identifiers, and comments are
+// left as they are. It returns an error if a string is unterminated.
+func singleQuoteStrings(sql string) (string, error) {
+	var sb strings.Builder
+	rs := []rune(sql)
+
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == '"':
+			sb.WriteRune('\'')
+			i++
+			for ; i < len(rs); i++ {
+				if rs[i] == '"' {
+					// doubled quotes are escapes
+					if i+1 < len(rs) && rs[i+1] == '"' {
+						sb.WriteRune('"')
+						i++
+						continue
+					}
+					break
+				}
+				if rs[i] == '\'' {
+					sb.WriteRune('\'')
+				}
+				sb.WriteRune(rs[i])
+			}
+			if i == len(rs) {
+				return sql, fmt.Errorf("unterminated double-quoted string")
+			}
+			sb.WriteRune('\'')
+		case r == '\'' || r == '`':
+			start := i
+			for i++; i < len(rs); i++ {
+				if rs[i] == r {
+					if i+1 < len(rs) && rs[i+1] == r {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			if i == len(rs) {
+				return sql, fmt.Errorf("unterminated %c string", r)
+			}
+			sb.WriteString(string(rs[start : i+1]))
+		case r == '-' && i+1 < len(rs) && rs[i+1] == '-':
+			start := i
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+			sb.WriteString(string(rs[start:i]))
+			if i < len(rs) {
+				sb.WriteRune(rs[i])
+			}
+		case r == '/' && i+1 < len(rs) && rs[i+1] == '*':
+			start := i
+			for i += 2; i < len(rs) && !(rs[i-1] == '*' && rs[i] == '/' && i > start+2); i++ {
+			}
+			if i == len(rs) {
+				i--
+			}
+			sb.WriteString(string(rs[start : i+1]))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String(), nil
+}
+
+// singleQuotePack returns a copy of a pack with the double-quoted strings of each query rewritten as
+// single-quoted strings. Queries that can not be rewritten safely are left as they are, and logged.
+func singleQuotePack(pack *Pack) *Pack {
+	cp := *pack
+	cp.Queries = map[string]*Metadata{}
+	for name, m := range pack.Queries {
+		mc := *m
+		q, err := singleQuoteStrings(m.Query)
+		if err != nil {
+			klog.Warningf("not converting %q to single quotes: %v", name, err)
+		}
+		mc.Query = q
+		cp.Queries[name] = &mc
+	}
+	return &cp
+}
@@ -0,0 +1,59 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSingleQuoteStrings(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", in: `SELECT * FROM users WHERE shell = "/bin/sh";`, want: `SELECT * FROM users WHERE shell = '/bin/sh';`},
+		{name: "nested single quotes", in: `SELECT * FROM mdfind WHERE query = "item == 'latest'";`, want: `SELECT * FROM mdfind WHERE query = 'item == ''latest''';`},
+		{name: "escaped double quote", in: `SELECT "say ""hi""";`, want: `SELECT 'say "hi"';`},
+		{name: "single-quoted string with double quotes", in: `SELECT * FROM users WHERE description = 'the "admin"';`, want: `SELECT * FROM users WHERE description = 'the "admin"';`},
+		{name: "escaped single quote", in: `SELECT 'it''s "fine"', "ok";`, want: `SELECT 'it''s "fine"', 'ok';`},
+		{name: "backticks", in: "SELECT `\"weird\"` FROM t;", want: "SELECT `\"weird\"` FROM t;"},
+		{name: "line comment", in: "-- don't \"touch\"\nSELECT \"x\";", want: "-- don't \"touch\"\nSELECT 'x';"},
+		{name: "block comment", in: `SELECT /* "it's" */ "x";`, want: `SELECT /* "it's" */ 'x';`},
+		{name: "unterminated", in: `SELECT "x;`, want: `SELECT "x;`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := singleQuoteStrings(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("singleQuoteStrings(%q) error = %v, want error: %v", tc.in, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("singleQuoteStrings(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRenderPackSingleQuotes(t *testing.T) {
+	original := `SELECT * FROM mdfind WHERE query = "item == 'latest'";`
+	p := &Pack{Queries: map[string]*Metadata{"mdfind": {Query: original}}}
+
+	bs, err := RenderPack(p, &RenderConfig{SingleQuotes: true, ValidateJSON: true})
+	if err != nil {
+		t.Fatalf("RenderPack() = %v", err)
+	}
+
+	got := &Pack{}
+	if err := json.Unmarshal(bs, got); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, bs)
+	}
+	want := `SELECT * FROM mdfind WHERE query = 'item == ''latest''';`
+	if got.Queries["mdfind"].Query != want {
+		t.Errorf("rendered query = %q, want %q", got.Queries["mdfind"].Query, want)
+	}
+	if p.Queries["mdfind"].Query != original {
+		t.Errorf("RenderPack() modified the pack: query = %q, want %q", p.Queries["mdfind"].Query, original)
+	}
+}
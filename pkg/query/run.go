@@ -2,14 +2,19 @@ package query
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"k8s.io/klog/v2"
 )
@@ -18,20 +23,26 @@ type RunResult struct {
 	IncompatiblePlatform string
 	Rows                 []Row
 	Elapsed              time.Duration
+	// Warnings are the lines osqueryi wrote to stderr for a query that otherwise succeeded, such as deprecation notices
+	Warnings []string
 }
 
 type Row map[string]string
 
 func (r Row) String() string {
-	var sb strings.Builder
-
 	keys := []string{}
 	for k := range r {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
+	return r.Text(keys)
+}
 
-	for _, k := range keys {
+// Text renders the row as key:value pairs in the order of the given headers, using "" for missing columns.
+func (r Row) Text(headers []string) string {
+	var sb strings.Builder
+
+	for _, k := range headers {
 		v := r[k]
 
 		text := fmt.Sprintf(`%s:%s `, k, v)
@@ -45,25 +56,232 @@ func (r Row) String() string {
 	return strings.TrimSpace(sb.String())
 }
 
+// Values returns the row values in the order of the given headers, using "" for missing columns.
+func (r Row) Values(headers []string) []string {
+	vals := make([]string, len(headers))
+	for i, h := range headers {
+		vals[i] = r[h]
+	}
+	return vals
+}
+
+// Columns returns the sorted union of column names across all rows.
+func (rr *RunResult) Columns() []string {
+	seen := map[string]bool{}
+	cols := []string{}
+	for _, r := range rr.Rows {
+		for k := range r {
+			if !seen[k] {
+				seen[k] = true
+				cols = append(cols, k)
+			}
+		}
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// CSV renders the rows as RFC 4180 CSV, with a header row. If headers is nil, Columns() is used.
+func (rr *RunResult) CSV(headers []string) ([]byte, error) {
+	if headers == nil {
+		headers = rr.Columns()
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(headers); err != nil {
+		return nil, err
+	}
+	for _, r := range rr.Rows {
+		if err := w.Write(r.Values(headers)); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Pretty renders the rows as an aligned table, similar to the osqueryi ".mode pretty" output.
+// If headers is nil, Columns() is used.
+func (rr *RunResult) Pretty(headers []string) string {
+	if headers == nil {
+		headers = rr.Columns()
+	}
+
+	widths := make([]int, len(headers))
+	for i, h := range headers {
+		widths[i] = utf8.RuneCountInString(h)
+	}
+	for _, r := range rr.Rows {
+		for i, v := range r.Values(headers) {
+			if w := utf8.RuneCountInString(v); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	var sb strings.Builder
+	divider := func() {
+		for _, w := range widths {
+			sb.WriteString("+" + strings.Repeat("-", w+2))
+		}
+		sb.WriteString("+\n")
+	}
+	line := func(vals []string) {
+		for i, v := range vals {
+			sb.WriteString("| " + v + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v)) + " ")
+		}
+		sb.WriteString("|\n")
+	}
+
+	divider()
+	line(headers)
+	divider()
+	for _, r := range rr.Rows {
+		line(r.Values(headers))
+	}
+	divider()
+	return sb.String()
+}
+
 // IsIncompatible returns "" if compatible, or a string of the platform this query is compatible with.
 func IsIncompatible(m *Metadata) string {
-	other := ""
-	if m.Platform != "" && m.Platform != runtime.GOOS {
-		if m.Platform == "posix" {
-			if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
-				other = "posix"
+	return incompatibleWith(m, runtime.GOOS)
+}
+
+// incompatibleWith returns "" if the query is compatible with goos, or a string of the platforms this query is compatible with.
+func incompatibleWith(m *Metadata, goos string) string {
+	ps := m.Platforms()
+	if len(ps) == 0 {
+		return ""
+	}
+
+	for _, p := range ps {
+		switch p {
+		case goos, "any", "all":
+			return ""
+		case "posix":
+			if goos == "linux" || goos == "darwin" {
+				return ""
 			}
-		} else {
-			other = m.Platform
 		}
 	}
-	return other
+	return m.Platform
 }
 
+// DefaultOsqueryi is the osqueryi binary that is run when RunConfig does not name one.
+const DefaultOsqueryi = "osqueryi"
+
+// RunConfig configures how osqueryi is invoked. A nil *RunConfig uses the defaults.
+type RunConfig struct {
+	// Osqueryi is the name or path of the osqueryi binary, searched for in $PATH if it has no path separators.
+	Osqueryi string
+	// Flags are additional osqueryi arguments, appended after --json.
+	Flags []string
+	// Seed is the path to an osquery configuration for deterministic runs, typically defining
+	// auto_table_construction tables backed by a SQLite fixture. Events are disabled when it is set.
+	Seed string
+}
+
+// osqueryi returns the name or path of the osqueryi binary to run.
+func (c *RunConfig) osqueryi() string {
+	if c == nil || c.Osqueryi == "" {
+		return DefaultOsqueryi
+	}
+	return c.Osqueryi
+}
+
+// jsonArgs returns the arguments for running osqueryi with JSON output.
+func (c *RunConfig) jsonArgs() []string {
+	args := []string{"--json"}
+	if c == nil {
+		return args
+	}
+	if c.Seed != "" {
+		args = append(args, "--disable_events", "--config_path="+c.Seed)
+	}
+	return append(args, c.Flags...)
+}
+
+// LookPath returns the path to the osqueryi binary, or an error if it does not exist or is not executable.
+func (c *RunConfig) LookPath() (string, error) {
+	return exec.LookPath(c.osqueryi())
+}
+
+// missingTableRe matches the osqueryi error for a query that references a table it does not have.
+var missingTableRe = regexp.MustCompile(`no such table: ([\w.]+)`)
+
+// MissingTableError is returned when osqueryi fails a query because it references a table that does not exist.
+type MissingTableError struct {
+	// Table is the name of the missing table, as reported by osqueryi.
+	Table string
+	Err   error
+}
+
+func (e *MissingTableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MissingTableError) Unwrap() error {
+	return e.Err
+}
+
+// missingTable returns the name of the missing table that stderr from osqueryi complains about, or "".
+func missingTable(stderr string) string {
+	match := missingTableRe.FindStringSubmatch(stderr)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// runError wraps err in a *MissingTableError if stderr names a missing table.
+func runError(err error, stderr string) error {
+	if table := missingTable(stderr); table != "" {
+		return &MissingTableError{Table: table, Err: err}
+	}
+	return err
+}
+
+// partialResult returns true if stderr from osqueryi can be ignored because the query uses tables
+// that are not available on this platform, logging why.
+func partialResult(incompatible string, stderr string) bool {
+	if incompatible == "" || !strings.Contains(stderr, "no such table:") {
+		return false
+	}
+	klog.Infof("partial test due to incompatible platform %q: %s", incompatible, strings.TrimSpace(stderr))
+	return true
+}
+
+// Version returns the version reported by osqueryi, for example "5.9.1".
+func Version(c *RunConfig) (string, error) {
+	cmd := exec.Command(c.osqueryi(), "--version")
+	stdout, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", cmd, err)
+	}
+
+	fields := strings.Fields(string(stdout))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s: no version in output", cmd)
+	}
+	return fields[len(fields)-1], nil
+}
+
+// Run runs a query within a new osqueryi process, using the default RunConfig.
 func Run(m *Metadata) (*RunResult, error) {
+	return RunContext(context.Background(), m, nil)
+}
+
+// RunContext runs a query within a new osqueryi process, which is killed if the context is done first.
+func RunContext(ctx context.Context, m *Metadata, c *RunConfig) (*RunResult, error) {
 	incompatible := IsIncompatible(m)
 
-	cmd := exec.Command("osqueryi", "--json")
+	cmd := exec.CommandContext(ctx, c.osqueryi(), c.jsonArgs()...)
+	// Don't wait forever for children of a killed osqueryi to close its output
+	cmd.WaitDelay = time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("error: %v", err)
@@ -81,26 +299,47 @@ func Run(m *Metadata) (*RunResult, error) {
 	stdout, err := cmd.Output()
 	elapsed := time.Since(start)
 
-	ignoreError := false
-	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			if incompatible != "" && ee.ExitCode() == 1 && bytes.Contains(ee.Stderr, []byte("no such table:")) {
-				klog.Infof("partial test due to incompatible platform %q: %s", incompatible, strings.TrimSpace(string(ee.Stderr)))
-				ignoreError = true
-			} else {
-				return nil, fmt.Errorf("%s [%w]: %s\nstdin: %s", cmd, err, ee.Stderr, m.Query)
-			}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if errors.Is(ctxErr, context.Canceled) {
+			return nil, fmt.Errorf("%q cancelled after %s: %w", m.Name, elapsed.Round(time.Millisecond), ctxErr)
 		}
-		if !ignoreError {
+		return nil, fmt.Errorf("%q timed out after %s: %w", m.Name, elapsed.Round(time.Millisecond), ctxErr)
+	}
+
+	if err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
 			return nil, fmt.Errorf("%s: %w", cmd, err)
 		}
+		if ee.ExitCode() != 1 || !partialResult(incompatible, stderr.String()) {
+			return nil, runError(fmt.Errorf("%s [%w]: %s\nstdin: %s", cmd, err, stderr.String(), m.Query), stderr.String())
+		}
 	}
 
+	// Any remaining error is a partial result, for a query that is incompatible with this platform
+	partial := err != nil
+
 	rows := []Row{}
 	err = json.Unmarshal(stdout, &rows)
 	if err != nil {
 		klog.Errorf("unable to parse output: %v", err)
 	}
 
-	return &RunResult{IncompatiblePlatform: incompatible, Rows: rows, Elapsed: elapsed}, nil
+	rr := &RunResult{IncompatiblePlatform: incompatible, Rows: rows, Elapsed: elapsed}
+	// The stderr of a partial result explains the failure, rather than warning about the results
+	if !partial {
+		rr.Warnings = warnings(stderr.String())
+	}
+	return rr, nil
+}
+
+// warnings splits the stderr of a successful osqueryi run into non-empty lines.
+func warnings(stderr string) []string {
+	var lines []string
+	for _, l := range strings.Split(stderr, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
 }
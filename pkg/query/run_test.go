@@ -0,0 +1,223 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIncompatibleWith(t *testing.T) {
+	tests := []struct {
+		platform string
+		goos     string
+		want     string
+	}{
+		{platform: "linux,darwin", goos: "linux", want: ""},
+		{platform: "linux,darwin", goos: "darwin", want: ""},
+		{platform: "linux,darwin", goos: "windows", want: "linux,darwin"},
+		{platform: "posix", goos: "darwin", want: ""},
+		{platform: "posix", goos: "windows", want: "posix"},
+		{platform: "windows", goos: "linux", want: "windows"},
+		{platform: "", goos: "linux", want: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.platform+"/"+tc.goos, func(t *testing.T) {
+			m := &Metadata{Platform: tc.platform}
+			if got := incompatibleWith(m, tc.goos); got != tc.want {
+				t.Errorf("incompatibleWith(%q, %q) = %q, want %q", tc.platform, tc.goos, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRowValues(t *testing.T) {
+	r := Row{"name": "bash", "pid": "1"}
+	got := r.Values([]string{"pid", "missing", "name"})
+	want := []string{"1", "", "bash"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Values() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRowText(t *testing.T) {
+	r := Row{"name": "bash", "pid": "1", "cmdline": "/bin/bash -l"}
+	if got, want := r.Text([]string{"pid", "missing", "cmdline"}), "pid:1 missing: cmdline:'/bin/bash -l'"; got != want {
+		t.Errorf("Text() = %q, want %q", got, want)
+	}
+	if got, want := r.String(), "cmdline:'/bin/bash -l' name:bash pid:1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestRunResultCSV(t *testing.T) {
+	rr := &RunResult{Rows: []Row{
+		{"name": "plain", "cmdline": "a,b"},
+		{"name": `say "hi"`, "cmdline": "line1\nline2"},
+		{"name": "sparse"},
+	}}
+
+	got, err := rr.CSV(nil)
+	if err != nil {
+		t.Fatalf("CSV: %v", err)
+	}
+
+	want := "cmdline,name\n" +
+		"\"a,b\",plain\n" +
+		"\"line1\nline2\",\"say \"\"hi\"\"\"\n" +
+		",sparse\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("CSV() mismatch (-want +got):\n%s", diff)
+	}
+
+	got, err = rr.CSV([]string{"name"})
+	if err != nil {
+		t.Fatalf("CSV: %v", err)
+	}
+	want = "name\nplain\n\"say \"\"hi\"\"\"\nsparse\n"
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("CSV() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunResultPretty(t *testing.T) {
+	rr := &RunResult{Rows: []Row{
+		{"name": "launchd", "pid": "1"},
+		{"name": "sh", "pid": "31337", "cwd": "/"},
+	}}
+
+	want := `+-----+---------+-------+
+| cwd | name    | pid   |
++-----+---------+-------+
+|     | launchd | 1     |
+| /   | sh      | 31337 |
++-----+---------+-------+
+`
+	if diff := cmp.Diff(want, rr.Pretty(nil)); diff != "" {
+		t.Errorf("Pretty() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunSeed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub osqueryi requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "osqueryi")
+	stub := `#!/bin/sh
+cat > /dev/null
+echo "[{\"args\":\"$*\"}]"
+`
+	if err := os.WriteFile(path, []byte(stub), 0o700); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	seed := filepath.Join(dir, "fixture.conf")
+	c := &RunConfig{Osqueryi: path, Seed: seed, Flags: []string{"--verbose"}}
+
+	rr, err := RunContext(context.Background(), &Metadata{Name: "users", Query: "SELECT * FROM fixture_users;"}, c)
+	if err != nil {
+		t.Fatalf("RunContext() = %v", err)
+	}
+	want := []Row{{"args": "--json --disable_events --config_path=" + seed + " --verbose"}}
+	if diff := cmp.Diff(want, rr.Rows); diff != "" {
+		t.Errorf("osqueryi arguments mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunWarnings(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub osqueryi requires a POSIX shell")
+	}
+
+	path := filepath.Join(t.TempDir(), "osqueryi")
+	stub := `#!/bin/sh
+cat > /dev/null
+echo "Warning: the uptime column is deprecated" >&2
+echo "" >&2
+echo "Warning: coercing size to INTEGER" >&2
+echo '[{"uptime":"42"}]'
+`
+	if err := os.WriteFile(path, []byte(stub), 0o700); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	rr, err := RunContext(context.Background(), &Metadata{Name: "uptime", Query: "SELECT * FROM uptime;"}, &RunConfig{Osqueryi: path})
+	if err != nil {
+		t.Fatalf("RunContext() = %v", err)
+	}
+	if diff := cmp.Diff([]Row{{"uptime": "42"}}, rr.Rows); diff != "" {
+		t.Errorf("rows mismatch (-want +got):\n%s", diff)
+	}
+	want := []string{"Warning: the uptime column is deprecated", "Warning: coercing size to INTEGER"}
+	if diff := cmp.Diff(want, rr.Warnings); diff != "" {
+		t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunIncompatiblePlatform(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub osqueryi requires a POSIX shell")
+	}
+
+	path := filepath.Join(t.TempDir(), "osqueryi")
+	stub := `#!/bin/sh
+cat > /dev/null
+echo "Error: near line 1: no such table: xprotect_reports" >&2
+exit 1
+`
+	if err := os.WriteFile(path, []byte(stub), 0o700); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	c := &RunConfig{Osqueryi: path}
+
+	other := "darwin"
+	if runtime.GOOS == "darwin" {
+		other = "linux"
+	}
+
+	rr, err := RunContext(context.Background(), &Metadata{Name: "xprotect", Query: "SELECT * FROM xprotect_reports;", Platform: other}, c)
+	if err != nil {
+		t.Fatalf("RunContext(%s query) = %v", other, err)
+	}
+	if rr.IncompatiblePlatform != other {
+		t.Errorf("IncompatiblePlatform = %q, want %q", rr.IncompatiblePlatform, other)
+	}
+	if rr.Warnings != nil {
+		t.Errorf("Warnings = %q, want none for a partial result", rr.Warnings)
+	}
+
+	_, err = RunContext(context.Background(), &Metadata{Name: "xprotect", Query: "SELECT * FROM xprotect_reports;"}, c)
+	if err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Errorf("RunContext(compatible query) = %v, want no such table error", err)
+	}
+	var mt *MissingTableError
+	if !errors.As(err, &mt) || mt.Table != "xprotect_reports" {
+		t.Errorf("RunContext(compatible query) = %v, want *MissingTableError for xprotect_reports", err)
+	}
+}
+
+func TestMissingTable(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   string
+	}{
+		{stderr: "Error: near line 1: no such table: xprotect_reports\n", want: "xprotect_reports"},
+		{stderr: "Error: no such table: main.users", want: "main.users"},
+		{stderr: "W1017 12:00:00.000 warning\nError: near line 3: no such table: chrome_extensions\n", want: "chrome_extensions"},
+		{stderr: "Error: near line 1: no such column: pid\n", want: ""},
+		{stderr: "", want: ""},
+	}
+
+	for _, tc := range tests {
+		if got := missingTable(tc.stderr); got != tc.want {
+			t.Errorf("missingTable(%q) = %q, want %q", tc.stderr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// sentinelColumn is the column returned by the query sent after each query, marking the end of its results.
+const sentinelColumn = "osqtool_sentinel"
+
+// Session runs queries within a single long-lived osqueryi process, so that its startup cost is paid once.
+// If osqueryi exits while running a query, the failure is attributed to that query, and a new
+// process is started for the next one. A Session is safe for concurrent use, but runs one query at a time.
+type Session struct {
+	mu     sync.Mutex
+	config *RunConfig
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *json.Decoder
+	stderr chan string
+	n      int
+}
+
+// NewSession starts an osqueryi process for running queries, using the default RunConfig if c is nil.
+func NewSession(c *RunConfig) (*Session, error) {
+	s := &Session{config: c}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) start() error {
+	cmd := exec.Command(s.config.osqueryi(), s.config.jsonArgs()...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("stderr: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %w", cmd, err)
+	}
+	klog.V(1).Infof("started osqueryi session (pid %d)", cmd.Process.Pid)
+
+	// stderr is consumed continuously so that a noisy query can not block osqueryi
+	lines := make(chan string, 64)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	s.cmd = cmd
+	s.stdin = stdin
+	s.stdout = json.NewDecoder(stdout)
+	s.stderr = lines
+	return nil
+}
+
+// stop terminates the osqueryi process, returning anything it had left to say on stderr.
+func (s *Session) stop() string {
+	if s.cmd == nil {
+		return ""
+	}
+
+	s.stdin.Close()
+	remaining := []string{}
+	for l := range s.stderr {
+		remaining = append(remaining, l)
+	}
+	if err := s.cmd.Wait(); err != nil {
+		klog.V(1).Infof("osqueryi session exited: %v", err)
+	}
+	s.cmd = nil
+	return strings.Join(remaining, "\n")
+}
+
+// Close stops the osqueryi process.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+	return nil
+}
+
+// Run runs a query within the session, with the same semantics as Run.
+func (s *Session) Run(m *Metadata) (*RunResult, error) {
+	return s.RunContext(context.Background(), m)
+}
+
+// RunContext runs a query within the session. If the context is done first, the osqueryi
+// process is killed, and a new one is started for the next query.
+func (s *Session) RunContext(ctx context.Context, m *Metadata) (*RunResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func(p *os.Process) {
+		select {
+		case <-ctx.Done():
+			if err := p.Kill(); err != nil {
+				klog.Errorf("kill osqueryi: %v", err)
+			}
+		case <-finished:
+		}
+	}(s.cmd.Process)
+
+	rr, err := s.run(m)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		if errors.Is(ctxErr, context.Canceled) {
+			return nil, fmt.Errorf("%q cancelled: %w", m.Name, ctxErr)
+		}
+		return nil, fmt.Errorf("%q timed out: %w", m.Name, ctxErr)
+	}
+	return rr, err
+}
+
+func (s *Session) run(m *Metadata) (*RunResult, error) {
+	incompatible := IsIncompatible(m)
+	s.n++
+	want := fmt.Sprintf("osqtool-%d", s.n)
+	// The second sentinel is an invalid query, so that its error marks the end of this query's errors on stderr
+	marker := fmt.Sprintf("%s_%d", sentinelColumn, s.n)
+
+	// Terminate the query, which may lack a semicolon, so that it is not joined with the sentinel.
+	// The terminator is on its own line in case the query ends with a comment.
+	q := strings.TrimSpace(m.Query)
+	if !strings.HasSuffix(q, ";") {
+		q += "\n;"
+	}
+
+	start := time.Now()
+	input := fmt.Sprintf("%s\nSELECT '%s' AS %s;\nSELECT %s;\n", q, want, sentinelColumn, marker)
+	if _, err := io.WriteString(s.stdin, input); err != nil {
+		return nil, fmt.Errorf("osqueryi exited before %q could run: %s", m.Name, s.stop())
+	}
+
+	rows := []Row{}
+	for {
+		batch := []Row{}
+		if err := s.stdout.Decode(&batch); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("osqueryi exited while running %q: %s\nstdin: %s", m.Name, s.stop(), m.Query)
+			}
+			stderr := s.stop()
+			return nil, fmt.Errorf("unable to parse output of %q: %w: %s", m.Name, err, stderr)
+		}
+		if len(batch) == 1 && batch[0][sentinelColumn] == want {
+			break
+		}
+		rows = append(rows, batch...)
+	}
+	elapsed := time.Since(start)
+
+	errs := []string{}
+	for {
+		l, ok := <-s.stderr
+		if !ok {
+			return nil, fmt.Errorf("osqueryi exited while running %q: %s", m.Name, strings.Join(append(errs, s.stop()), "\n"))
+		}
+		if strings.HasSuffix(strings.TrimSpace(l), marker) {
+			break
+		}
+		errs = append(errs, l)
+	}
+
+	rr := &RunResult{IncompatiblePlatform: incompatible, Rows: rows, Elapsed: elapsed}
+	if len(errs) == 0 {
+		return rr, nil
+	}
+
+	stderr := strings.Join(errs, "\n")
+	switch {
+	case partialResult(incompatible, stderr):
+	// Without an exit code to go by, only errors reported by the shell fail the query
+	case shellError(errs):
+		return nil, runError(fmt.Errorf("osqueryi session: %s\nstdin: %s", stderr, m.Query), stderr)
+	default:
+		rr.Warnings = warnings(stderr)
+	}
+	return rr, nil
+}
+
+// shellError returns true if any line of stderr is an error reported by the osqueryi shell.
+func shellError(lines []string) bool {
+	for _, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "Error:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package query
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// interactiveStub emulates an interactive osqueryi session, recording each start in a file.
+// Like osqueryi, lines are joined until a statement is terminated by a semicolon.
+const interactiveStub = `#!/bin/sh
+echo started >> "$STARTS"
+stmt=""
+while IFS= read -r line; do
+  stmt="$stmt$line"
+  case "$stmt" in
+    *";") line="$stmt"; stmt="" ;;
+    *) stmt="$stmt "; continue ;;
+  esac
+  case "$line" in
+    "SELECT '"*"AS osqtool_sentinel;") echo "[{\"osqtool_sentinel\":\"$(echo "$line" | sed "s/.*'\(.*\)'.*/\1/")\"}]" ;;
+    "SELECT osqtool_sentinel_"*) echo "Error: near line 1: no such column: $(echo "$line" | sed 's/SELECT \(.*\);/\1/')" >&2 ;;
+    *crash*) exit 139 ;;
+    *warn*) echo "W1017 12:00:00.000000 1 deprecated.cpp:1] this table is deprecated" >&2; printf '[\n  {"a":"1"}\n]\n' ;;
+    *broken*) echo "Error: near line 1: near \"broken\": syntax error" >&2 ;;
+    *empty*) printf '[\n\n]\n' ;;
+    *) printf '[\n  {"a":"1"},\n  {"a":"2"}\n]\n' ;;
+  esac
+done
+`
+
+func TestSession(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub osqueryi requires a POSIX shell")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "osqueryi"), []byte(interactiveStub), 0o700); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	starts := filepath.Join(dir, "starts")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("STARTS", starts)
+
+	s, err := NewSession(nil)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		query   string
+		want    []Row
+		wantErr string
+		warns   int
+	}{
+		{name: "good", query: "SELECT a FROM t;", want: []Row{{"a": "1"}, {"a": "2"}}},
+		{name: "no-semicolon", query: "SELECT a FROM t -- trailing comment", want: []Row{{"a": "1"}, {"a": "2"}}},
+		{name: "empty", query: "SELECT a FROM empty;", want: []Row{}},
+		{name: "warning", query: "SELECT a FROM warn;", want: []Row{{"a": "1"}}, warns: 1},
+		{name: "broken", query: "SELECT broken;", wantErr: "syntax error"},
+		{name: "after-error", query: "SELECT a FROM t;", want: []Row{{"a": "1"}, {"a": "2"}}},
+		{name: "crash", query: "SELECT crash();", wantErr: "osqueryi exited while running \"crash\""},
+		{name: "after-crash", query: "SELECT a FROM t;", want: []Row{{"a": "1"}, {"a": "2"}}},
+	}
+
+	for _, tc := range tests {
+		rr, err := s.Run(&Metadata{Name: tc.name, Query: tc.query})
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: Run() error = %v, want %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Run() = %v", tc.name, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, rr.Rows); diff != "" {
+			t.Errorf("%s: rows mismatch (-want +got):\n%s", tc.name, diff)
+		}
+		if len(rr.Warnings) != tc.warns {
+			t.Errorf("%s: got %d warnings (%q), want %d", tc.name, len(rr.Warnings), rr.Warnings, tc.warns)
+		}
+	}
+
+	bs, err := os.ReadFile(starts)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := strings.Count(string(bs), "started"); got != 2 {
+		t.Errorf("osqueryi started %d times, want 2 (once, then after the crash)", got)
+	}
+}
@@ -0,0 +1,297 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sidecarExtensions are the suffixes appended to a query path to find its sidecar metadata file.
+var sidecarExtensions = []string{".yaml", ".yml"}
+
+// sidecar is query metadata stored in a YAML file alongside the query, for example "foo.sql.yaml" or "foo.yaml".
+// Only the flat subset of YAML understood by parseFlatYAML is supported, and anything else is an error.
+type sidecar struct {
+	path   string
+	keys   []string
+	values map[string][]string
+}
+
+// sidecarPaths returns the paths that may hold the sidecar metadata for a query path.
+func sidecarPaths(path string) []string {
+	paths := []string{}
+	for _, ext := range sidecarExtensions {
+		paths = append(paths, path+ext)
+	}
+	if base, ok := strings.CutSuffix(path, ".sql"); ok {
+		for _, ext := range sidecarExtensions {
+			paths = append(paths, base+ext)
+		}
+	}
+	return paths
+}
+
+// loadSidecar loads the sidecar metadata for a query path, returning nil if there is none.
+func loadSidecar(path string) (*sidecar, error) {
+	var found *sidecar
+	for _, p := range sidecarPaths(path) {
+		bs, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %v", err)
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s: conflicts with sidecar %s", p, found.path)
+		}
+
+		sc, err := parseSidecar(bs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		sc.path = p
+		found = sc
+	}
+	return found, nil
+}
+
+// parseSidecar parses the flat YAML subset understood by sidecar files.
+func parseSidecar(bs []byte) (*sidecar, error) {
+	keys, values, err := parseFlatYAML(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key != "description" && !directives[key] {
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return &sidecar{keys: keys, values: values}, nil
+}
+
+// yamlIndicators begin YAML constructs outside of the flat subset, such as block scalars, anchors,
+// aliases, tags, and flow mappings, or characters that YAML reserves.
+const yamlIndicators = "|>&*!%@`{}]?,"
+
+// parseFlatYAML parses the flat subset of YAML used by sidecar and tag files: a mapping of "key: value"
+// pairs, where each value is a scalar, a flow sequence of scalars such as "[a, b]", or a block sequence
+// of "- item" lines below its key. Scalars are plain, or quoted without escape sequences, and may be
+// followed by a comment. Anything else, such as nested mappings, block scalars, anchors, or multiple
+// documents, is rejected rather than misread. Keys are returned in file order.
+func parseFlatYAML(bs []byte) ([]string, map[string][]string, error) {
+	keys := []string{}
+	values := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(bs, utf8BOM)))
+	// list is the key whose block sequence items may follow, if any
+	list := ""
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == "---" {
+			if len(keys) > 0 {
+				return nil, nil, fmt.Errorf("line %d: multiple documents are not supported", n)
+			}
+			continue
+		}
+
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			if list == "" {
+				return nil, nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			item, err := parseScalar(strings.TrimPrefix(trimmed, "-"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			values[list] = append(values[list], item)
+			continue
+		}
+
+		if line != strings.TrimLeft(line, " \t") {
+			return nil, nil, fmt.Errorf("line %d: nested values are not supported, got %q", n, line)
+		}
+		key, value, err := cutKey(trimmed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if _, dup := values[key]; dup {
+			return nil, nil, fmt.Errorf("line %d: duplicate key %q", n, key)
+		}
+		keys = append(keys, key)
+		list = ""
+
+		switch {
+		case value == "" || strings.HasPrefix(value, "#"):
+			values[key] = []string{}
+			list = key
+		case strings.HasPrefix(value, "["):
+			items, err := parseFlowSequence(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			values[key] = items
+		default:
+			v, err := parseScalar(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			values[key] = []string{v}
+		}
+	}
+
+	return keys, values, scanner.Err()
+}
+
+// cutKey splits a "key: value" line, where the key may be quoted.
+func cutKey(line string) (string, string, error) {
+	if line[0] == '"' || line[0] == '\'' {
+		key, rest, err := cutQuoted(line)
+		if err != nil {
+			return "", "", fmt.Errorf("key: %w", err)
+		}
+		rest, ok := strings.CutPrefix(rest, ":")
+		if !ok || (rest != "" && rest[0] != ' ') {
+			return "", "", fmt.Errorf("expected 'key: value', got %q", line)
+		}
+		return key, strings.TrimSpace(rest), nil
+	}
+
+	if strings.ContainsRune(yamlIndicators+"#-", rune(line[0])) {
+		return "", "", fmt.Errorf("unsupported key %q", line)
+	}
+	i := strings.Index(line, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(line, ":") {
+			return "", "", fmt.Errorf("expected 'key: value', got %q", line)
+		}
+		i = len(line) - 1
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), nil
+}
+
+// cutQuoted returns the value of the single or double quoted string at the start of s, and the
+// remainder of s after its closing quote. Within single quotes, a doubled quote is a literal quote,
+// and no other escape sequences are supported.
+func cutQuoted(s string) (string, string, error) {
+	q := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			sb.WriteByte('\'')
+			i++
+		case s[i] == q:
+			return sb.String(), s[i+1:], nil
+		case s[i] == '\\' && q == '"':
+			return "", "", fmt.Errorf("escape sequences are not supported: %s", s)
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted string: %s", s)
+}
+
+// parseScalar parses a plain or quoted scalar, which may be followed by a comment.
+func parseScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || strings.HasPrefix(s, "#"):
+		return "", fmt.Errorf("empty value")
+	case s[0] == '"' || s[0] == '\'':
+		v, rest, err := cutQuoted(s)
+		if err != nil {
+			return "", err
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after quoted value", rest)
+		}
+		return v, nil
+	case strings.ContainsRune(yamlIndicators+"[", rune(s[0])), s == "-", strings.HasPrefix(s, "- "):
+		return "", fmt.Errorf("unsupported value %q", s)
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if strings.Contains(s, ": ") || strings.HasSuffix(s, ":") {
+		return "", fmt.Errorf("nested mappings are not supported, got %q", s)
+	}
+	return s, nil
+}
+
+// parseFlowSequence parses a flow sequence of scalars such as "[a, 'b c']", which may be followed by a comment.
+func parseFlowSequence(s string) ([]string, error) {
+	items := []string{}
+	rest := strings.TrimSpace(strings.TrimPrefix(s, "["))
+	for {
+		// An empty list, or a trailing comma
+		if strings.HasPrefix(rest, "]") {
+			break
+		}
+
+		var item string
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			v, after, err := cutQuoted(rest)
+			if err != nil {
+				return nil, err
+			}
+			item, rest = v, strings.TrimSpace(after)
+		} else {
+			end := strings.IndexAny(rest, ",]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated list: %s", s)
+			}
+			v, err := parseScalar(rest[:end])
+			if err != nil {
+				return nil, err
+			}
+			item, rest = v, rest[end:]
+		}
+		items = append(items, item)
+
+		if r, ok := strings.CutPrefix(rest, ","); ok {
+			rest = strings.TrimSpace(r)
+			continue
+		}
+		if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected ',' or ']' in list: %s", s)
+		}
+		break
+	}
+
+	if rest = strings.TrimSpace(strings.TrimPrefix(rest, "]")); rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, fmt.Errorf("unexpected %q after list", rest)
+	}
+	return items, nil
+}
+
+// apply overrides query metadata with the values from the sidecar.
+func (sc *sidecar) apply(m *Metadata) error {
+	for _, key := range sc.keys {
+		vs := sc.values[key]
+		switch key {
+		case "description":
+			m.Description = strings.Join(vs, " ")
+		case "tags":
+			m.Tags = vs
+		case "platform":
+			m.Platform = strings.Join(vs, ",")
+		default:
+			if len(vs) != 1 {
+				return fmt.Errorf("%s: %q expects a single value", sc.path, key)
+			}
+			if err := applyDirective(m, key, vs[0]); err != nil {
+				return fmt.Errorf("%s: %w", sc.path, err)
+			}
+		}
+	}
+	return nil
+}
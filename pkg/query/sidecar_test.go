@@ -0,0 +1,81 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseFlatYAML(t *testing.T) {
+	in := `---
+# metadata
+description: Users currently logged in # shown by docs
+interval: "600"
+platform: [linux, 'macos', ] # trailing comma
+"*-linux": it's
+tags:
+  - often
+  - 'who''s there'
+empty:
+`
+	keys, values, err := parseFlatYAML([]byte(in))
+	if err != nil {
+		t.Fatalf("parseFlatYAML() = %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"description", "interval", "platform", "*-linux", "tags", "empty"}, keys); diff != "" {
+		t.Errorf("keys mismatch (-want +got):\n%s", diff)
+	}
+	want := map[string][]string{
+		"description": {"Users currently logged in"},
+		"interval":    {"600"},
+		"platform":    {"linux", "macos"},
+		"*-linux":     {"it's"},
+		"tags":        {"often", "who's there"},
+		"empty":       {},
+	}
+	if diff := cmp.Diff(want, values); diff != "" {
+		t.Errorf("values mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseFlatYAMLUnsupported(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{name: "block scalar", in: "description: |\n  Users\n  logged in\n", wantErr: "unsupported value"},
+		{name: "folded scalar", in: "description: >-\n  Users\n", wantErr: "unsupported value"},
+		{name: "nested mapping", in: "platform:\n  linux: true\n", wantErr: "nested values are not supported"},
+		{name: "inline mapping", in: "description: a: b\n", wantErr: "nested mappings are not supported"},
+		{name: "flow mapping", in: "tags: {a: b}\n", wantErr: "unsupported value"},
+		{name: "nested list", in: "tags:\n  - [a, b]\n", wantErr: "unsupported value"},
+		{name: "list of lists", in: "tags:\n  - - a\n", wantErr: "unsupported value"},
+		{name: "list of mappings", in: "tags:\n  - name: a\n", wantErr: "nested mappings are not supported"},
+		{name: "list after value", in: "tags: a\n  - b\n", wantErr: "list item without a key"},
+		{name: "anchor", in: "tags: &t [a]\n", wantErr: "unsupported value"},
+		{name: "alias", in: "tags: *t\n", wantErr: "unsupported value"},
+		{name: "tag", in: "interval: !!int 60\n", wantErr: "unsupported value"},
+		{name: "escape", in: "description: \"a\\tb\"\n", wantErr: "escape sequences are not supported"},
+		{name: "unterminated", in: "description: 'users\n", wantErr: "unterminated quoted string"},
+		{name: "text after quote", in: "description: 'a' b\n", wantErr: "unexpected"},
+		{name: "quoted comma", in: "tags: [\"a, b\" c]\n", wantErr: "expected ',' or ']'"},
+		{name: "unterminated list", in: "tags: [a, b\n", wantErr: "unterminated list"},
+		{name: "multi-line scalar", in: "description: Users\n  logged in\n", wantErr: "nested values are not supported"},
+		{name: "complex key", in: "? description\n: Users\n", wantErr: "unsupported key"},
+		{name: "no value", in: "description\n", wantErr: "expected 'key: value'"},
+		{name: "documents", in: "interval: 60\n---\ninterval: 120\n", wantErr: "multiple documents"},
+		{name: "duplicate", in: "interval: 60\ninterval: 120\n", wantErr: "duplicate key"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := parseFlatYAML([]byte(tc.in))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("parseFlatYAML(%q) = %v, want error containing %q", tc.in, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package query
+
+// AnyPlatform is the SplitPack bucket for queries that do not name a platform.
+const AnyPlatform = "any"
+
+// SplitPack splits a pack into one pack per platform, keyed by platform name. Queries that name several
+// platforms appear in each of their packs, and queries without a platform are placed in the AnyPlatform pack.
+// If expandPosix is set, posix queries appear in both the linux and darwin packs rather than a posix pack.
+// Pack-level fields and discovery queries are copied to each pack.
+func SplitPack(p *Pack, expandPosix bool) map[string]*Pack {
+	packs := map[string]*Pack{}
+
+	add := func(platform string, name string, m *Metadata) {
+		sp := packs[platform]
+		if sp == nil {
+			sp = &Pack{
+				Queries:   map[string]*Metadata{},
+				Discovery: p.Discovery,
+				Shard:     p.Shard,
+				Platform:  p.Platform,
+				Version:   p.Version,
+				Oncall:    p.Oncall,
+			}
+			packs[platform] = sp
+		}
+		sp.Queries[name] = m
+	}
+
+	for name, m := range p.Queries {
+		platforms := m.Platforms()
+		if len(platforms) == 0 {
+			add(AnyPlatform, name, m)
+			continue
+		}
+
+		for _, platform := range platforms {
+			switch {
+			case platform == "all":
+				add(AnyPlatform, name, m)
+			case platform == "posix" && expandPosix:
+				add("linux", name, m)
+				add("darwin", name, m)
+			default:
+				add(platform, name, m)
+			}
+		}
+	}
+	return packs
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Verification statuses of a query.
+const (
+	StatusVerified = "verified"
+	StatusPartial  = "partial"
+	StatusErrored  = "errored"
+)
+
+// VerifyResult is the outcome of verifying a single query.
+type VerifyResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+	Rows      int    `json:"rows"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NewVerifyResult returns the outcome of verifying a query, given its run result and error, either of which may be nil.
+func NewVerifyResult(name string, status string, rr *RunResult, err error) VerifyResult {
+	r := VerifyResult{Name: name, Status: status}
+	if rr != nil {
+		r.ElapsedMS = rr.Elapsed.Milliseconds()
+		r.Rows = len(rr.Rows)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// VerifySummary is a machine-readable report of the queries verified, and their projected daily cost.
+type VerifySummary struct {
+	Queries              []VerifyResult `json:"queries"`
+	Verified             int            `json:"verified"`
+	Partial              int            `json:"partial"`
+	Errored              int            `json:"errored"`
+	TotalDailyDurationMS int64          `json:"total_daily_duration_ms"`
+	TotalDailyRuns       int64          `json:"total_daily_runs"`
+}
+
+// Add records the outcome of verifying a query.
+func (s *VerifySummary) Add(r VerifyResult) {
+	s.Queries = append(s.Queries, r)
+	switch r.Status {
+	case StatusVerified:
+		s.Verified++
+	case StatusPartial:
+		s.Partial++
+	case StatusErrored:
+		s.Errored++
+	}
+}
+
+// SetTotals records the projected daily duration and number of runs across all queries.
+func (s *VerifySummary) SetTotals(duration time.Duration, runs int64) {
+	s.TotalDailyDurationMS = duration.Milliseconds()
+	s.TotalDailyRuns = runs
+}
+
+// Render renders the summary as indented JSON, with queries sorted by name.
+func (s *VerifySummary) Render() ([]byte, error) {
+	sort.Slice(s.Queries, func(i, j int) bool { return s.Queries[i].Name < s.Queries[j].Name })
+	if s.Queries == nil {
+		s.Queries = []VerifyResult{}
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
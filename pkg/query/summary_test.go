@@ -0,0 +1,46 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVerifySummary(t *testing.T) {
+	s := &VerifySummary{}
+	s.Add(NewVerifyResult("slow", StatusErrored, &RunResult{Elapsed: 5 * time.Second}, errors.New("too slow")))
+	s.Add(NewVerifyResult("fast", StatusVerified, &RunResult{Elapsed: 20 * time.Millisecond, Rows: []Row{{"a": "1"}, {"a": "2"}}}, nil))
+	s.Add(NewVerifyResult("elsewhere", StatusPartial, &RunResult{IncompatiblePlatform: "windows"}, nil))
+	s.Add(NewVerifyResult("missing", StatusErrored, nil, errors.New("no such table: foo")))
+	s.SetTotals(90*time.Second, 48)
+
+	bs, err := s.Render()
+	if err != nil {
+		t.Fatalf("Render() = %v", err)
+	}
+
+	got := VerifySummary{}
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, bs)
+	}
+
+	want := VerifySummary{
+		Queries: []VerifyResult{
+			{Name: "elsewhere", Status: StatusPartial},
+			{Name: "fast", Status: StatusVerified, ElapsedMS: 20, Rows: 2},
+			{Name: "missing", Status: StatusErrored, Error: "no such table: foo"},
+			{Name: "slow", Status: StatusErrored, ElapsedMS: 5000, Error: "too slow"},
+		},
+		Verified:             1,
+		Partial:              1,
+		Errored:              2,
+		TotalDailyDurationMS: 90000,
+		TotalDailyRuns:       48,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("VerifySummary mismatch (-want +got):\n%s", diff)
+	}
+}
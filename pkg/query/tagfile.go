@@ -0,0 +1,62 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// TagRule adds tags to every query whose name matches a glob pattern.
+type TagRule struct {
+	Pattern string
+	Tags    []string
+}
+
+// LoadTagFile loads tag rules from a YAML file mapping name globs to tags, for example:
+//
+//	process-*: [process]
+//	"*-linux": linux
+func LoadTagFile(p string) ([]TagRule, error) {
+	bs, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("read: %v", err)
+	}
+
+	keys, values, err := parseFlatYAML(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	rules := []TagRule{}
+	for _, k := range keys {
+		if _, err := path.Match(k, ""); err != nil {
+			return nil, fmt.Errorf("%s: pattern %q: %w", p, k, err)
+		}
+		rules = append(rules, TagRule{Pattern: k, Tags: values[k]})
+	}
+	return rules, nil
+}
+
+// ApplyTagRules adds the tags of each matching rule to a query, skipping any it already has.
+func ApplyTagRules(m *Metadata, rules []TagRule) {
+	for _, r := range rules {
+		if ok, _ := path.Match(r.Pattern, m.Name); !ok {
+			continue
+		}
+		for _, t := range r.Tags {
+			if !m.HasTag(t) {
+				m.Tags = append(m.Tags, t)
+			}
+		}
+	}
+}
+
+// HasTag returns true if the query has the tag.
+func (m *Metadata) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	tparse "text/template/parse"
+)
+
+// ExpandTemplate substitutes {{.key}} placeholders within a query using vars, including those within
+// SQL comments. It returns the names of the variables the query references, and an error if any of
+// them are missing from vars.
+func ExpandTemplate(m *Metadata, vars map[string]string) (map[string]bool, error) {
+	used := map[string]bool{}
+	for _, s := range []*string{&m.Query, &m.SingleLineQuery} {
+		if !strings.Contains(*s, "{{") {
+			continue
+		}
+
+		t, err := template.New(m.Name).Option("missingkey=error").Parse(*s)
+		if err != nil {
+			return used, fmt.Errorf("parse: %w", err)
+		}
+		templateFields(t.Tree.Root, used)
+
+		var sb strings.Builder
+		if err := t.Execute(&sb, vars); err != nil {
+			return used, fmt.Errorf("execute: %w", err)
+		}
+		*s = sb.String()
+	}
+	return used, nil
+}
+
+// templateFields records the top-level field names referenced within a template node, such as "key" for {{.key}}.
+func templateFields(n tparse.Node, used map[string]bool) {
+	switch n := n.(type) {
+	case *tparse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			templateFields(c, used)
+		}
+	case *tparse.ActionNode:
+		templateFields(n.Pipe, used)
+	case *tparse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			templateFields(c, used)
+		}
+	case *tparse.CommandNode:
+		for _, a := range n.Args {
+			templateFields(a, used)
+		}
+	case *tparse.FieldNode:
+		used[n.Ident[0]] = true
+	case *tparse.IfNode:
+		templateBranchFields(&n.BranchNode, used)
+	case *tparse.RangeNode:
+		templateBranchFields(&n.BranchNode, used)
+	case *tparse.WithNode:
+		templateBranchFields(&n.BranchNode, used)
+	}
+}
+
+// templateBranchFields records the field names referenced within a conditional template node.
+func templateBranchFields(n *tparse.BranchNode, used map[string]bool) {
+	templateFields(n.Pipe, used)
+	templateFields(n.List, used)
+	templateFields(n.ElseList, used)
+}
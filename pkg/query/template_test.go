@@ -0,0 +1,40 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	in := "-- Unexpected listeners\nSELECT * FROM listening_ports\nWHERE port > {{.min_port}}\n--$ AND NOT path = '{{.agent}}'\n;"
+	m, err := ParseWithConfig("listeners", []byte(in), &ParseConfig{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	used, err := ExpandTemplate(m, map[string]string{"min_port": "1024", "agent": "/opt/agent/bin/agent"})
+	if err != nil {
+		t.Fatalf("ExpandTemplate() = %v", err)
+	}
+	if diff := cmp.Diff(map[string]bool{"min_port": true, "agent": true}, used); diff != "" {
+		t.Errorf("used mismatch (-want +got):\n%s", diff)
+	}
+	for _, want := range []string{"port > 1024", "--$ AND NOT path = '/opt/agent/bin/agent'"} {
+		if !strings.Contains(m.Query, want) {
+			t.Errorf("Query = %q, missing %q", m.Query, want)
+		}
+	}
+	if !strings.Contains(m.SingleLineQuery, "port > 1024") {
+		t.Errorf("SingleLineQuery = %q, want substitution", m.SingleLineQuery)
+	}
+}
+
+func TestExpandTemplateMissing(t *testing.T) {
+	m := &Metadata{Name: "listeners", Query: "SELECT * FROM listening_ports WHERE port > {{.min_prot}};"}
+	_, err := ExpandTemplate(m, map[string]string{"min_port": "1024"})
+	if err == nil || !strings.Contains(err.Error(), "min_prot") {
+		t.Errorf("ExpandTemplate() = %v, want missing variable error", err)
+	}
+}
@@ -0,0 +1,3 @@
+﻿-- Kernel modules
+-- interval: 600
+SELECT name FROM kernel_modules;
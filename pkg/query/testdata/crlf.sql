@@ -0,0 +1,6 @@
+-- Logged in users
+-- interval: 900
+-- platform: windows
+SELECT user,
+  host
+FROM logged_in_users;
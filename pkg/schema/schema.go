@@ -0,0 +1,240 @@
+// Package schema provides offline knowledge of osquery tables and columns.
+package schema
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed data/*.json
+var data embed.FS
+
+// Column is a column within an osquery table.
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// Table is an osquery table, using the same layout as the osquery schema JSON published at https://osquery.io/schema.
+type Table struct {
+	Name      string   `json:"name"`
+	Platforms []string `json:"platforms,omitempty"`
+	Columns   []Column `json:"columns,omitempty"`
+}
+
+// Schema is a set of known osquery tables, indexed by name.
+type Schema struct {
+	Tables map[string]*Table
+	// Partial is set if the schema only lists some tables, so a table missing from it may still exist.
+	Partial bool
+}
+
+// Default returns the schema bundled with osqtool. It is a partial list of commonly queried tables,
+// rather than a copy of the full osquery schema, so is marked as Partial.
+func Default() (*Schema, error) {
+	bs, err := data.ReadFile("data/osquery.json")
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	s, err := Parse(bs)
+	if err != nil {
+		return nil, err
+	}
+	s.Partial = true
+	return s, nil
+}
+
+// Parse parses a JSON list of tables.
+func Parse(bs []byte) (*Schema, error) {
+	ts := []*Table{}
+	if err := json.Unmarshal(bs, &ts); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	s := &Schema{Tables: map[string]*Table{}}
+	for _, t := range ts {
+		if t.Name == "" {
+			return nil, fmt.Errorf("table with no name")
+		}
+		s.Tables[t.Name] = t
+	}
+	return s, nil
+}
+
+// LoadFile loads a JSON list of tables from a file.
+func LoadFile(path string) (*Schema, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	s, err := Parse(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// LoadVersion loads the schema snapshot for an osquery version from a directory of files named after
+// each version, such as "5.10.0.json", as published by the osquery project.
+func LoadVersion(dir string, version string) (*Schema, error) {
+	if version == "" || strings.ContainsAny(version, `/\`) {
+		return nil, fmt.Errorf("invalid version: %q", version)
+	}
+	return LoadFile(filepath.Join(dir, version+".json"))
+}
+
+// Merge adds the tables of another schema, replacing any tables of the same name.
+func (s *Schema) Merge(o *Schema) {
+	for name, t := range o.Tables {
+		s.Tables[name] = t
+	}
+}
+
+// HasTable returns true if the table is known to the schema.
+func (s *Schema) HasTable(name string) bool {
+	return s.Tables[strings.ToLower(name)] != nil
+}
+
+// sqliteTables are table-valued functions and virtual tables provided by SQLite itself.
+var sqliteTables = map[string]bool{
+	"json_each":     true,
+	"json_tree":     true,
+	"sqlite_master": true,
+	"sqlite_schema": true,
+}
+
+var (
+	stringLiteralRe = regexp.MustCompile(`'(?:[^']|'')*'|"(?:[^"]|"")*"`)
+	tableRe         = regexp.MustCompile(`(?i)\b(?:FROM|JOIN)\s+([a-z_][a-z0-9_]*)`)
+	tableAliasRe    = regexp.MustCompile(`(?i)\b(?:FROM|JOIN)\s+([a-z_][a-z0-9_]*)(?:\s+(?:AS\s+)?([a-z_][a-z0-9_]*))?`)
+	qualifiedRe     = regexp.MustCompile(`(?i)\b([a-z_][a-z0-9_]*)\.([a-z_][a-z0-9_]*)\b`)
+	selectListRe    = regexp.MustCompile(`(?is)^\s*SELECT\s+(?:DISTINCT\s+)?(.*?)\s+FROM\b`)
+	selectItemRe    = regexp.MustCompile(`(?i)^([a-z_][a-z0-9_]*)(?:\s+(?:AS\s+)?[a-z_][a-z0-9_]*)?$`)
+	// WITH name AS (...), or name(columns) AS (...)
+	cteRe = regexp.MustCompile(`(?i)\b([a-z_][a-z0-9_]*)\s*(?:\([^()]*\))?\s+AS\s*\(`)
+)
+
+// aliasKeywords may follow a table name, and are not aliases.
+var aliasKeywords = map[string]bool{
+	"cross": true, "group": true, "having": true, "inner": true, "join": true, "left": true, "limit": true,
+	"natural": true, "on": true, "order": true, "outer": true, "union": true, "using": true, "where": true,
+}
+
+// Tables naively extracts the table names referenced by FROM and JOIN clauses of a query.
+func Tables(sql string) []string {
+	sql = stringLiteralRe.ReplaceAllString(sql, "''")
+
+	seen := map[string]bool{}
+	tables := []string{}
+	for _, match := range tableRe.FindAllStringSubmatch(sql, -1) {
+		t := strings.ToLower(match[1])
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+// Columns naively extracts the columns referenced by a query, indexed by table name. Columns are found
+// when qualified by a table name or alias, or listed by name in the SELECT clause of a single-table query.
+func Columns(sql string) map[string][]string {
+	sql = stringLiteralRe.ReplaceAllString(sql, "''")
+
+	aliases := map[string]string{}
+	for _, match := range tableAliasRe.FindAllStringSubmatch(sql, -1) {
+		t := strings.ToLower(match[1])
+		aliases[t] = t
+		if a := strings.ToLower(match[2]); a != "" && !aliasKeywords[a] {
+			aliases[a] = t
+		}
+	}
+
+	seen := map[string]bool{}
+	cols := map[string][]string{}
+	add := func(t string, c string) {
+		c = strings.ToLower(c)
+		if seen[t+"."+c] {
+			return
+		}
+		seen[t+"."+c] = true
+		cols[t] = append(cols[t], c)
+	}
+
+	for _, match := range qualifiedRe.FindAllStringSubmatch(sql, -1) {
+		if t, ok := aliases[strings.ToLower(match[1])]; ok {
+			add(t, match[2])
+		}
+	}
+
+	if ts := Tables(sql); len(ts) == 1 {
+		if match := selectListRe.FindStringSubmatch(sql); match != nil {
+			for _, item := range strings.Split(match[1], ",") {
+				if m := selectItemRe.FindStringSubmatch(strings.TrimSpace(item)); m != nil {
+					add(ts[0], m[1])
+				}
+			}
+		}
+	}
+	return cols
+}
+
+// HasColumn returns true if the table is known to the schema, and has the column.
+func (s *Schema) HasColumn(table string, column string) bool {
+	t := s.Tables[strings.ToLower(table)]
+	if t == nil {
+		return false
+	}
+	for _, c := range t.Columns {
+		if strings.EqualFold(c.Name, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnknownColumns returns the sorted list of "table.column" references within a query to columns which are
+// not in the schema. References to unknown tables are ignored, as they are reported by UnknownTables.
+func (s *Schema) UnknownColumns(sql string) []string {
+	unknown := []string{}
+	for t, cs := range Columns(sql) {
+		if !s.HasTable(t) {
+			continue
+		}
+		for _, c := range cs {
+			if !s.HasColumn(t, c) {
+				unknown = append(unknown, t+"."+c)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// UnknownTables returns the sorted list of tables referenced by a query which are not in the schema,
+// ignoring those defined by the query itself as common table expressions.
+func (s *Schema) UnknownTables(sql string) []string {
+	ctes := map[string]bool{}
+	for _, match := range cteRe.FindAllStringSubmatch(stringLiteralRe.ReplaceAllString(sql, "''"), -1) {
+		ctes[strings.ToLower(match[1])] = true
+	}
+
+	unknown := []string{}
+	for _, t := range Tables(sql) {
+		if s.HasTable(t) || ctes[t] || sqliteTables[t] || strings.HasPrefix(t, "pragma_") {
+			continue
+		}
+		unknown = append(unknown, t)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTables(t *testing.T) {
+	sql := `SELECT p.name, u.username FROM processes p
+JOIN users u ON p.uid = u.uid
+LEFT JOIN process_open_sockets s USING (pid)
+WHERE p.cmdline LIKE '%from fake_table%'`
+
+	want := []string{"processes", "users", "process_open_sockets"}
+	if diff := cmp.Diff(want, Tables(sql)); diff != "" {
+		t.Errorf("Tables() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestUnknownTables(t *testing.T) {
+	s, err := Default()
+	if err != nil {
+		t.Fatalf("Default: %v", err)
+	}
+
+	sql := "SELECT * FROM acme_agents JOIN processes USING (pid), json_each(processes.cmdline);"
+	if diff := cmp.Diff([]string{"acme_agents"}, s.UnknownTables(sql)); diff != "" {
+		t.Errorf("UnknownTables() mismatch (-want +got):\n%s", diff)
+	}
+
+	extra, err := LoadFile("testdata/extension.json")
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	s.Merge(extra)
+
+	if got := s.UnknownTables(sql); len(got) != 0 {
+		t.Errorf("UnknownTables() with extra schema = %v, want none", got)
+	}
+
+	cte := "WITH RECURSIVE tree(pid) AS (SELECT 1 UNION SELECT p.pid FROM processes p JOIN tree ON p.parent = tree.pid), " +
+		"top AS (SELECT * FROM tree) SELECT * FROM top JOIN proceses USING (pid);"
+	if diff := cmp.Diff([]string{"proceses"}, s.UnknownTables(cte)); diff != "" {
+		t.Errorf("UnknownTables() with common table expressions mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestColumns(t *testing.T) {
+	sql := `SELECT p.name, u.username, p.pid AS process_id FROM processes AS p
+JOIN users u ON p.uid = u.uid
+WHERE p.cmdline LIKE '%x.y%'`
+
+	want := map[string][]string{
+		"processes": {"name", "pid", "uid", "cmdline"},
+		"users":     {"username", "uid"},
+	}
+	if diff := cmp.Diff(want, Columns(sql)); diff != "" {
+		t.Errorf("Columns() mismatch (-want +got):\n%s", diff)
+	}
+
+	want = map[string][]string{"processes": {"pid", "name"}}
+	if diff := cmp.Diff(want, Columns("SELECT pid, name AS n, count(*) FROM processes WHERE uid = 0")); diff != "" {
+		t.Errorf("Columns() single table mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestUnknownColumnsByVersion(t *testing.T) {
+	sql := "SELECT pid, cgroup_path FROM processes;"
+
+	s, err := LoadVersion("testdata/versions", "5.10.0")
+	if err != nil {
+		t.Fatalf("LoadVersion: %v", err)
+	}
+	if got := s.UnknownColumns(sql); len(got) != 0 {
+		t.Errorf("UnknownColumns() in 5.10.0 = %v, want none", got)
+	}
+
+	s, err = LoadVersion("testdata/versions", "5.9.0")
+	if err != nil {
+		t.Fatalf("LoadVersion: %v", err)
+	}
+	if diff := cmp.Diff([]string{"processes.cgroup_path"}, s.UnknownColumns(sql)); diff != "" {
+		t.Errorf("UnknownColumns() in 5.9.0 mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := LoadVersion("testdata/versions", "4.0.0"); err == nil {
+		t.Errorf("LoadVersion() = nil error, want error for missing snapshot")
+	}
+}